@@ -1,9 +1,5 @@
 package db
 
-import (
-	"unicode"
-)
-
 // Read returns Attributes from the corresponding entry from the DB
 func (db *DB) Read(key string, attributes []string) (*Entry, error) {
 	var result *Entry
@@ -18,27 +14,14 @@ func (db *DB) Read(key string, attributes []string) (*Entry, error) {
 	if err != nil {
 		return nil, err
 	}
-	values := make(map[string]*Value)
-	for _, name := range attributes {
-		if value, ok := result.Attributes[name]; ok {
-			values[name] = value
-		} else {
-			values[name] = nil
-		}
-	}
-	result.Attributes = values
-	return result, nil
+	return selectAttributes(result, attributes), nil
 }
 
 // Scan takes a key and finds all entries that are greater than or equal to that key
 func (db *DB) Scan(key string, attributes []string) (result []*Entry, err error) {
-	maxRunes := []rune{}
-	for i := 0; i < KeySize; i++ {
-		maxRunes = append(maxRunes, unicode.MaxASCII)
-	}
-	maxKey := string(maxRunes)
 	err = db.ViewTxn(func(txn *Txn) error {
-		entries, err := txn.Scan(key, maxKey)
+		// An empty end key with prefixEnd leaves the range without an end
+		entries, err := txn.scan(&keyRange{startKey: key, prefixEnd: true})
 		if err != nil {
 			return err
 		}
@@ -48,20 +31,30 @@ func (db *DB) Scan(key string, attributes []string) (result []*Entry, err error)
 	if err != nil {
 		return nil, err
 	}
-	for _, entry := range result {
-		values := make(map[string]*Value)
-		for _, name := range attributes {
-			if value, ok := entry.Attributes[name]; ok {
-				values[name] = value
-			} else {
-				values[name] = nil
-			}
-		}
-		entry.Attributes = values
+	for i, entry := range result {
+		result[i] = selectAttributes(entry, attributes)
 	}
 	return result, err
 }
 
+// selectAttributes returns a copy of the entry with only the given attributes. Entries returned from
+// the DB are shared with the memtable so they must never be modified in place
+func selectAttributes(entry *Entry, attributes []string) *Entry {
+	values := make(map[string]*Value)
+	for _, name := range attributes {
+		if value, ok := entry.Attributes[name]; ok {
+			values[name] = value
+		} else {
+			values[name] = nil
+		}
+	}
+	return &Entry{
+		ts:         entry.ts,
+		Key:        entry.Key,
+		Attributes: values,
+	}
+}
+
 // Update updates certain Attributes in an entry
 func (db *DB) Update(key string, values map[string]*Value) error {
 	exists, err := db.exists(key)
@@ -76,11 +69,14 @@ func (db *DB) Update(key string, values map[string]*Value) error {
 		if err != nil {
 			return err
 		}
+		attributes := make(map[string]*Value)
+		for name, value := range entry.Attributes {
+			attributes[name] = value
+		}
 		for name, value := range values {
-			entry.Attributes[name] = value
+			attributes[name] = value
 		}
-		txn.Write(key, entry.Attributes)
-		return nil
+		return txn.Write(key, attributes)
 	})
 	return err
 }
@@ -95,8 +91,7 @@ func (db *DB) Insert(key string, values map[string]*Value) error {
 		return newErrKeyAlreadyExists(key)
 	}
 	err = db.UpdateTxn(func(txn *Txn) error {
-		txn.Write(key, values)
-		return nil
+		return txn.Write(key, values)
 	})
 	return err
 }
@@ -180,14 +180,13 @@ func find(root *avlNode, key string, ts uint64) *Entry {
 
 func commonParent(root *avlNode, keyRange *keyRange) *avlNode {
 	startKey := keyRange.startKey
-	endKey := keyRange.endKey
 	if root == nil {
 		return nil
 	}
-	if startKey < root.key && endKey < root.key {
+	if startKey < root.key && keyRange.afterEnd(root.key) {
 		return commonParent(root.left, keyRange)
 	}
-	if startKey > root.key && endKey > root.key {
+	if startKey > root.key {
 		return commonParent(root.right, keyRange)
 	}
 	return root
@@ -195,11 +194,10 @@ func commonParent(root *avlNode, keyRange *keyRange) *avlNode {
 
 func rangeQuery(root *avlNode, keyRange *keyRange, ts uint64) (entries []*Entry) {
 	startKey := keyRange.startKey
-	endKey := keyRange.endKey
 	if root == nil {
 		return entries
 	}
-	if startKey <= root.key && root.key <= endKey {
+	if keyRange.contains(root.key) {
 		leftKeys := rangeQuery(root.left, keyRange, ts)
 		rightKeys := rangeQuery(root.right, keyRange, ts)
 
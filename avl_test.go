@@ -1,6 +1,7 @@
 package db
 
 import (
+	"math"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -199,3 +200,55 @@ func TestAVLRandom(t *testing.T) {
 		}
 	}
 }
+
+func benchmarkMemStorePut(b *testing.B, store memStore) {
+	keys := rand.Perm(b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Put(simpleEntry(uint64(i), strconv.Itoa(keys[i]), "value"))
+	}
+}
+
+// benchmarkMemStoreReadWhileWriting measures reads while another goroutine keeps writing to the store
+func benchmarkMemStoreReadWhileWriting(b *testing.B, store memStore) {
+	numKeys := 10000
+	for i := 0; i < numKeys; i++ {
+		store.Put(simpleEntry(uint64(i), strconv.Itoa(i), "value"))
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := numKeys; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				store.Put(simpleEntry(uint64(i), strconv.Itoa(i%numKeys), "value"))
+			}
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			store.Find(strconv.Itoa(r.Intn(numKeys)), math.MaxUint64)
+		}
+	})
+	b.StopTimer()
+	close(done)
+}
+
+func BenchmarkAVLPut(b *testing.B) {
+	benchmarkMemStorePut(b, newAVLTree())
+}
+
+func BenchmarkSkipListPut(b *testing.B) {
+	benchmarkMemStorePut(b, newSkipList())
+}
+
+func BenchmarkAVLReadWhileWriting(b *testing.B) {
+	benchmarkMemStoreReadWhileWriting(b, newAVLTree())
+}
+
+func BenchmarkSkipListReadWhileWriting(b *testing.B) {
+	benchmarkMemStoreReadWhileWriting(b, newSkipList())
+}
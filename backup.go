@@ -0,0 +1,429 @@
+package db
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackupEngine stores backups of a DB in a directory of its own. Every file of a backup is stored once under the
+// hash of its content, so SST and value log files that did not change since an earlier backup are shared with it
+// instead of stored again. Each backup is a meta file listing its files. The backup directory is locked while the
+// engine is open
+type BackupEngine struct {
+	directory  string
+	lock       *dirLock
+	backupLock sync.Mutex
+}
+
+// BackupInfo describes a backup
+type BackupInfo struct {
+	ID        uint64
+	Timestamp time.Time
+	// Size is the total size of the files of the backup, including the files it shares with other backups
+	Size     int64
+	NumFiles int
+}
+
+// backupFile is a file of a backup: its path relative to the DB directory, and the hash and size of its content
+type backupFile struct {
+	path string
+	hash string
+	size int64
+}
+
+// backupMeta is the content of the meta file of a backup
+type backupMeta struct {
+	info  *BackupInfo
+	files []*backupFile
+}
+
+// OpenBackupEngine opens the backup directory, creating it if needed. Files left behind by a backup that did not
+// finish are removed
+func OpenBackupEngine(directory string) (*BackupEngine, error) {
+	for _, dir := range []string{backupSharedDir, backupMetaDir} {
+		err := os.MkdirAll(filepath.Join(directory, dir), dirPerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lock, err := lockDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+	be := &BackupEngine{directory: directory, lock: lock}
+	err = os.RemoveAll(filepath.Join(directory, backupTmpDir))
+	if err == nil {
+		err = be.removeUnreferenced()
+	}
+	if err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	return be, nil
+}
+
+// Close unlocks the backup directory
+func (be *BackupEngine) Close() error {
+	be.backupLock.Lock()
+	defer be.backupLock.Unlock()
+	return be.lock.unlock()
+}
+
+// CreateBackup backs up the DB as of a single point in time. The DB is checkpointed into the backup directory,
+// then every file of the checkpoint is hashed and only stored if no earlier backup has the same content
+func (be *BackupEngine) CreateBackup(db *DB) (*BackupInfo, error) {
+	be.backupLock.Lock()
+	defer be.backupLock.Unlock()
+
+	metas, err := be.readMetas()
+	if err != nil {
+		return nil, err
+	}
+	id := uint64(1)
+	if len(metas) > 0 {
+		id = metas[len(metas)-1].info.ID + 1
+	}
+
+	tmpDir := filepath.Join(be.directory, backupTmpDir)
+	err = os.MkdirAll(tmpDir, dirPerm)
+	if err != nil {
+		return nil, err
+	}
+	checkpointDir := filepath.Join(tmpDir, strconv.FormatUint(id, 10))
+	defer os.RemoveAll(checkpointDir)
+	err = db.Checkpoint(checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &backupMeta{info: &BackupInfo{ID: id, Timestamp: time.Now()}}
+	err = filepath.Walk(checkpointDir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		path, err := filepath.Rel(checkpointDir, filename)
+		if err != nil {
+			return err
+		}
+		hash, size, err := hashFile(filename)
+		if err != nil {
+			return err
+		}
+		file := &backupFile{path: filepath.ToSlash(path), hash: hash, size: size}
+		err = be.storeFile(filename, file)
+		if err != nil {
+			return err
+		}
+		meta.files = append(meta.files, file)
+		meta.info.Size += size
+		meta.info.NumFiles++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = be.writeMeta(meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta.info, nil
+}
+
+// storeFile copies a file of a new backup into the shared directory unless it is already there. The copy is
+// renamed into place once it is complete so a shared file is never partially written
+func (be *BackupEngine) storeFile(filename string, file *backupFile) error {
+	shared := sharedFilename(be.directory, file)
+	_, err := os.Stat(shared)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	tmp := shared + ".tmp"
+	os.Remove(tmp)
+	err = copyFile(filename, tmp)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, shared)
+}
+
+// Backups returns all backups, oldest first
+func (be *BackupEngine) Backups() ([]*BackupInfo, error) {
+	be.backupLock.Lock()
+	defer be.backupLock.Unlock()
+	metas, err := be.readMetas()
+	if err != nil {
+		return nil, err
+	}
+	infos := []*BackupInfo{}
+	for _, meta := range metas {
+		infos = append(infos, meta.info)
+	}
+	return infos, nil
+}
+
+// DeleteBackup deletes a backup along with the shared files no other backup has
+func (be *BackupEngine) DeleteBackup(id uint64) error {
+	be.backupLock.Lock()
+	defer be.backupLock.Unlock()
+	err := os.Remove(metaFilename(be.directory, id))
+	if os.IsNotExist(err) {
+		return newErrBackupNotFound(id)
+	}
+	if err != nil {
+		return err
+	}
+	return be.removeUnreferenced()
+}
+
+// PurgeOldBackups deletes all backups but the numToKeep newest ones, along with the shared files only they had.
+// It returns ErrInvalidNumBackups if numToKeep is negative
+func (be *BackupEngine) PurgeOldBackups(numToKeep int) error {
+	if numToKeep < 0 {
+		return newErrInvalidNumBackups(numToKeep)
+	}
+	be.backupLock.Lock()
+	defer be.backupLock.Unlock()
+	metas, err := be.readMetas()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(metas)-numToKeep; i++ {
+		err := os.Remove(metaFilename(be.directory, metas[i].info.ID))
+		if err != nil {
+			return err
+		}
+	}
+	return be.removeUnreferenced()
+}
+
+// VerifyBackup checks that every file of a backup is stored with the size and content hash it was backed up with.
+// It returns ErrBackupCorrupted for the first file that is missing or changed
+func (be *BackupEngine) VerifyBackup(id uint64) error {
+	be.backupLock.Lock()
+	defer be.backupLock.Unlock()
+	meta, err := readMeta(be.directory, id)
+	if err != nil {
+		return err
+	}
+	for _, file := range meta.files {
+		hash, size, err := hashFile(sharedFilename(be.directory, file))
+		if os.IsNotExist(err) {
+			return newErrBackupCorrupted(id, file.path, "file is missing")
+		}
+		if err != nil {
+			return err
+		}
+		if size != file.size {
+			return newErrBackupCorrupted(id, file.path, fmt.Sprintf("expected %d bytes, got %d", file.size, size))
+		}
+		if hash != file.hash {
+			return newErrBackupCorrupted(id, file.path, "content hash does not match")
+		}
+	}
+	return nil
+}
+
+// RestoreBackup copies the files of a backup into the DB directory, which must be empty or not exist yet, and
+// can then be opened with NewDB. Every file is checked against its content hash while it is copied. If restoring
+// fails, the files restored so far are removed. The backup must not be deleted while it is restored
+func RestoreBackup(backupDir string, id uint64, dbDir string) error {
+	meta, err := readMeta(backupDir, id)
+	if err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(dbDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(infos) > 0 {
+		return newErrDirectoryNotEmpty(dbDir)
+	}
+	err = os.MkdirAll(dbDir, dirPerm)
+	if err != nil {
+		return err
+	}
+	for _, file := range meta.files {
+		err := restoreFile(backupDir, id, file, filepath.Join(dbDir, filepath.FromSlash(file.path)))
+		if err != nil {
+			deleteData(dbDir)
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFile copies a shared file of a backup to its path in the DB directory while hashing it
+func restoreFile(backupDir string, id uint64, file *backupFile, target string) error {
+	src, err := os.Open(sharedFilename(backupDir, file))
+	if os.IsNotExist(err) {
+		return newErrBackupCorrupted(id, file.path, "file is missing")
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	err = os.MkdirAll(filepath.Dir(target), dirPerm)
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, filePerm)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	h := sha256.New()
+	size, err := io.Copy(dst, io.TeeReader(src, h))
+	if err != nil {
+		return err
+	}
+	if size != file.size || hex.EncodeToString(h.Sum(nil)) != file.hash {
+		return newErrBackupCorrupted(id, file.path, "content hash does not match")
+	}
+	return dst.Sync()
+}
+
+// removeUnreferenced deletes the shared files no backup has, including copies left by a backup that did not finish
+func (be *BackupEngine) removeUnreferenced() error {
+	metas, err := be.readMetas()
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]struct{})
+	for _, meta := range metas {
+		for _, file := range meta.files {
+			referenced[filepath.Base(sharedFilename(be.directory, file))] = struct{}{}
+		}
+	}
+	sharedDir := filepath.Join(be.directory, backupSharedDir)
+	infos, err := ioutil.ReadDir(sharedDir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if _, ok := referenced[info.Name()]; ok {
+			continue
+		}
+		err := os.Remove(filepath.Join(sharedDir, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMetas reads the meta files of all backups, sorted by id
+func (be *BackupEngine) readMetas() ([]*backupMeta, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(be.directory, backupMetaDir))
+	if err != nil {
+		return nil, err
+	}
+	metas := []*backupMeta{}
+	for _, info := range infos {
+		id, err := strconv.ParseUint(info.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		meta, err := readMeta(be.directory, id)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].info.ID < metas[j].info.ID
+	})
+	return metas, nil
+}
+
+// writeMeta writes the meta file of a new backup once all its files are stored. The meta file is renamed into
+// place once it is complete, which is the point at which the backup exists. Its first line is the time of the
+// backup, followed by one line per file with its hash, size and path
+func (be *BackupEngine) writeMeta(meta *backupMeta) error {
+	lines := []string{strconv.FormatInt(meta.info.Timestamp.UnixNano(), 10)}
+	for _, file := range meta.files {
+		lines = append(lines, file.hash+" "+strconv.FormatInt(file.size, 10)+" "+file.path)
+	}
+	filename := metaFilename(be.directory, meta.info.ID)
+	tmp := filename + ".tmp"
+	os.Remove(tmp)
+	err := writeNewFile(tmp, []byte(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// readMeta reads the meta file of a backup. It returns ErrBackupNotFound if there is no backup with the id
+func readMeta(backupDir string, id uint64) (*backupMeta, error) {
+	f, err := os.Open(metaFilename(backupDir, id))
+	if os.IsNotExist(err) {
+		return nil, newErrBackupNotFound(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	meta := &backupMeta{info: &BackupInfo{ID: id}}
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return nil, newErrBackupCorrupted(id, "meta", "missing timestamp")
+	}
+	nanos, err := strconv.ParseInt(scanner.Text(), 10, 64)
+	if err != nil {
+		return nil, newErrBackupCorrupted(id, "meta", "invalid timestamp")
+	}
+	meta.info.Timestamp = time.Unix(0, nanos)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return nil, newErrBackupCorrupted(id, "meta", "invalid file line")
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, newErrBackupCorrupted(id, "meta", "invalid file size")
+		}
+		meta.files = append(meta.files, &backupFile{path: fields[2], hash: fields[0], size: size})
+		meta.info.Size += size
+		meta.info.NumFiles++
+	}
+	return meta, scanner.Err()
+}
+
+func metaFilename(backupDir string, id uint64) string {
+	return filepath.Join(backupDir, backupMetaDir, strconv.FormatUint(id, 10))
+}
+
+// sharedFilename is the name a file is stored under in the shared directory: its content hash and its extension
+func sharedFilename(backupDir string, file *backupFile) string {
+	return filepath.Join(backupDir, backupSharedDir, file.hash+filepath.Ext(file.path))
+}
+
+// hashFile returns the SHA-256 hash of the content of a file and its size
+func hashFile(filename string) (string, int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
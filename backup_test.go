@@ -0,0 +1,316 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupBackupEngine opens a backup engine in an empty directory
+func setupBackupEngine(directory string) (*BackupEngine, error) {
+	err := os.RemoveAll(directory)
+	if err != nil {
+		return nil, err
+	}
+	return OpenBackupEngine(directory)
+}
+
+// checkRestore restores a backup into an empty directory and checks the first numKeys keys have the given version
+func checkRestore(backupDir string, id uint64, numKeys, version int) error {
+	os.RemoveAll("restore")
+	err := RestoreBackup(backupDir, id, "restore")
+	if err != nil {
+		return err
+	}
+	db, err := NewDB("restore")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return checkLargeValues(db, numKeys, version)
+}
+
+func TestBackupRestore(t *testing.T) {
+	// Without compaction, the level 0 files of the first backup are unchanged in the second one
+	opts := DefaultOptions()
+	opts.ValueThreshold = 64
+	opts.CompactionStrategy = &noCompaction{}
+	opts.L0SlowdownWritesTrigger = 1000
+	opts.L0StopWritesTrigger = 1000
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+	be, err := setupBackupEngine("backup")
+	if err != nil {
+		t.Fatalf("Error opening backup engine: %v\n", err)
+	}
+	defer os.RemoveAll("backup")
+	defer os.RemoveAll("restore")
+	defer be.Close()
+
+	err = writeLargeValues(db, 100, 1)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	first, err := be.CreateBackup(db)
+	if err != nil {
+		t.Fatalf("Error creating backup: %v\n", err)
+	}
+	// The second backup has values in level 0, the value log and the WALs
+	err = writeLargeValues(db, 100, 2)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	err = writeLargeValues(db, 50, 3)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	second, err := be.CreateBackup(db)
+	if err != nil {
+		t.Fatalf("Error creating backup: %v\n", err)
+	}
+
+	backups, err := be.Backups()
+	if err != nil {
+		t.Fatalf("Error listing backups: %v\n", err)
+	}
+	if len(backups) != 2 || backups[0].ID != first.ID || backups[1].ID != second.ID {
+		t.Fatalf("Expected backups %d and %d, Got: %v\n", first.ID, second.ID, backups)
+	}
+	if backups[1].NumFiles != second.NumFiles || backups[1].Size != second.Size {
+		t.Fatalf("Expected listed backup to match created backup\n")
+	}
+
+	// Files of the first backup that did not change are shared with the second one
+	shared, err := ioutil.ReadDir(filepath.Join("backup", backupSharedDir))
+	if err != nil {
+		t.Fatalf("Error reading shared directory: %v\n", err)
+	}
+	if len(shared) >= first.NumFiles+second.NumFiles {
+		t.Fatalf("Expected fewer than %d shared files, Got: %d\n", first.NumFiles+second.NumFiles, len(shared))
+	}
+	firstMeta, err := readMeta("backup", first.ID)
+	if err != nil {
+		t.Fatalf("Error reading backup meta: %v\n", err)
+	}
+	secondMeta, err := readMeta("backup", second.ID)
+	if err != nil {
+		t.Fatalf("Error reading backup meta: %v\n", err)
+	}
+	hashes := make(map[string]string)
+	for _, file := range secondMeta.files {
+		hashes[file.path] = file.hash
+	}
+	for _, file := range firstMeta.files {
+		if filepath.Ext(file.path) == ".sst" && hashes[file.path] != file.hash {
+			t.Fatalf("Expected %s to be shared by both backups\n", file.path)
+		}
+	}
+
+	for _, info := range backups {
+		err = be.VerifyBackup(info.ID)
+		if err != nil {
+			t.Fatalf("Error verifying backup %d: %v\n", info.ID, err)
+		}
+	}
+
+	err = checkRestore("backup", first.ID, 100, 1)
+	if err != nil {
+		t.Fatalf("Error restoring first backup: %v\n", err)
+	}
+	err = checkRestore("backup", second.ID, 50, 3)
+	if err != nil {
+		t.Fatalf("Error restoring second backup: %v\n", err)
+	}
+	err = RestoreBackup("backup", second.ID, "restore")
+	if _, ok := err.(*ErrDirectoryNotEmpty); !ok {
+		t.Fatalf("Expected restore into a DB directory to return ErrDirectoryNotEmpty, Got: %v\n", err)
+	}
+
+	// The backup directory can only be opened by one engine at a time
+	_, err = OpenBackupEngine("backup")
+	if _, ok := err.(*ErrDirectoryLocked); !ok {
+		t.Fatalf("Expected ErrDirectoryLocked, Got: %v\n", err)
+	}
+}
+
+func TestBackupPurge(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueThreshold = 64
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+	be, err := setupBackupEngine("backup")
+	if err != nil {
+		t.Fatalf("Error opening backup engine: %v\n", err)
+	}
+	defer os.RemoveAll("backup")
+	defer os.RemoveAll("restore")
+	defer be.Close()
+
+	for version := 1; version <= 3; version++ {
+		err = writeLargeValues(db, 100, version)
+		if err != nil {
+			t.Fatalf("Error writing to db: %v\n", err)
+		}
+		err = db.Flush()
+		if err != nil {
+			t.Fatalf("Error flushing memtable: %v\n", err)
+		}
+		info, err := be.CreateBackup(db)
+		if err != nil {
+			t.Fatalf("Error creating backup: %v\n", err)
+		}
+		if info.ID != uint64(version) {
+			t.Fatalf("Expected backup id %d, Got: %d\n", version, info.ID)
+		}
+	}
+
+	if _, ok := be.PurgeOldBackups(-1).(*ErrInvalidNumBackups); !ok {
+		t.Fatalf("Expected purge with a negative amount of backups to return ErrInvalidNumBackups\n")
+	}
+	err = be.PurgeOldBackups(1)
+	if err != nil {
+		t.Fatalf("Error purging backups: %v\n", err)
+	}
+	backups, err := be.Backups()
+	if err != nil {
+		t.Fatalf("Error listing backups: %v\n", err)
+	}
+	if len(backups) != 1 || backups[0].ID != 3 {
+		t.Fatalf("Expected only backup 3 to be kept, Got: %v\n", backups)
+	}
+	if _, ok := checkRestore("backup", 1, 100, 1).(*ErrBackupNotFound); !ok {
+		t.Fatalf("Expected restore of purged backup to return ErrBackupNotFound\n")
+	}
+
+	// Only the files of the kept backup are left
+	meta, err := readMeta("backup", 3)
+	if err != nil {
+		t.Fatalf("Error reading backup meta: %v\n", err)
+	}
+	kept := make(map[string]struct{})
+	for _, file := range meta.files {
+		kept[filepath.Base(sharedFilename("backup", file))] = struct{}{}
+	}
+	shared, err := ioutil.ReadDir(filepath.Join("backup", backupSharedDir))
+	if err != nil {
+		t.Fatalf("Error reading shared directory: %v\n", err)
+	}
+	if len(shared) != len(kept) {
+		t.Fatalf("Expected %d shared files after purge, Got: %d\n", len(kept), len(shared))
+	}
+	err = checkRestore("backup", 3, 100, 3)
+	if err != nil {
+		t.Fatalf("Error restoring kept backup: %v\n", err)
+	}
+
+	err = be.DeleteBackup(3)
+	if err != nil {
+		t.Fatalf("Error deleting backup: %v\n", err)
+	}
+	if _, ok := be.DeleteBackup(3).(*ErrBackupNotFound); !ok {
+		t.Fatalf("Expected second delete to return ErrBackupNotFound\n")
+	}
+	shared, err = ioutil.ReadDir(filepath.Join("backup", backupSharedDir))
+	if err != nil {
+		t.Fatalf("Error reading shared directory: %v\n", err)
+	}
+	if len(shared) != 0 {
+		t.Fatalf("Expected no shared files after deleting all backups, Got: %d\n", len(shared))
+	}
+}
+
+func TestVerifyBackupCorrupted(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueThreshold = 64
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+	be, err := setupBackupEngine("backup")
+	if err != nil {
+		t.Fatalf("Error opening backup engine: %v\n", err)
+	}
+	defer os.RemoveAll("backup")
+	defer os.RemoveAll("restore")
+	defer be.Close()
+
+	err = writeLargeValues(db, 100, 1)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	info, err := be.CreateBackup(db)
+	if err != nil {
+		t.Fatalf("Error creating backup: %v\n", err)
+	}
+	meta, err := readMeta("backup", info.ID)
+	if err != nil {
+		t.Fatalf("Error reading backup meta: %v\n", err)
+	}
+
+	// Flip a byte of an SST file without changing its size
+	var sst *backupFile
+	for _, file := range meta.files {
+		if filepath.Ext(file.path) == ".sst" {
+			sst = file
+		}
+	}
+	if sst == nil {
+		t.Fatalf("Expected an SST file in the backup\n")
+	}
+	data, err := ioutil.ReadFile(sharedFilename("backup", sst))
+	if err != nil {
+		t.Fatalf("Error reading shared file: %v\n", err)
+	}
+	data[len(data)/2] ^= 0xff
+	err = ioutil.WriteFile(sharedFilename("backup", sst), data, filePerm)
+	if err != nil {
+		t.Fatalf("Error writing shared file: %v\n", err)
+	}
+
+	if _, ok := be.VerifyBackup(info.ID).(*ErrBackupCorrupted); !ok {
+		t.Fatalf("Expected verify of corrupted backup to return ErrBackupCorrupted\n")
+	}
+	os.RemoveAll("restore")
+	err = RestoreBackup("backup", info.ID, "restore")
+	if _, ok := err.(*ErrBackupCorrupted); !ok {
+		t.Fatalf("Expected restore of corrupted backup to return ErrBackupCorrupted, Got: %v\n", err)
+	}
+	files, err := ioutil.ReadDir("restore")
+	if err != nil {
+		t.Fatalf("Error reading restore directory: %v\n", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected failed restore to remove restored files, Got: %d\n", len(files))
+	}
+
+	err = os.Remove(sharedFilename("backup", sst))
+	if err != nil {
+		t.Fatalf("Error removing shared file: %v\n", err)
+	}
+	if _, ok := be.VerifyBackup(info.ID).(*ErrBackupCorrupted); !ok {
+		t.Fatalf("Expected verify of backup with a missing file to return ErrBackupCorrupted\n")
+	}
+	if _, ok := be.VerifyBackup(info.ID + 1).(*ErrBackupNotFound); !ok {
+		t.Fatalf("Expected verify of unknown backup to return ErrBackupNotFound\n")
+	}
+}
@@ -0,0 +1,54 @@
+package db
+
+import "sync"
+
+// backgroundError is the first flush or compaction failure that persisted after maxBackgroundRetries attempts.
+// While it is set, the DB is read only
+type backgroundError struct {
+	err  error
+	lock sync.RWMutex
+}
+
+// set records the error unless an earlier one is already recorded
+func (bg *backgroundError) set(err error) {
+	bg.lock.Lock()
+	defer bg.lock.Unlock()
+	if bg.err == nil {
+		bg.err = err
+	}
+}
+
+// get returns the recorded error, or nil if there is none
+func (bg *backgroundError) get() error {
+	bg.lock.RLock()
+	defer bg.lock.RUnlock()
+	if bg.err == nil {
+		return nil
+	}
+	return newErrBackgroundError(bg.err)
+}
+
+func (bg *backgroundError) clear() {
+	bg.lock.Lock()
+	defer bg.lock.Unlock()
+	bg.err = nil
+}
+
+// BackgroundError returns the flush or compaction failure that made the DB read only, or nil if writes are allowed
+func (db *DB) BackgroundError() error {
+	return db.lsm.bgErr.get()
+}
+
+// Resume clears the background error once its cause is fixed, for example by freeing disk space, and makes the DB
+// writable again. It flushes the memtables, retrying a failed flush, and returns once they are flushed.
+// If the flush fails again, the DB stays read only and the new error is returned
+func (db *DB) Resume() error {
+	err := db.acquireWrite()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+	db.lsm.bgErr.clear()
+	db.lsm.maybeCompact()
+	return db.flushMemTables()
+}
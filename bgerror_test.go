@@ -0,0 +1,230 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackgroundErrorFlush(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	value, _ := CreateValue("value")
+	err = db.Insert("key", map[string]*Value{"value": value})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+	// Flushes fail while the level 0 directory is missing
+	err = os.RemoveAll("data/L0")
+	if err != nil {
+		t.Fatalf("Error removing level 0 directory: %v\n", err)
+	}
+	err = db.Flush()
+	if _, ok := err.(*ErrBackgroundError); !ok {
+		t.Fatalf("Expected background error from flush, Got: %v\n", err)
+	}
+	if _, ok := db.BackgroundError().(*ErrBackgroundError); !ok {
+		t.Fatalf("Expected background error to be set, Got: %v\n", db.BackgroundError())
+	}
+	err = db.Insert("other", map[string]*Value{"value": value})
+	if _, ok := err.(*ErrBackgroundError); !ok {
+		t.Fatalf("Expected background error from write, Got: %v\n", err)
+	}
+	entry, err := db.Read("key", []string{"value"})
+	if err != nil || string(entry.Attributes["value"].Data) != "value" {
+		t.Fatalf("Error reading key while read only: %v\n", err)
+	}
+
+	// Resuming before the cause is fixed fails again
+	err = db.Resume()
+	if _, ok := err.(*ErrBackgroundError); !ok {
+		t.Fatalf("Expected background error from resume, Got: %v\n", err)
+	}
+
+	err = os.MkdirAll("data/L0", dirPerm)
+	if err != nil {
+		t.Fatalf("Error creating level 0 directory: %v\n", err)
+	}
+	err = db.Resume()
+	if err != nil {
+		t.Fatalf("Error resuming: %v\n", err)
+	}
+	if db.BackgroundError() != nil {
+		t.Fatalf("Expected background error to be cleared, Got: %v\n", db.BackgroundError())
+	}
+	if db.lsm.levels[0].numFiles() != 1 {
+		t.Fatalf("Expected memtable to be flushed after resume\n")
+	}
+	err = db.Insert("other", map[string]*Value{"value": value})
+	if err != nil {
+		t.Fatalf("Error inserting into db after resume: %v\n", err)
+	}
+}
+
+func TestBackgroundErrorCompaction(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	// Compactions into level 1 fail while its directory is missing
+	err = os.RemoveAll("data/L1")
+	if err != nil {
+		t.Fatalf("Error removing level 1 directory: %v\n", err)
+	}
+	for i := 0; i < compactThreshold; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+		err = db.Flush()
+		if err != nil {
+			t.Fatalf("Error flushing memtable: %v\n", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for db.BackgroundError() == nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, ok := db.BackgroundError().(*ErrBackgroundError); !ok {
+		t.Fatalf("Expected background error from compaction, Got: %v\n", db.BackgroundError())
+	}
+	value, _ := CreateValue("value")
+	err = db.Insert("key", map[string]*Value{"value": value})
+	if _, ok := err.(*ErrBackgroundError); !ok {
+		t.Fatalf("Expected background error from write, Got: %v\n", err)
+	}
+
+	err = os.MkdirAll("data/L1", dirPerm)
+	if err != nil {
+		t.Fatalf("Error creating level 1 directory: %v\n", err)
+	}
+	err = db.Resume()
+	if err != nil {
+		t.Fatalf("Error resuming: %v\n", err)
+	}
+	deadline = time.Now().Add(3 * time.Second)
+	for db.lsm.levels[0].numFiles() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if db.lsm.levels[0].numFiles() > 0 || db.BackgroundError() != nil {
+		t.Fatalf("Expected level 0 to be compacted after resume, Got: %v\n", db.BackgroundError())
+	}
+	for i := 0; i < compactThreshold; i++ {
+		key := strconv.Itoa(10000 + i)
+		entry, err := db.Read(key, []string{"value"})
+		if err != nil || string(entry.Attributes["value"].Data) != key {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+	}
+}
+
+func TestBackgroundErrorStalledWrites(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxImmutableMemTables = 1
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	// The first flush waits on the value log until the writers are stopped, then fails while the level 0 directory
+	// is missing until the DB becomes read only
+	err = os.RemoveAll("data/L0")
+	if err != nil {
+		t.Fatalf("Error removing level 0 directory: %v\n", err)
+	}
+	db.vlog.fileLock.Lock()
+	numWriters := 16
+	errs, err := startStoppedWriters(db, numWriters)
+	db.vlog.fileLock.Unlock()
+	if err != nil {
+		t.Fatalf("Error stopping writes: %v\n", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for w := 0; w < 2*numWriters; w++ {
+		select {
+		case err := <-errs:
+			if _, ok := err.(*ErrBackgroundError); !ok {
+				t.Fatalf("Expected background error from stopped write, Got: %v\n", err)
+			}
+		case <-timeout:
+			t.Fatalf("Expected all stopped writes to return the background error, %d still waiting\n", 2*numWriters-w)
+		}
+	}
+}
+
+func TestBackgroundErrorMemTable(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	// The WAL of the next memtable cannot be created while a directory is in its place. A single failure is retried
+	walName := filepath.Join("data", "memtables", strconv.FormatUint(db.wc.memTableID+1, 10))
+	err = os.Mkdir(walName, dirPerm)
+	if err != nil {
+		t.Fatalf("Error creating directory: %v\n", err)
+	}
+	value, _ := CreateValue(strings.Repeat("v", 8*KB))
+	for i := 0; i < 2; i++ {
+		err = db.Insert(strconv.Itoa(i), map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	err = os.Remove(walName)
+	if err != nil {
+		t.Fatalf("Error removing directory: %v\n", err)
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable after a retried rotation: %v\n", err)
+	}
+
+	// Once the rotation failed maxBackgroundRetries times in a row, the DB becomes read only
+	walName = filepath.Join("data", "memtables", strconv.FormatUint(db.wc.memTableID+1, 10))
+	err = os.Mkdir(walName, dirPerm)
+	if err != nil {
+		t.Fatalf("Error creating directory: %v\n", err)
+	}
+	for i := 2; i < 100 && err == nil; i++ {
+		err = db.Insert(strconv.Itoa(i), map[string]*Value{"value": value})
+	}
+	if _, ok := err.(*ErrBackgroundError); !ok {
+		t.Fatalf("Expected background error from write, Got: %v\n", err)
+	}
+	if _, ok := db.Flush().(*ErrBackgroundError); !ok {
+		t.Fatalf("Expected background error from flush\n")
+	}
+
+	err = os.Remove(walName)
+	if err != nil {
+		t.Fatalf("Error removing directory: %v\n", err)
+	}
+	err = db.Resume()
+	if err != nil {
+		t.Fatalf("Error resuming: %v\n", err)
+	}
+	err = db.Insert("other", map[string]*Value{"value": value})
+	if err != nil {
+		t.Fatalf("Error inserting into db after resume: %v\n", err)
+	}
+	entry, err := db.Read("0", []string{"value"})
+	if err != nil || string(entry.Attributes["value"].Data) != string(value.Data) {
+		t.Fatalf("Error reading key written before the background error: %v\n", err)
+	}
+}
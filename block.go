@@ -0,0 +1,273 @@
+package db
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Blocks of restartVersion files are a sequence of records followed by the offsets of their restart points and
+// the amount of restart points, each a 4 byte integer. A record is the length of the prefix it shares with the
+// previous key, the length of the rest of the key, and the length of the value as varints, then the rest of the
+// key and the value. Records at restart points share nothing with the previous key.
+
+// blockBuilder builds a block of prefix compressed records with restart points every blockRestartInterval keys
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	counter  int
+	lastKey  string
+}
+
+func newBlockBuilder() *blockBuilder {
+	return &blockBuilder{
+		buf:      []byte{},
+		restarts: []uint32{},
+	}
+}
+
+// add appends a record to the block. Keys must be added in sorted order
+func (b *blockBuilder) add(key string, value []byte) {
+	shared := 0
+	if b.counter%blockRestartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		for shared < len(key) && shared < len(b.lastKey) && key[shared] == b.lastKey[shared] {
+			shared++
+		}
+	}
+	b.buf = appendUvarint(b.buf, uint64(shared))
+	b.buf = appendUvarint(b.buf, uint64(len(key)-shared))
+	b.buf = appendUvarint(b.buf, uint64(len(value)))
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+	b.counter++
+	b.lastKey = key
+}
+
+func (b *blockBuilder) empty() bool {
+	return b.counter == 0
+}
+
+// size returns the size the block would have if it was finished now
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+// finish appends the restart points and returns the block. The builder is reset for the next block
+func (b *blockBuilder) finish() []byte {
+	block := b.buf
+	for _, restart := range b.restarts {
+		block = append(block, uint32ToBytes(restart)...)
+	}
+	block = append(block, uint32ToBytes(uint32(len(b.restarts)))...)
+	*b = *newBlockBuilder()
+	return block
+}
+
+// blockReader reads the records of a block built by blockBuilder
+type blockReader struct {
+	data     []byte
+	restarts []byte
+}
+
+func newBlockReader(block []byte) (*blockReader, error) {
+	if len(block) < 4 {
+		return nil, newErrBadFormattedSST()
+	}
+	numRestarts := uint64(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	if numRestarts*4 > uint64(len(block)-4) {
+		return nil, newErrBadFormattedSST()
+	}
+	recordsEnd := len(block) - 4 - int(numRestarts)*4
+	return &blockReader{
+		data:     block[:recordsEnd],
+		restarts: block[recordsEnd : len(block)-4],
+	}, nil
+}
+
+func (r *blockReader) numRestarts() int {
+	return len(r.restarts) / 4
+}
+
+func (r *blockReader) restart(i int) int {
+	return int(binary.LittleEndian.Uint32(r.restarts[4*i : 4*i+4]))
+}
+
+// record decodes the record at offset given the key of the previous record, and returns the offset of the next one
+func (r *blockReader) record(offset int, prevKey string) (key string, value []byte, next int, err error) {
+	i := offset
+	var lengths [3]uint64
+	for j := range lengths {
+		if i >= len(r.data) {
+			return "", nil, 0, newErrBadFormattedSST()
+		}
+		length, n := binary.Uvarint(r.data[i:])
+		if n <= 0 {
+			return "", nil, 0, newErrBadFormattedSST()
+		}
+		lengths[j] = length
+		i += n
+	}
+	shared, unshared, valueSize := lengths[0], lengths[1], lengths[2]
+	if shared > uint64(len(prevKey)) || uint64(len(r.data)-i) < unshared || uint64(len(r.data)-i)-unshared < valueSize {
+		return "", nil, 0, newErrBadFormattedSST()
+	}
+	key = prevKey[:shared] + string(r.data[i:i+int(unshared)])
+	i += int(unshared)
+	value = r.data[i : i+int(valueSize)]
+	return key, value, i + int(valueSize), nil
+}
+
+// seek returns the offset of the restart point to scan from for the first record with a key not less than key.
+// It binary searches for the last restart point whose key is less than key
+func (r *blockReader) seek(key string) (int, error) {
+	var err error
+	i := sort.Search(r.numRestarts(), func(i int) bool {
+		restartKey, _, _, e := r.record(r.restart(i), "")
+		if e != nil {
+			err = e
+			return true
+		}
+		return restartKey >= key
+	})
+	if err != nil {
+		return 0, err
+	}
+	if i == 0 {
+		return 0, nil
+	}
+	return r.restart(i - 1), nil
+}
+
+// scan calls fn on every record from offset until the end of the block or until fn returns false
+func (r *blockReader) scan(offset int, fn func(key string, value []byte) (bool, error)) error {
+	key := ""
+	for offset < len(r.data) {
+		nextKey, value, next, err := r.record(offset, key)
+		if err != nil {
+			return err
+		}
+		key, offset = nextKey, next
+		more, err := fn(key, value)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeBlockEntry encodes the ts and attributes of an entry as the value of its record in a data block
+func encodeBlockEntry(entry *Entry) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, entry.ts)
+	return encodeAttributes(data, entry.Attributes)
+}
+
+func decodeBlockEntry(key string, value []byte) (*Entry, error) {
+	if len(value) < 8 {
+		return nil, newErrDecodeEntry()
+	}
+	attributes, err := decodeAttributes(value[8:])
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{
+		ts:         binary.LittleEndian.Uint64(value[:8]),
+		Key:        key,
+		Attributes: attributes,
+	}, nil
+}
+
+// decodeRestartBlock decodes all entries in a data block of a restartVersion file
+func decodeRestartBlock(block []byte) ([]*Entry, error) {
+	reader, err := newBlockReader(block)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	err = reader.scan(0, func(key string, value []byte) (bool, error) {
+		entry, err := decodeBlockEntry(key, value)
+		if err != nil {
+			return false, err
+		}
+		entries = append(entries, entry)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// seekRestartBlock returns the latest version of the key older than ts in a data block of a restartVersion file.
+// Only the records from the closest restart point before the key are decoded
+func seekRestartBlock(key string, ts uint64, block []byte) (*Entry, error) {
+	reader, err := newBlockReader(block)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := reader.seek(key)
+	if err != nil {
+		return nil, err
+	}
+	var result *Entry
+	err = reader.scan(offset, func(recordKey string, value []byte) (bool, error) {
+		if recordKey < key {
+			return true, nil
+		}
+		if recordKey > key {
+			return false, nil
+		}
+		if len(value) < 8 {
+			return false, newErrDecodeEntry()
+		}
+		if binary.LittleEndian.Uint64(value[:8]) >= ts {
+			return true, nil
+		}
+		result, err = decodeBlockEntry(recordKey, value)
+		return false, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, newErrKeyNotFound()
+	}
+	return result, nil
+}
+
+// encodeIndexBlock encodes the index entries as a block whose records map the last key of each data block to
+// its offset and size
+func encodeIndexBlock(index []*indexEntry) []byte {
+	builder := newBlockBuilder()
+	for _, entry := range index {
+		value := appendUvarint([]byte{}, entry.offset)
+		value = appendUvarint(value, entry.size)
+		builder.add(entry.key, value)
+	}
+	return builder.finish()
+}
+
+func decodeIndexBlock(data []byte, dataSize uint64) ([]*indexEntry, error) {
+	reader, err := newBlockReader(data)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*indexEntry{}
+	err = reader.scan(0, func(key string, value []byte) (bool, error) {
+		offset, n := binary.Uvarint(value)
+		if n <= 0 {
+			return false, newErrBadFormattedSST()
+		}
+		size, m := binary.Uvarint(value[n:])
+		if m <= 0 || offset+size > dataSize {
+			return false, newErrBadFormattedSST()
+		}
+		entries = append(entries, &indexEntry{key: key, offset: offset, size: size})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
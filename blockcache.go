@@ -0,0 +1,215 @@
+package db
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// blockCacheKey identifies a cached block by the ID of the SST file it belongs to and its offset in the file.
+// Every SST file written, including a file moved to another level, gets a new ID, so the blocks of a file are never
+// served for another file that replaced it. The index of a file is cached at offset 0, where its header starts,
+// since no data block can start there
+type blockCacheKey struct {
+	fileID string
+	offset uint64
+}
+
+type blockCacheEntry struct {
+	key   blockCacheKey
+	value interface{}
+	size  int
+}
+
+// cacheShard is an LRU of blocks bounded by the total size of its blocks
+type cacheShard struct {
+	items    map[blockCacheKey]*list.Element
+	order    *list.List
+	size     int
+	capacity int
+	lock     sync.Mutex
+
+	// indexSize is the part of size used by index blocks
+	indexSize int
+}
+
+// blockCache caches decompressed data blocks and decoded index blocks of SST files for all levels.
+// It is split into shards, each with its own lock, so concurrent reads rarely contend
+type blockCache struct {
+	// hits and misses are first so they are 64 bit aligned for atomic operations
+	hits     uint64
+	misses   uint64
+	shards   []*cacheShard
+	capacity int
+	lock     sync.Mutex
+}
+
+// cachedIndex is the decoded header and index block of an SST file
+type cachedIndex struct {
+	header *sstHeader
+	index  []*indexEntry
+}
+
+// BlockCacheStats reports how many SST block reads were served by the block cache
+type BlockCacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Size     int
+	Capacity int
+	// IndexSize is the part of Size used by index blocks
+	IndexSize int
+}
+
+// newBlockCache creates a block cache that holds up to capacity bytes of blocks. A capacity of 0 disables caching
+func newBlockCache(capacity int) *blockCache {
+	cache := &blockCache{
+		shards:   make([]*cacheShard, numCacheShards),
+		capacity: capacity,
+	}
+	for i := range cache.shards {
+		cache.shards[i] = &cacheShard{
+			items:    make(map[blockCacheKey]*list.Element),
+			order:    list.New(),
+			capacity: capacity / numCacheShards,
+		}
+	}
+	return cache
+}
+
+func (cache *blockCache) shard(key blockCacheKey) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key.fileID))
+	h.Write([]byte(strconv.FormatUint(key.offset, 10)))
+	return cache.shards[h.Sum32()%uint32(len(cache.shards))]
+}
+
+// get returns the cached block for the key and marks it as most recently used
+func (cache *blockCache) get(key blockCacheKey) (interface{}, bool) {
+	if cache == nil {
+		return nil, false
+	}
+	shard := cache.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	element, ok := shard.items[key]
+	if !ok {
+		atomic.AddUint64(&cache.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&cache.hits, 1)
+	shard.order.MoveToFront(element)
+	return element.Value.(*blockCacheEntry).value, true
+}
+
+// set adds a block to the cache, evicting the least recently used blocks of its shard until it fits.
+// Blocks larger than a shard are not cached
+func (cache *blockCache) set(key blockCacheKey, value interface{}, size int) {
+	if cache == nil {
+		return
+	}
+	shard := cache.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if size > shard.capacity {
+		return
+	}
+	if element, ok := shard.items[key]; ok {
+		shard.remove(element)
+	}
+	for shard.size+size > shard.capacity {
+		shard.remove(shard.order.Back())
+	}
+	shard.items[key] = shard.order.PushFront(&blockCacheEntry{key: key, value: value, size: size})
+	shard.size += size
+	if key.offset == 0 {
+		shard.indexSize += size
+	}
+}
+
+func (shard *cacheShard) remove(element *list.Element) {
+	entry := shard.order.Remove(element).(*blockCacheEntry)
+	delete(shard.items, entry.key)
+	shard.size -= entry.size
+	if entry.key.offset == 0 {
+		shard.indexSize -= entry.size
+	}
+}
+
+// evictFile removes all blocks of a deleted or moved SST file from the cache so they do not take up room until
+// they are least recently used. File IDs are random and only unique within their level, so this also keeps the
+// blocks of a deleted file from being served in the unlikely case its ID is given to a new file
+func (cache *blockCache) evictFile(fileID string) {
+	if cache == nil {
+		return
+	}
+	for _, shard := range cache.shards {
+		shard.lock.Lock()
+		for key, element := range shard.items {
+			if key.fileID == fileID {
+				shard.remove(element)
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
+
+// setCapacity changes how many bytes of blocks the cache holds, evicting the least recently used blocks of each
+// shard until it fits. A capacity of 0 or less empties the cache until it grows again
+func (cache *blockCache) setCapacity(capacity int) {
+	if cache == nil {
+		return
+	}
+	if capacity < 0 {
+		capacity = 0
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if capacity == cache.capacity {
+		return
+	}
+	cache.capacity = capacity
+	for _, shard := range cache.shards {
+		shard.lock.Lock()
+		shard.capacity = capacity / numCacheShards
+		for shard.size > shard.capacity {
+			shard.remove(shard.order.Back())
+		}
+		shard.lock.Unlock()
+	}
+}
+
+func (cache *blockCache) stats() BlockCacheStats {
+	cache.lock.Lock()
+	capacity := cache.capacity
+	cache.lock.Unlock()
+	stats := BlockCacheStats{
+		Hits:     atomic.LoadUint64(&cache.hits),
+		Misses:   atomic.LoadUint64(&cache.misses),
+		Capacity: capacity,
+	}
+	for _, shard := range cache.shards {
+		shard.lock.Lock()
+		stats.Size += shard.size
+		stats.IndexSize += shard.indexSize
+		shard.lock.Unlock()
+	}
+	return stats
+}
+
+// indexCacheSize estimates the memory used by a decoded index block
+func indexCacheSize(index []*indexEntry) int {
+	size := headerSize
+	for _, entry := range index {
+		size += len(entry.key) + indexEntryOverhead
+	}
+	return size
+}
+
+// BlockCacheStats returns the hit and miss counters and current size of the block cache
+func (db *DB) BlockCacheStats() BlockCacheStats {
+	return db.lsm.fm.cache.stats()
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestBlockCacheEviction(t *testing.T) {
+	cache := newBlockCache(numCacheShards * 100)
+	for i := 0; i < 1000; i++ {
+		cache.set(blockCacheKey{fileID: "a", offset: uint64(i)}, []byte{}, 30)
+	}
+	stats := cache.stats()
+	if stats.Size > stats.Capacity {
+		t.Fatalf("Cache size %d exceeds capacity %d\n", stats.Size, stats.Capacity)
+	}
+	if stats.Size == 0 {
+		t.Fatalf("Expected cache to hold blocks\n")
+	}
+
+	// The most recently set block must still be cached, the first one must have been evicted
+	if _, ok := cache.get(blockCacheKey{fileID: "a", offset: 999}); !ok {
+		t.Fatalf("Expected most recent block to be cached\n")
+	}
+	if _, ok := cache.get(blockCacheKey{fileID: "a", offset: 0}); ok {
+		t.Fatalf("Expected least recent block to be evicted\n")
+	}
+	stats = cache.stats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("Expected 1 hit and 1 miss, Got: %d hits and %d misses\n", stats.Hits, stats.Misses)
+	}
+
+	cache.set(blockCacheKey{fileID: "b", offset: 0}, []byte{}, 30)
+	cache.evictFile("a")
+	if _, ok := cache.get(blockCacheKey{fileID: "a", offset: 999}); ok {
+		t.Fatalf("Expected blocks of evicted file to be removed\n")
+	}
+	if _, ok := cache.get(blockCacheKey{fileID: "b", offset: 0}); !ok {
+		t.Fatalf("Expected blocks of other files to stay cached\n")
+	}
+	if cache.stats().Size != 30 {
+		t.Fatalf("Cache size, Expected: 30, Got: %d\n", cache.stats().Size)
+	}
+}
+
+func TestBlockCacheSetCapacity(t *testing.T) {
+	cache := newBlockCache(numCacheShards * 100)
+	for i := 0; i < 1000; i++ {
+		cache.set(blockCacheKey{fileID: "a", offset: uint64(i)}, []byte{}, 30)
+	}
+	cache.setCapacity(numCacheShards * 50)
+	stats := cache.stats()
+	if stats.Capacity != numCacheShards*50 || stats.Size > stats.Capacity {
+		t.Fatalf("Expected cache to shrink to %d, Got: %+v\n", numCacheShards*50, stats)
+	}
+	if _, ok := cache.get(blockCacheKey{fileID: "a", offset: 999}); !ok {
+		t.Fatalf("Expected most recent block to stay cached\n")
+	}
+
+	cache.setCapacity(-1)
+	if cache.stats().Size != 0 {
+		t.Fatalf("Expected cache without capacity to be empty, Got: %d\n", cache.stats().Size)
+	}
+	cache.set(blockCacheKey{fileID: "a", offset: 0}, []byte{}, 30)
+	if _, ok := cache.get(blockCacheKey{fileID: "a", offset: 0}); ok {
+		t.Fatalf("Expected cache without capacity to cache nothing\n")
+	}
+	cache.setCapacity(numCacheShards * 100)
+	cache.set(blockCacheKey{fileID: "a", offset: 0}, []byte{}, 30)
+	if _, ok := cache.get(blockCacheKey{fileID: "a", offset: 0}); !ok {
+		t.Fatalf("Expected cache to hold blocks once it grows again\n")
+	}
+}
+
+func TestBlockCacheReads(t *testing.T) {
+	_, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	entries := []*Entry{}
+	for i := 1000; i < 5000; i++ {
+		key := strconv.Itoa(i)
+		entries = append(entries, simpleEntry(uint64(i), key, key))
+	}
+	dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries, SnappyCompression)
+	if err != nil {
+		t.Fatalf("Error writing data entries: %v\n", err)
+	}
+	keyRangeEntry := createkeyRangeEntry(kr)
+	header := createHeader(len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry))
+	data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+	err = writeNewFile("data/L0/test.sst", data)
+	if err != nil {
+		t.Fatalf("Error writing to file: %v\n", err)
+	}
+
+	fm := newFileManager(newBlockCache(MB), 10, false)
+	for i := 0; i < 2; i++ {
+		entry, err := fm.Find("data/L0/test.sst", "1234", 10000)
+		if err != nil {
+			t.Fatalf("Error finding key: %v\n", err)
+		}
+		if string(entry.Attributes["value"].Data) != "1234" {
+			t.Fatalf("Value expected: 1234, Got: %v\n", string(entry.Attributes["value"].Data))
+		}
+	}
+	stats := fm.cache.stats()
+	// The index stays pinned by the open table, so only the data block is looked up the second time
+	if stats.Misses != 2 || stats.Hits != 1 {
+		t.Fatalf("Expected index and data block to miss then data block to hit, Got: %d hits and %d misses\n", stats.Hits, stats.Misses)
+	}
+
+	result, err := fm.Range("data/L0/test.sst", kr, 10000)
+	if err != nil {
+		t.Fatalf("Error range query on file: %v\n", err)
+	}
+	if len(result) != len(entries) {
+		t.Fatalf("Expected length of entries: %d, Got %d\n", len(entries), len(result))
+	}
+
+	fm.Evict("data/L0/test.sst")
+	if fm.cache.stats().Size != 0 {
+		t.Fatalf("Expected cache to be empty after evicting file, Got size: %d\n", fm.cache.stats().Size)
+	}
+}
@@ -16,8 +16,7 @@ type bloom struct {
 // newBloom creates a bloom filter depending on n, the number of elements that will be inserted into the bloom filter
 func newBloom(n int) *bloom {
 	k := uint32(10) // Number of hash functions
-	p := 0.001      // False positive probability 0.001 = 1/1000 False Positive = 99.9% Correct
-	size := uint64(math.Ceil((float64(n) * math.Log(p)) / math.Log(1/math.Pow(2, math.Log(2)))))
+	size := bloomSize(n)
 
 	return &bloom{
 		k:    k,
@@ -26,6 +25,12 @@ func newBloom(n int) *bloom {
 	}
 }
 
+// bloomSize returns the size of the bits array of a bloom filter for n keys
+func bloomSize(n int) uint64 {
+	p := 0.001 // False positive probability 0.001 = 1/1000 False Positive = 99.9% Correct
+	return uint64(math.Ceil((float64(n) * math.Log(p)) / math.Log(1/math.Pow(2, math.Log(2)))))
+}
+
 // recoverBloom creates a new in-memory bloom filter from a bits array
 func recoverBloom(bits []byte) *bloom {
 	k := uint32(10)
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// checkpointRequest asks db.run to link and copy the files of the DB into directory
+type checkpointRequest struct {
+	directory string
+	errChan   chan error
+}
+
+// fileDeleter deletes the SST or value log files removed by compactions and garbage collection. While a checkpoint
+// is linking files, deletions are paused and the removed files are only deleted once it is done
+type fileDeleter struct {
+	paused  int
+	pending []string
+	lock    sync.Mutex
+}
+
+// remove deletes a file right away unless deletions are paused. Files a checkpoint failed to delete are retried
+func (d *fileDeleter) remove(filename string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.paused > 0 {
+		d.pending = append(d.pending, filename)
+		return nil
+	}
+	// The error of an earlier file was already reported by the checkpoint that failed to delete it
+	d.removePending()
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pause holds back deletions until resume is called as many times
+func (d *fileDeleter) pause() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.paused++
+}
+
+// resume deletes the files removed while deletions were paused once no checkpoint is running anymore
+func (d *fileDeleter) resume() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.paused--
+	if d.paused > 0 {
+		return nil
+	}
+	return d.removePending()
+}
+
+// removePending deletes the pending files. The ones that cannot be deleted stay pending for the next try
+func (d *fileDeleter) removePending() error {
+	var firstErr error
+	var failed []string
+	for _, filename := range d.pending {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			failed = append(failed, filename)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	d.pending = failed
+	return firstErr
+}
+
+// Checkpoint writes a copy of the database as of a single point in time to a new directory, which can be opened
+// like any other DB directory. SST files never change once written, so they are hard linked, and copied only if
+// the directory is on another file system. WALs and the value log file still being appended are copied. Writes and
+// flushes wait while the files are linked and copied, and no SST or value log file is deleted until the checkpoint
+// is done. It returns an error if the directory already exists
+func (db *DB) Checkpoint(directory string) error {
+	err := db.acquireWrite()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+
+	err = os.MkdirAll(filepath.Dir(directory), dirPerm)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(directory, dirPerm)
+	if err != nil {
+		return err
+	}
+
+	db.lsm.fm.deleter.pause()
+	db.vlog.deleter.pause()
+	errChan := make(chan error, 1)
+	db.checkpointChan <- &checkpointRequest{directory: directory, errChan: errChan}
+	err = <-errChan
+	// The checkpoint does not depend on the removed files being deleted, and the ones left are retried on the next
+	// deletion, so failing to delete them only gets logged
+	if resumeErr := db.lsm.fm.deleter.resume(); resumeErr != nil {
+		fmt.Println(resumeErr)
+	}
+	if resumeErr := db.vlog.deleter.resume(); resumeErr != nil {
+		fmt.Println(resumeErr)
+	}
+	if err != nil {
+		os.RemoveAll(directory)
+		return err
+	}
+	return nil
+}
+
+// runCheckpoint is called by db.run, so no write reaches the memtables while the checkpoint is written. The running
+// flush is finished first so its entries are either in level 0 and the value log, or in its WAL. Flushing resumes
+// once the files are linked and copied
+func (db *DB) runCheckpoint(req *checkpointRequest) {
+	if db.wc.flushing != nil && !db.wc.flushFailed {
+		flushErr := <-db.flushDoneChan
+		req.errChan <- db.writeCheckpoint(req.directory)
+		db.flushDone(flushErr)
+		return
+	}
+	req.errChan <- db.writeCheckpoint(req.directory)
+}
+
+// writeCheckpoint links the SST files of every level and the value log files into the directory, and copies the
+// WALs and the value log head
+func (db *DB) writeCheckpoint(directory string) error {
+	// A compaction adds its output files to the level below before it removes its input files, so listing the
+	// levels top down finds every entry in at least one level
+	for i, level := range db.lsm.levels {
+		levelDir := filepath.Join(directory, "L"+strconv.Itoa(i))
+		err := os.Mkdir(levelDir, dirPerm)
+		if err != nil {
+			return err
+		}
+		for _, file := range level.sortedSSTFiles() {
+			err := linkFile(file.filename, filepath.Join(levelDir, file.fileID+".sst"))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	walDir := filepath.Join(directory, "memtables")
+	err := os.Mkdir(walDir, dirPerm)
+	if err != nil {
+		return err
+	}
+	for _, mt := range db.memTables() {
+		// The WAL of a memtable that was just flushed is already removed
+		err := copyFile(mt.walName, filepath.Join(walDir, filepath.Base(mt.walName)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return db.vlog.checkpoint(filepath.Join(directory, "vlog"))
+}
+
+// checkpoint links all value log files into the directory, except for the head which is still appended to and
+// is copied instead. Files removed by garbage collection are still linked while their deletion is paused
+func (vlog *valueLog) checkpoint(directory string) error {
+	err := os.Mkdir(directory, dirPerm)
+	if err != nil {
+		return err
+	}
+	fileIDs, err := vlog.fileIDs()
+	if err != nil {
+		return err
+	}
+	vlog.fileLock.RLock()
+	head := vlog.head
+	vlog.fileLock.RUnlock()
+	for id := range fileIDs {
+		target := filepath.Join(directory, filepath.Base(vlog.filename(id)))
+		if id == head {
+			err = copyFile(vlog.filename(id), target)
+		} else {
+			err = linkFile(vlog.filename(id), target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkFile hard links a file that never changes, or copies it if it cannot be linked
+func linkFile(filename, target string) error {
+	err := os.Link(filename, target)
+	if err == nil {
+		return nil
+	}
+	return copyFile(filename, target)
+}
+
+// copyFile copies a file and syncs the copy
+func copyFile(filename, target string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, filePerm)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+	return dst.Sync()
+}
@@ -0,0 +1,280 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckpoint(t *testing.T) {
+	// Without compaction, the flushed files stay in level 0 until the manual compaction
+	opts := DefaultOptions()
+	opts.ValueThreshold = 64
+	opts.CompactionStrategy = &noCompaction{}
+	opts.L0SlowdownWritesTrigger = 1000
+	opts.L0StopWritesTrigger = 1000
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+	os.RemoveAll("checkpoint")
+	defer os.RemoveAll("checkpoint")
+
+	// Half of the values are flushed to level 0 and the value log, the other half are only in WALs
+	err = writeLargeValues(db, 100, 1)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	err = writeLargeValues(db, 50, 2)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = db.Checkpoint("checkpoint")
+	if err != nil {
+		t.Fatalf("Error writing checkpoint: %v\n", err)
+	}
+	err = db.Checkpoint("checkpoint")
+	if err == nil {
+		t.Fatalf("Expected checkpoint into an existing directory to fail\n")
+	}
+
+	// SST files are linked, not copied
+	files, err := ioutil.ReadDir(db.lsm.levels[0].directory)
+	if err != nil {
+		t.Fatalf("Error reading level directory: %v\n", err)
+	}
+	if len(files) == 0 {
+		t.Fatalf("Expected level 0 files after flush\n")
+	}
+	for _, file := range files {
+		linked, err := os.Stat(filepath.Join("checkpoint", "L0", file.Name()))
+		if err != nil {
+			t.Fatalf("Error reading checkpoint file: %v\n", err)
+		}
+		if !os.SameFile(file, linked) {
+			t.Fatalf("Expected %s to be hard linked into the checkpoint\n", file.Name())
+		}
+	}
+
+	// Writes after the checkpoint do not change it
+	err = writeLargeValues(db, 100, 3)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = db.CompactRange("0", "99")
+	if err != nil {
+		t.Fatalf("Error compacting db: %v\n", err)
+	}
+
+	checkpoint, err := NewDBWithOptions("checkpoint", opts)
+	if err != nil {
+		t.Fatalf("Error opening checkpoint: %v\n", err)
+	}
+	defer checkpoint.Close()
+	err = checkLargeValues(checkpoint, 50, 2)
+	if err != nil {
+		t.Fatalf("Error reading values from checkpoint WALs: %v\n", err)
+	}
+	err = checkpoint.ViewTxn(func(txn *Txn) error {
+		for i := 50; i < 100; i++ {
+			key := strconv.Itoa(i)
+			entry, err := txn.Read(key)
+			if err != nil {
+				return err
+			}
+			if string(entry.Attributes["value"].Data) != string(largeValue(key, 1).Data) {
+				t.Fatalf("Wrong value for key: %v\n", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error reading flushed values from checkpoint: %v\n", err)
+	}
+	err = checkLargeValues(db, 100, 3)
+	if err != nil {
+		t.Fatalf("Error reading from db: %v\n", err)
+	}
+}
+
+func TestCheckpointDuringWrites(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueThreshold = 64
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+	defer os.RemoveAll("checkpoint")
+
+	// Flushes and compactions keep running while the writers overwrite the same keys
+	numWriters := 4
+	var wg sync.WaitGroup
+	errs := make(chan error, numWriters)
+	stop := make(chan struct{})
+	versions := make([]int, numWriters)
+	var versionLock sync.Mutex
+	wg.Add(numWriters)
+	for w := 0; w < numWriters; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for version := 1; ; version++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := db.UpdateTxn(func(txn *Txn) error {
+					for i := 0; i < 50; i++ {
+						key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+						err := txn.Write(key, map[string]*Value{"value": largeValue(key, version)})
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				versionLock.Lock()
+				versions[w] = version
+				versionLock.Unlock()
+			}
+		}(w)
+	}
+
+	for round := 0; round < 5; round++ {
+		time.Sleep(100 * time.Millisecond)
+		// Every writer committed at least this version before the checkpoint, and at most the next one once it is done
+		versionLock.Lock()
+		before := append([]int{}, versions...)
+		versionLock.Unlock()
+		os.RemoveAll("checkpoint")
+		err = db.Checkpoint("checkpoint")
+		if err != nil {
+			t.Fatalf("Error writing checkpoint: %v\n", err)
+		}
+		versionLock.Lock()
+		after := append([]int{}, versions...)
+		versionLock.Unlock()
+
+		checkpoint, err := NewDBWithOptions("checkpoint", opts)
+		if err != nil {
+			t.Fatalf("Error opening checkpoint: %v\n", err)
+		}
+		err = checkpoint.ViewTxn(func(txn *Txn) error {
+			for w := 0; w < numWriters; w++ {
+				// Txns commit all their keys at once, so all keys of a writer are at the same version
+				found := -1
+				for i := 0; i < 50; i++ {
+					key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+					entry, err := txn.Read(key)
+					if _, ok := err.(*ErrKeyNotFound); ok && before[w] == 0 {
+						continue
+					}
+					if err != nil {
+						return err
+					}
+					version := -1
+					for v := before[w]; v <= after[w]+1; v++ {
+						if string(entry.Attributes["value"].Data) == string(largeValue(key, v).Data) {
+							version = v
+						}
+					}
+					if version == -1 || (found != -1 && version != found) {
+						t.Fatalf("Wrong value for key %v in checkpoint, expected a version between %d and %d\n", key, before[w], after[w]+1)
+					}
+					found = version
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error reading from checkpoint: %v\n", err)
+		}
+		err = checkpoint.Close()
+		if err != nil {
+			t.Fatalf("Error closing checkpoint: %v\n", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+}
+
+func TestFileDeleterPause(t *testing.T) {
+	os.RemoveAll("checkpoint")
+	defer os.RemoveAll("checkpoint")
+	err := os.Mkdir("checkpoint", dirPerm)
+	if err != nil {
+		t.Fatalf("Error creating directory: %v\n", err)
+	}
+	filename := filepath.Join("checkpoint", "file")
+	err = ioutil.WriteFile(filename, []byte("data"), filePerm)
+	if err != nil {
+		t.Fatalf("Error writing file: %v\n", err)
+	}
+
+	d := &fileDeleter{}
+	d.pause()
+	d.pause()
+	err = d.remove(filename)
+	if err != nil {
+		t.Fatalf("Error removing file: %v\n", err)
+	}
+	err = d.resume()
+	if err != nil {
+		t.Fatalf("Error resuming deletions: %v\n", err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("Expected file to be kept while a checkpoint is running, Got: %v\n", err)
+	}
+	err = d.resume()
+	if err != nil {
+		t.Fatalf("Error resuming deletions: %v\n", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("Expected file to be deleted once all checkpoints are done, Got: %v\n", err)
+	}
+
+	// A non empty directory cannot be removed, so it stays pending until the next deletion
+	dirname := filepath.Join("checkpoint", "dir")
+	err = os.MkdirAll(filepath.Join(dirname, "nested"), dirPerm)
+	if err != nil {
+		t.Fatalf("Error creating directory: %v\n", err)
+	}
+	d.pause()
+	err = d.remove(dirname)
+	if err != nil {
+		t.Fatalf("Error removing file: %v\n", err)
+	}
+	err = d.resume()
+	if err == nil {
+		t.Fatalf("Expected error deleting a non empty directory\n")
+	}
+	err = os.Remove(filepath.Join(dirname, "nested"))
+	if err != nil {
+		t.Fatalf("Error removing directory: %v\n", err)
+	}
+	err = d.remove(filename)
+	if err != nil {
+		t.Fatalf("Error removing file: %v\n", err)
+	}
+	if _, err := os.Stat(dirname); !os.IsNotExist(err) {
+		t.Fatalf("Expected directory left by the checkpoint to be deleted, Got: %v\n", err)
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+// acquire returns ErrDBClosed once Close was called. Otherwise Close waits until the caller calls release
+func (db *DB) acquire() error {
+	db.closeLock.RLock()
+	if db.closed {
+		db.closeLock.RUnlock()
+		return newErrDBClosed()
+	}
+	return nil
+}
+
+// release lets Close continue once the operation started by acquire is done
+func (db *DB) release() {
+	db.closeLock.RUnlock()
+}
+
+// Close gracefully closes the database. Txn ops that already started are finished, while txns, flushes and
+// compactions requested afterwards return ErrDBClosed. Pending writes are written to the memtables, and flushed
+// to level 0 if FlushOnClose is set. Writes stopped by a write stall return ErrDBClosed. The running flush and
+// compaction are finished before all goroutines are stopped and all files are closed. The directory is unlocked
+// last. It returns the first error hit while closing
+func (db *DB) Close() error {
+	db.closingOnce.Do(func() {
+		close(db.closing)
+	})
+	db.closeLock.Lock()
+	if db.closed {
+		db.closeLock.Unlock()
+		return newErrDBClosed()
+	}
+	db.closed = true
+	db.closeLock.Unlock()
+
+	// Commits, index backfills and value log rewrites already handed to the oracle are written before it stops
+	db.oracle.stop()
+
+	var firstErr error
+	setErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	// A read only DB has no memtables to write and no directory lock
+	if db.replica == nil {
+		if db.opts.FlushOnClose {
+			setErr(db.flushMemTables())
+		}
+		errChan := make(chan error, 1)
+		db.close <- errChan
+		setErr(<-errChan)
+	}
+	setErr(db.lsm.Close())
+	setErr(db.vlog.Close())
+	if db.lock != nil {
+		setErr(db.lock.unlock())
+	}
+	return firstErr
+}
+
+// stopStalled is called by db.run once Close is called. Writes waiting for room in the memtables return
+// ErrDBClosed, and so do the writes that would have to wait from now on
+func (db *DB) stopStalled() {
+	db.wc.closing = true
+	for _, req := range db.wc.stalled {
+		req.errChan <- newErrDBClosed()
+	}
+	db.wc.stalled = nil
+}
+
+// stopMemTables is called by db.run when the DB is closed. It waits for the running flush, stops runFlush, returns
+// ErrDBClosed to the Flush calls and writes still waiting, and closes the WALs of all memtables
+func (db *DB) stopMemTables() error {
+	if db.wc.flushing != nil && !db.wc.flushFailed {
+		if err := <-db.flushDoneChan; err == nil {
+			db.memLock.Lock()
+			db.immutables = db.immutables[1:]
+			db.memLock.Unlock()
+		}
+	}
+	db.wc.flushing = nil
+	close(db.flushChan)
+
+	for _, req := range db.wc.flushReqs {
+		req.errChan <- newErrDBClosed()
+	}
+	db.wc.flushReqs = nil
+	for _, req := range db.wc.stalled {
+		req.errChan <- newErrDBClosed()
+	}
+	db.wc.stalled = nil
+
+	var firstErr error
+	for _, mt := range db.memTables() {
+		err := mt.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
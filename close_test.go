@@ -0,0 +1,261 @@
+package db
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkGoroutines waits for the amount of goroutines to go back down to the given amount
+func checkGoroutines(t *testing.T, before int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("Expected at most %d goroutines after close, Got: %d\n%s\n", before, runtime.NumGoroutine(), buf[:n])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	opts := DefaultOptions()
+	opts.RateLimit = 10 * MB
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+		if i%250 == 0 {
+			err = db.Flush()
+			if err != nil {
+				t.Fatalf("Error flushing memtable: %v\n", err)
+			}
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		_, err := db.Read(strconv.Itoa(10000+i), []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key: %v\n", err)
+		}
+	}
+	entries, err := db.Scan("", []string{"value"})
+	if err != nil {
+		t.Fatalf("Error scanning db: %v\n", err)
+	}
+	if len(entries) != 1000 {
+		t.Fatalf("Scan length expected: %d, Got: %d\n", 1000, len(entries))
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Error closing db: %v\n", err)
+	}
+	checkGoroutines(t, before)
+}
+
+func TestCloseRejects(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	value, _ := CreateValue("value")
+	err = db.Insert("key", map[string]*Value{"value": value})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+	txn := db.StartTxn()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Error closing db: %v\n", err)
+	}
+
+	checkClosed := func(op string, err error) {
+		if _, ok := err.(*ErrDBClosed); !ok {
+			t.Fatalf("Expected %s to return ErrDBClosed, Got: %v\n", op, err)
+		}
+	}
+	_, err = txn.Read("key")
+	checkClosed("read in txn started before close", err)
+	txn.Write("other", map[string]*Value{"value": value})
+	checkClosed("commit of txn started before close", txn.Commit())
+	_, err = db.Read("key", []string{"value"})
+	checkClosed("read", err)
+	_, err = db.Scan("", []string{"value"})
+	checkClosed("scan", err)
+	checkClosed("delete", db.Delete("key"))
+	checkClosed("flush", db.Flush())
+	checkClosed("compact range", db.CompactRange("a", "z"))
+	checkClosed("value log gc", db.RunValueLogGC(0.5))
+	checkClosed("create index", db.CreateIndex("idx", "value"))
+	checkClosed("second close", db.Close())
+}
+
+func TestCloseFlushOnClose(t *testing.T) {
+	opts := DefaultOptions()
+	opts.FlushOnClose = true
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Error closing db: %v\n", err)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join("data", "memtables"))
+	if err != nil {
+		t.Fatalf("Error reading memtables directory: %v\n", err)
+	}
+	for _, file := range files {
+		if file.Size() > 0 {
+			t.Fatalf("Expected all WALs to be empty after flush on close, Got: %s with %d bytes\n", file.Name(), file.Size())
+		}
+	}
+
+	db, err = NewDB("data")
+	if err != nil {
+		t.Fatalf("Error opening DB: %v\n", err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(10000 + i)
+		entry, err := db.Read(key, []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != key {
+			t.Fatalf("Value expected: %v, Got: %v\n", key, string(entry.Attributes["value"].Data))
+		}
+	}
+}
+
+func TestCloseDuringWrites(t *testing.T) {
+	before := runtime.NumGoroutine()
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	// Each writer records the keys it wrote until its commits return ErrDBClosed
+	numWriters := 8
+	written := make([][]string, numWriters)
+	errs := make(chan error, numWriters)
+	var wg sync.WaitGroup
+	wg.Add(numWriters)
+	for w := 0; w < numWriters; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				key := strconv.Itoa(w) + "-" + strconv.Itoa(100000+i)
+				err := db.UpdateTxn(func(txn *Txn) error {
+					return txn.Write(key, map[string]*Value{"value": &Value{DataType: String, Data: []byte(key)}})
+				})
+				if _, ok := err.(*ErrDBClosed); ok {
+					return
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				written[w] = append(written[w], key)
+			}
+		}(w)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Error closing db: %v\n", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	checkGoroutines(t, before)
+
+	db, err = NewDB("data")
+	if err != nil {
+		t.Fatalf("Error opening DB: %v\n", err)
+	}
+	defer db.Close()
+	for _, keys := range written {
+		for _, key := range keys {
+			_, err := db.Read(key, []string{"value"})
+			if err != nil {
+				t.Fatalf("Error reading key %v written before close: %v\n", key, err)
+			}
+		}
+	}
+}
+
+func TestCloseStalledWrites(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxImmutableMemTables = 1
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	// The first flush waits on the value log, so writers stop once both memtables are full, either before
+	// reaching db.run or while waiting in it
+	db.vlog.fileLock.Lock()
+	numWriters := 16
+	errs, err := startStoppedWriters(db, numWriters)
+	if err != nil {
+		db.vlog.fileLock.Unlock()
+		t.Fatalf("Error stopping writes: %v\n", err)
+	}
+
+	closeErr := make(chan error, 1)
+	go func() {
+		closeErr <- db.Close()
+	}()
+	// Stopped writes return before the flush they wait for is done
+	timeout := time.After(5 * time.Second)
+	for w := 0; w < 2*numWriters; w++ {
+		select {
+		case err := <-errs:
+			if _, ok := err.(*ErrDBClosed); !ok {
+				db.vlog.fileLock.Unlock()
+				t.Fatalf("Expected ErrDBClosed from stopped write, Got: %v\n", err)
+			}
+		case <-timeout:
+			db.vlog.fileLock.Unlock()
+			t.Fatalf("Expected all stopped writes to return ErrDBClosed, %d still waiting\n", 2*numWriters-w)
+		}
+	}
+	db.vlog.fileLock.Unlock()
+
+	select {
+	case err := <-closeErr:
+		if err != nil {
+			t.Fatalf("Error closing db: %v\n", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected close to return once stopped writes returned\n")
+	}
+}
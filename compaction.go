@@ -0,0 +1,237 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// compaction merges input files of a level, along with the files they overlap in the output level, into new
+// files in the output level. A compaction that drops its inputs deletes them without writing anything
+type compaction struct {
+	level    int
+	output   int
+	inputs   []*sstFile
+	overlaps []*sstFile
+	drop     bool
+
+	// targetFileSize is the size at which a new output file is started. 0 writes a single output file
+	targetFileSize int
+}
+
+// runCompaction runs a compaction picked by the compaction strategy. A single input that overlaps nothing in a
+// lower output level is moved down without rewriting it, unless the output is the bottommost level, where
+// versions no txn can read anymore are dropped. The new files replace the overlapping files in the output
+// level before the inputs are removed from their level, so reads always find every key in one of the two levels
+func (lsm *lsm) runCompaction(c *compaction) error {
+	level := lsm.levels[c.level]
+	output := lsm.levels[c.output]
+
+	inputs := []string{}
+	for _, file := range c.inputs {
+		inputs = append(inputs, file.filename)
+	}
+	if c.drop {
+		return level.DeleteSSTFiles(inputs)
+	}
+	bottommost := lsm.bottommost(c)
+	if c.output != c.level && len(c.inputs) == 1 && len(c.overlaps) == 0 && !bottommost {
+		return lsm.moveFile(c.level, c.inputs[0])
+	}
+
+	overlaps := []string{}
+	for _, file := range c.overlaps {
+		overlaps = append(overlaps, file.filename)
+	}
+	watermark := uint64(0)
+	if bottommost {
+		watermark = atomic.LoadUint64(&lsm.watermark)
+	}
+	outputs, err := output.compact(append(inputs, overlaps...), c.targetFileSize, watermark)
+	if err != nil {
+		return err
+	}
+	if c.output == c.level {
+		output.ReplaceSSTFiles(outputs, append(inputs, overlaps...))
+	} else {
+		output.ReplaceSSTFiles(outputs, overlaps)
+		level.ReplaceSSTFiles(nil, inputs)
+	}
+	return removeSSTFiles(lsm.fm, append(inputs, overlaps...))
+}
+
+// bottommost returns whether the compaction writes to the last level and includes every file of it that overlaps
+// its keys. Only then are no older versions of its keys left in another file, so its output can drop them
+func (lsm *lsm) bottommost(c *compaction) bool {
+	output := lsm.levels[c.output]
+	if output.below != nil {
+		return false
+	}
+	files := append(append([]*sstFile{}, c.inputs...), c.overlaps...)
+	included := make(map[string]struct{})
+	for _, file := range files {
+		included[file.filename] = struct{}{}
+	}
+	kr := filesKeyRange(files)
+	for _, file := range output.overlappingSSTFiles(kr.startKey, kr.endKey) {
+		if _, ok := included[file.filename]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// moveFile moves an SST file from a level to the level below
+func (lsm *lsm) moveFile(numLevel int, file *sstFile) error {
+	level := lsm.levels[numLevel]
+	below := level.below
+
+	level.bloomLock.RLock()
+	bloom := level.blooms[file.fileID]
+	level.bloomLock.RUnlock()
+
+	fileID := below.getUniqueID()
+	moved := &sstFile{
+		fileID:   fileID,
+		filename: filepath.Join(below.directory, fileID+".sst"),
+		keyRange: file.keyRange,
+		bloom:    bloom,
+		size:     file.size,
+	}
+	// Link the file below first so it can be read from either level until it is removed from this one
+	err := os.Link(file.filename, moved.filename)
+	if err != nil {
+		return err
+	}
+	below.ReplaceSSTFiles([]*sstFile{moved}, nil)
+	level.ReplaceSSTFiles(nil, []string{file.filename})
+	return removeSSTFiles(lsm.fm, []string{file.filename})
+}
+
+// compact runs compactions until no level needs one. A failed compaction is retried the next time the compactor
+// wakes up, and becomes the background error once it failed maxBackgroundRetries times in a row
+func (lsm *lsm) compact() {
+	for {
+		select {
+		case <-lsm.close:
+			return
+		default:
+		}
+		if lsm.bgErr.get() != nil {
+			return
+		}
+		c := lsm.strategy.pick(lsm)
+		if c == nil {
+			return
+		}
+		err := lsm.runCompaction(c)
+		if err != nil {
+			lsm.compactErrors++
+			if lsm.compactErrors >= maxBackgroundRetries {
+				lsm.compactErrors = 0
+				lsm.bgErr.set(err)
+			}
+			return
+		}
+		lsm.compactErrors = 0
+	}
+}
+
+// runCompactor asks the compaction strategy for compactions whenever a file is added to level 0, and every second.
+// It also runs manual compactions so they never run concurrently with the ones it picks
+func (lsm *lsm) runCompactor() {
+	defer close(lsm.compactorDone)
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lsm.compactChan:
+			lsm.compact()
+		case req := <-lsm.manualChan:
+			req.errChan <- lsm.compactRange(req.keyRange)
+		case <-ticker.C:
+			lsm.compact()
+		case <-lsm.close:
+			return
+		}
+	}
+}
+
+// maybeCompact wakes up the compactor without waiting for it
+func (lsm *lsm) maybeCompact() {
+	select {
+	case lsm.compactChan <- struct{}{}:
+	default:
+	}
+}
+
+// manualCompaction is a request to compact a key range down to the bottommost level
+type manualCompaction struct {
+	keyRange *keyRange
+	errChan  chan error
+}
+
+// CompactRange compacts all files overlapping the key range down to the bottommost level and returns when done
+func (lsm *lsm) CompactRange(keyRange *keyRange) error {
+	req := &manualCompaction{
+		keyRange: keyRange,
+		errChan:  make(chan error, 1),
+	}
+	select {
+	case lsm.manualChan <- req:
+		return <-req.errChan
+	case <-lsm.close:
+		return newErrDBClosed()
+	}
+}
+
+// compactRange compacts the files overlapping the key range one level at a time. Each compaction takes the
+// overlapping files of a level and merges them into the level below, until they all reach the bottommost level
+func (lsm *lsm) compactRange(keyRange *keyRange) error {
+	startKey, endKey := keyRange.startKey, keyRange.endKey
+	for _, level := range lsm.levels[:len(lsm.levels)-1] {
+		inputs := level.expandInputs(startKey, endKey)
+		if len(inputs) == 0 {
+			continue
+		}
+		kr := filesKeyRange(inputs)
+		// Files below may hold older versions of keys outside the range, so it grows with the inputs
+		if kr.startKey < startKey {
+			startKey = kr.startKey
+		}
+		if kr.endKey > endKey {
+			endKey = kr.endKey
+		}
+		err := lsm.runCompaction(&compaction{
+			level:          level.level,
+			output:         level.level + 1,
+			inputs:         inputs,
+			overlaps:       level.below.overlappingSSTFiles(kr.startKey, kr.endKey),
+			targetFileSize: lsm.opts.TargetFileSize,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactRange flushes the mutable memtable and then compacts all files overlapping the range of keys down to
+// the bottommost level. It returns when the compaction is done
+func (db *DB) CompactRange(startKey, endKey string) error {
+	if startKey > endKey {
+		return newErrInvalidRange()
+	}
+	err := db.acquireWrite()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+	err = db.flushMemTables()
+	if err != nil {
+		return err
+	}
+	return db.lsm.CompactRange(&keyRange{startKey: startKey, endKey: endKey})
+}
@@ -0,0 +1,377 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCompactionLeveled(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BaseLevelSize = 64 * KB
+	opts.LevelSizeMultiplier = 2
+	opts.TargetFileSize = 16 * KB
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	numKeys := 3000
+	for version := 0; version < 3; version++ {
+		for i := 0; i < numKeys; i++ {
+			key := strconv.Itoa(10000 + i)
+			value, _ := CreateValue(key + "-" + strconv.Itoa(version))
+			err := db.UpdateTxn(func(txn *Txn) error {
+				return txn.Write(key, map[string]*Value{"value": value})
+			})
+			if err != nil {
+				t.Fatalf("Error writing key %v: %v\n", key, err)
+			}
+		}
+	}
+	time.Sleep(3 * time.Second)
+
+	deepest := 0
+	for _, level := range db.lsm.levels[1:] {
+		files := level.sortedSSTFiles()
+		if len(files) > 0 {
+			deepest = level.level
+		}
+		for i := 1; i < len(files); i++ {
+			if files[i-1].keyRange.endKey >= files[i].keyRange.startKey {
+				t.Fatalf("Files in level %d overlap: %v and %v\n", level.level, files[i-1].keyRange, files[i].keyRange)
+			}
+		}
+	}
+	if deepest < 2 {
+		t.Fatalf("Expected compaction to reach level 2, Got deepest level: %d\n", deepest)
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		entry, err := db.Read(key, []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != key+"-2" {
+			t.Fatalf("Value expected: %v, Got: %v\n", key+"-2", string(entry.Attributes["value"].Data))
+		}
+		for _, level := range db.lsm.levels[1:] {
+			if files := level.FindSSTFile(key); len(files) > 1 {
+				t.Fatalf("Expected at most one file for key %v in level %d, Got: %v\n", key, level.level, files)
+			}
+		}
+	}
+}
+
+func TestCompactionRoundRobin(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	level := db.lsm.levels[1]
+	for i, kr := range []*keyRange{{startKey: "a", endKey: "c"}, {startKey: "d", endKey: "f"}, {startKey: "g", endKey: "i"}} {
+		level.NewSSTFile("file"+strconv.Itoa(i), kr, newBloom(1), KB)
+	}
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		c := level.pickInputs()
+		if len(c.inputs) != 1 {
+			t.Fatalf("Expected one input file, Got: %d\n", len(c.inputs))
+		}
+		picked = append(picked, c.inputs[0].keyRange.startKey)
+	}
+	if picked[0] != "a" || picked[1] != "d" || picked[2] != "g" || picked[3] != "a" {
+		t.Fatalf("Expected files to be picked round robin, Got: %v\n", picked)
+	}
+}
+
+func sstSizes(db *DB) (levels []int, total int) {
+	for _, level := range db.lsm.levels {
+		files := level.sortedSSTFiles()
+		levels = append(levels, len(files))
+		for _, file := range files {
+			total += file.size
+		}
+	}
+	return levels, total
+}
+
+func TestCompactionTiered(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CompactionStrategy = TieredCompaction(3)
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	numKeys := 2000
+	for version := 0; version < 3; version++ {
+		for i := 0; i < numKeys; i++ {
+			key := strconv.Itoa(10000 + i)
+			value, _ := CreateValue(key + "-" + strconv.Itoa(version))
+			err := db.UpdateTxn(func(txn *Txn) error {
+				return txn.Write(key, map[string]*Value{"value": value})
+			})
+			if err != nil {
+				t.Fatalf("Error writing key %v: %v\n", key, err)
+			}
+		}
+	}
+	time.Sleep(3 * time.Second)
+
+	levels, _ := sstSizes(db)
+	for i, runs := range levels {
+		if runs >= 3 {
+			t.Fatalf("Expected level %d to have less than 3 runs, Got: %d\n", i, runs)
+		}
+	}
+	if levels[1] == 0 && levels[2] == 0 {
+		t.Fatalf("Expected runs to be merged into lower levels, Got: %v\n", levels)
+	}
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		entry, err := db.Read(key, []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != key+"-2" {
+			t.Fatalf("Value expected: %v, Got: %v\n", key+"-2", string(entry.Attributes["value"].Data))
+		}
+	}
+}
+
+func TestCompactionFIFO(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CompactionStrategy = FIFOCompaction(64*KB, 0)
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	numKeys := 5000
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.UpdateTxn(func(txn *Txn) error {
+			return txn.Write(key, map[string]*Value{"value": value})
+		})
+		if err != nil {
+			t.Fatalf("Error writing key %v: %v\n", key, err)
+		}
+	}
+	time.Sleep(2 * time.Second)
+
+	levels, total := sstSizes(db)
+	if total > 64*KB {
+		t.Fatalf("Expected SST files to fit in 64 KB, Got: %d bytes\n", total)
+	}
+	for i, files := range levels[1:] {
+		if files > 0 {
+			t.Fatalf("Expected FIFO compaction to keep all files in level 0, Got %d files in level %d\n", files, i+1)
+		}
+	}
+	if _, err := db.Read("10000", []string{"value"}); err == nil {
+		t.Fatalf("Expected oldest key to be dropped\n")
+	}
+	key := strconv.Itoa(10000 + numKeys - 1)
+	if _, err := db.Read(key, []string{"value"}); err != nil {
+		t.Fatalf("Error reading newest key: %v\n", err)
+	}
+	db.Close()
+
+	// Files older than the max age are dropped regardless of size
+	opts.CompactionStrategy = FIFOCompaction(0, 500*time.Millisecond)
+	db, err = NewDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error opening DB: %v\n", err)
+	}
+	defer db.Close()
+	time.Sleep(2 * time.Second)
+	if _, total := sstSizes(db); total != 0 {
+		t.Fatalf("Expected all SST files to be dropped, Got: %d bytes\n", total)
+	}
+}
+
+func TestCompactionFIFOWriteStall(t *testing.T) {
+	// The budget is large enough for level 0 to collect more files than the stop trigger
+	opts := DefaultOptions()
+	opts.CompactionStrategy = FIFOCompaction(100*MB, 0)
+	opts.NonBlockingWrites = true
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	numKeys := 20000
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(100000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error writing key %v: %v\n", key, err)
+		}
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	if numL0 := db.lsm.levels[0].numFiles(); numL0 <= opts.L0StopWritesTrigger {
+		t.Fatalf("Expected more than %d level 0 files, Got: %d\n", opts.L0StopWritesTrigger, numL0)
+	}
+	if stats := db.WriteStallStats(); stats.Rejected > 0 || stats.Slowdowns > 0 {
+		t.Fatalf("Expected FIFO compaction to never stall writes on level 0, Got: %+v\n", stats)
+	}
+	key := strconv.Itoa(100000)
+	if _, err := db.Read(key, []string{"value"}); err != nil {
+		t.Fatalf("Error reading oldest key: %v\n", err)
+	}
+}
+
+func TestCompactionL0Triggers(t *testing.T) {
+	opts := DefaultOptions()
+	opts.L0SlowdownWritesTrigger = 8
+	opts.L0StopWritesTrigger = 12
+	strategies := []struct {
+		strategy CompactionStrategy
+		slowdown int
+		stop     int
+	}{
+		{LeveledCompaction(), 8, 12},
+		{TieredCompaction(2), 8, 12},
+		{TieredCompaction(8), 16, 24},
+		{FIFOCompaction(100*MB, 0), 0, 0},
+	}
+	for _, s := range strategies {
+		opts.CompactionStrategy = s.strategy
+		db, err := setupDBWithOptions("data", opts)
+		if err != nil {
+			t.Fatalf("Error setting up DB: %v\n", err)
+		}
+		slowdown, stop := db.l0Triggers()
+		db.Close()
+		if slowdown != s.slowdown || stop != s.stop {
+			t.Fatalf("Expected triggers %d and %d for %T, Got: %d and %d\n", s.slowdown, s.stop, s.strategy, slowdown, stop)
+		}
+	}
+}
+
+func TestCompactRange(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	numKeys := 500
+	for version := 0; version < 2; version++ {
+		for i := 0; i < numKeys; i++ {
+			key := strconv.Itoa(10000 + i)
+			value, _ := CreateValue(key + "-" + strconv.Itoa(version))
+			err := db.UpdateTxn(func(txn *Txn) error {
+				return txn.Write(key, map[string]*Value{"value": value})
+			})
+			if err != nil {
+				t.Fatalf("Error writing key %v: %v\n", key, err)
+			}
+		}
+		err = db.Flush()
+		if err != nil {
+			t.Fatalf("Error flushing memtable: %v\n", err)
+		}
+		if len(db.memTables()) != 1 || db.mutable.size != 0 {
+			t.Fatalf("Expected memtables to be empty after flush\n")
+		}
+		if len(db.lsm.levels[0].FindSSTFile("10000")) == 0 {
+			t.Fatalf("Expected flushed key in level 0\n")
+		}
+	}
+	// Flushing with an empty memtable is a no-op
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing empty memtable: %v\n", err)
+	}
+
+	err = db.CompactRange("10100", "10200")
+	if err != nil {
+		t.Fatalf("Error compacting range: %v\n", err)
+	}
+	for _, level := range db.lsm.levels[:6] {
+		if files := level.overlappingSSTFiles("10100", "10200"); len(files) > 0 {
+			t.Fatalf("Expected no files overlapping range in level %d, Got: %d\n", level.level, len(files))
+		}
+	}
+	if files := db.lsm.levels[6].overlappingSSTFiles("10100", "10200"); len(files) == 0 {
+		t.Fatalf("Expected range to be compacted to level 6\n")
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		entry, err := db.Read(key, []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != key+"-1" {
+			t.Fatalf("Value expected: %v, Got: %v\n", key+"-1", string(entry.Attributes["value"].Data))
+		}
+	}
+
+	// Compacting to the bottommost level drops overwritten versions, deleted keys, and their tombstones
+	before, err := countLevelEntries(db, 6)
+	if err != nil {
+		t.Fatalf("Error reading level 6: %v\n", err)
+	}
+	if before != numKeys {
+		t.Fatalf("Expected one version of every key in level 6, Got: %d entries\n", before)
+	}
+	for i := 100; i <= 200; i++ {
+		err := db.Delete(strconv.Itoa(10000 + i))
+		if err != nil {
+			t.Fatalf("Error deleting key: %v\n", err)
+		}
+	}
+	err = db.CompactRange("10000", "10499")
+	if err != nil {
+		t.Fatalf("Error compacting range: %v\n", err)
+	}
+	after, err := countLevelEntries(db, 6)
+	if err != nil {
+		t.Fatalf("Error reading level 6: %v\n", err)
+	}
+	if after != numKeys-101 {
+		t.Fatalf("Expected deleted keys to be dropped from level 6, Got: %d entries\n", after)
+	}
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		_, err := db.Read(key, []string{"value"})
+		if _, ok := err.(*ErrKeyNotFound); !ok && i >= 100 && i <= 200 {
+			t.Fatalf("Expected deleted key %v to not be found, Got: %v\n", key, err)
+		}
+		if err != nil && (i < 100 || i > 200) {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+	}
+
+	err = db.CompactRange("b", "a")
+	if _, ok := err.(*ErrInvalidRange); !ok {
+		t.Fatalf("Expected invalid range error, Got: %v\n", err)
+	}
+}
+
+// countLevelEntries returns the amount of entries in all files of a level, counting every version
+func countLevelEntries(db *DB, numLevel int) (int, error) {
+	count := 0
+	for _, file := range db.lsm.levels[numLevel].sortedSSTFiles() {
+		entries, err := db.lsm.fm.MMap(file.filename)
+		if err != nil {
+			return 0, err
+		}
+		count += len(entries)
+	}
+	return count, nil
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionType is the algorithm used to compress SST data blocks
+type CompressionType uint8
+
+// Supported compression types. The type is stored in every data block so files written with
+// different options can be read regardless of the current option
+const (
+	NoCompression CompressionType = iota
+	SnappyCompression
+	ZstdCompression
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd creates the zstd encoder and decoder shared by all blocks. Both are safe for concurrent use
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdErr
+}
+
+// compressBlock compresses a data block and prepends the compression type. Blocks that do not shrink by
+// at least an eighth are stored uncompressed since decompressing them would cost more than it saves
+func compressBlock(compression CompressionType, block []byte) ([]byte, error) {
+	var compressed []byte
+	switch compression {
+	case NoCompression:
+	case SnappyCompression:
+		compressed = snappy.Encode(nil, block)
+	case ZstdCompression:
+		err := initZstd()
+		if err != nil {
+			return nil, err
+		}
+		compressed = zstdEncoder.EncodeAll(block, nil)
+	default:
+		return nil, newErrUnknownCompression(uint8(compression))
+	}
+	if compressed == nil || len(compressed) > len(block)-len(block)/8 {
+		return append([]byte{uint8(NoCompression)}, block...), nil
+	}
+	return append([]byte{uint8(compression)}, compressed...), nil
+}
+
+// decompressBlock reads the compression type of a block written by compressBlock and decompresses it
+func decompressBlock(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, newErrBadFormattedSST()
+	}
+	switch CompressionType(data[0]) {
+	case NoCompression:
+		return data[1:], nil
+	case SnappyCompression:
+		return snappy.Decode(nil, data[1:])
+	case ZstdCompression:
+		err := initZstd()
+		if err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(data[1:], nil)
+	default:
+		return nil, newErrUnknownCompression(data[0])
+	}
+}
@@ -1,5 +1,7 @@
 package db
 
+import "time"
+
 // KB represents kilobyte: 1024 bytes
 const KB = 1024
 
@@ -9,31 +11,103 @@ const MB = 1024 * KB
 // BlockSize is size of each data block: 1 KB
 const BlockSize = 4 * KB
 
+// blockRestartInterval is the amount of keys between restart points in a block. Keys at a restart point are
+// stored in full so the block can be binary searched, all other keys only store what differs from the previous key
+const blockRestartInterval = 16
+
 // MemTableSize is size limit of each memtable: 16 KB
 const MemTableSize = 16 * KB
 
-// KeySize is max size for key
-const KeySize = 255
+// KeySize is max size for key: 64 KB
+const KeySize = 64 * KB
 
-// EntrySize is max size for entire entry
-const EntrySize = KB
+// EntrySize is max size for all attribute values of an entry: 64 MB
+const EntrySize = 64 * MB
 
 // MaxAttributes is max amount of Attributes per entry
-const MaxAttributes = 10
+const MaxAttributes = 1024
 
 const timestampSize = 8
 
 const filenameLength = 8
+
+// compactThreshold is the amount of files in level 0 at which it is compacted into level 1
 const compactThreshold = 4
 
-const multiplier = MB
+const headerSize = 48
+const legacyHeaderSize = 32
+
+const defaultMaxOpenFiles = 500
+
+// defaultBaseLevelSize is the capacity of level 1
+const defaultBaseLevelSize = 10 * MB
+
+// defaultLevelSizeMultiplier is the ratio between the capacities of consecutive levels
+const defaultLevelSizeMultiplier = 10
+
+// defaultTargetFileSize is the size of SST files written by compaction
+const defaultTargetFileSize = 2 * MB
+
+// defaultRateLimit is the bytes per second flushes and compactions may write. 0 does not limit them
+const defaultRateLimit = 0
+
+// rateLimiterRefillPeriod is how often the rate limiter adds tokens to its bucket
+const rateLimiterRefillPeriod = 100 * time.Millisecond
+
+// rateLimiterChunkSize is the max amount of bytes written to a file at once by a rate limited write
+const rateLimiterChunkSize = 64 * KB
+
+// skipListMaxHeight is the max amount of levels of a skip list memtable
+const skipListMaxHeight = 12
+
+// skipListBranching is the inverse of the chance that a skip list node in a level is also in the level above
+const skipListBranching = 4
+
+// defaultMaxImmutableMemTables is the amount of full memtables that may wait to be flushed before writes stop
+const defaultMaxImmutableMemTables = 4
 
-const headerSize = 32
+// memEntryOverhead is the approximate memory used by a memtable entry besides its key and attributes
+const memEntryOverhead = 96
 
-const numWorkers = 50
+// memAttributeOverhead is the approximate memory used by an attribute of a memtable entry besides its name and data
+const memAttributeOverhead = 48
+
+// maxBackgroundRetries is the amount of times in a row a flush or compaction may fail before the DB becomes read only
+const maxBackgroundRetries = 3
+
+// defaultL0SlowdownWritesTrigger is the amount of level 0 files at which every write is delayed
+const defaultL0SlowdownWritesTrigger = 8
+
+// defaultL0StopWritesTrigger is the amount of level 0 files at which writes wait for compaction
+const defaultL0StopWritesTrigger = 12
+
+// writeSlowdownDelay is how long each write is delayed while writes are slowed down
+const writeSlowdownDelay = 1 * time.Millisecond
+
+// writeStallCheckInterval is how often stopped writes check whether flushes and compactions have caught up,
+// and how often a failed flush is retried
+const writeStallCheckInterval = 10 * time.Millisecond
+
+const defaultBlockCacheSize = 8 * MB
+const numCacheShards = 16
+
+// indexEntryOverhead is the approximate memory used by a decoded index entry besides its key
+const indexEntryOverhead = 40
 
 const oracleSize = 10000
 
+const defaultValueThreshold = 1 * KB
+const defaultValueLogFileSize = 1 * MB
+
+// valueLogHeaderSize is the size of the length and checksum before every value log record
+const valueLogHeaderSize = 8
+
+// valuePointerSize is the size of a value pointer: file id, offset, and record size
+const valuePointerSize = 16
+
+// gcBatchSize is the max amount of entries rewritten in one commit by value log garbage collection
+const gcBatchSize = 64
+
 const dirPerm = 0700
 const filePerm = 0600
 
@@ -46,4 +120,19 @@ const (
 	String
 	Bytes
 	Tombstone
+	Time
+	Decimal
+	List
+	Map
+	// valuePointer is stored in SST files in place of a value that was moved into the value log
+	valuePointer
 )
+
+// lockFileName is the file in the data directory that a DB holds an exclusive lock on while it is open
+const lockFileName = "LOCK"
+
+// Directories of a backup directory: files shared by content hash, one meta file per backup, and checkpoints
+// of backups being created
+const backupSharedDir = "shared"
+const backupMetaDir = "meta"
+const backupTmpDir = "tmp"
@@ -5,61 +5,138 @@ import (
 	"os"
 )
 
+// SST format versions. Legacy files have no version in their header and use 8 bit key sizes.
+// Files before compressedVersion pad data blocks to a multiple of BlockSize and address them by block number.
+// Files before restartVersion store whole entries one after another, so their blocks can only be scanned
+const (
+	legacyVersion uint64 = iota
+	varintVersion
+	compressedVersion
+	restartVersion
+)
+
+// sstVersion is the format version of all newly written SST files
+const sstVersion = restartVersion
+
+// sstMagic starts every versioned SST header. Legacy headers start with the data size, which can never be this large
+const sstMagic uint64 = 0x5453424445504d53
+
+// sstHeader describes the layout of an SST file: header, data blocks, index block, bloom filter, then key range
+type sstHeader struct {
+	version      uint64
+	size         uint64
+	dataSize     uint64
+	indexSize    uint64
+	bloomSize    uint64
+	keyRangeSize uint64
+}
+
+// createkeyRangeEntry encodes the first and last key of an SST file followed by the newest ts of its entries
 func createkeyRangeEntry(kr *keyRange) []byte {
 	data := []byte{}
-	startKeySize := uint8(len(kr.startKey))
-	endKeySize := uint8(len(kr.endKey))
-	data = append(data, startKeySize)
+	data = appendUvarint(data, uint64(len(kr.startKey)))
 	data = append(data, []byte(kr.startKey)...)
-	data = append(data, endKeySize)
+	data = appendUvarint(data, uint64(len(kr.endKey)))
 	data = append(data, []byte(kr.endKey)...)
+	data = appendUvarint(data, kr.maxTs)
 	return data
 }
 
-func parsekeyRangeEntry(data []byte) *keyRange {
+// parsekeyRangeEntry decodes the key range of an SST file. Files written before the newest ts was recorded have a
+// maxTs of 0
+func parsekeyRangeEntry(version uint64, data []byte) (*keyRange, error) {
+	keys := []string{}
 	i := 0
-	startKeySize := uint8(data[i])
-	i++
-	startKey := string(data[i : i+int(startKeySize)])
-	i += int(startKeySize)
-	endKeySize := uint8(data[i])
-	i++
-	endKey := string(data[i : i+int(endKeySize)])
-	return &keyRange{
-		startKey: startKey,
-		endKey:   endKey,
+	for len(keys) < 2 {
+		if i >= len(data) {
+			return nil, newErrBadFormattedSST()
+		}
+		var keySize uint64
+		if version == legacyVersion {
+			keySize = uint64(data[i])
+			i++
+		} else {
+			size, n := binary.Uvarint(data[i:])
+			if n <= 0 {
+				return nil, newErrBadFormattedSST()
+			}
+			keySize = size
+			i += n
+		}
+		if uint64(len(data)-i) < keySize {
+			return nil, newErrBadFormattedSST()
+		}
+		keys = append(keys, string(data[i:i+int(keySize)]))
+		i += int(keySize)
+	}
+	kr := &keyRange{
+		startKey: keys[0],
+		endKey:   keys[1],
+	}
+	if version != legacyVersion && i < len(data) {
+		maxTs, n := binary.Uvarint(data[i:])
+		if n <= 0 {
+			return nil, newErrBadFormattedSST()
+		}
+		kr.maxTs = maxTs
 	}
+	return kr, nil
 }
 
 func createHeader(dataSize, indexSize, bloomSize, keyRangeSize int) []byte {
-	dataSizeBytes := make([]byte, 8)
-	indexSizeBytes := make([]byte, 8)
-	bloomSizeBytes := make([]byte, 8)
-	keyRangeSizeBytes := make([]byte, 8)
-
-	binary.LittleEndian.PutUint64(dataSizeBytes, uint64(dataSize))
-	binary.LittleEndian.PutUint64(indexSizeBytes, uint64(indexSize))
-	binary.LittleEndian.PutUint64(bloomSizeBytes, uint64(bloomSize))
-	binary.LittleEndian.PutUint64(keyRangeSizeBytes, uint64(keyRangeSize))
-
-	header := append(dataSizeBytes, indexSizeBytes...)
-	header = append(header, bloomSizeBytes...)
-	header = append(header, keyRangeSizeBytes...)
+	header := make([]byte, headerSize)
+	binary.LittleEndian.PutUint64(header[:8], sstMagic)
+	binary.LittleEndian.PutUint64(header[8:16], sstVersion)
+	binary.LittleEndian.PutUint64(header[16:24], uint64(dataSize))
+	binary.LittleEndian.PutUint64(header[24:32], uint64(indexSize))
+	binary.LittleEndian.PutUint64(header[32:40], uint64(bloomSize))
+	binary.LittleEndian.PutUint64(header[40:], uint64(keyRangeSize))
 	return header
 }
 
-func readHeader(f *os.File) (dataSize, indexSize, bloomSize, keyRangeSize uint64, err error) {
+func readHeader(f *os.File) (*sstHeader, error) {
 	header := make([]byte, headerSize)
-	numBytes, err := f.Read(header)
-	if err != nil {
-		return 0, 0, 0, 0, err
+	numBytes, err := f.ReadAt(header, 0)
+	if err != nil && numBytes < legacyHeaderSize {
+		return nil, err
+	}
+	if numBytes < legacyHeaderSize {
+		return nil, newErrReadUnexpectedBytes("Header")
+	}
+	if binary.LittleEndian.Uint64(header[:8]) != sstMagic {
+		return &sstHeader{
+			version:      legacyVersion,
+			size:         legacyHeaderSize,
+			dataSize:     binary.LittleEndian.Uint64(header[:8]),
+			indexSize:    binary.LittleEndian.Uint64(header[8:16]),
+			bloomSize:    binary.LittleEndian.Uint64(header[16:24]),
+			keyRangeSize: binary.LittleEndian.Uint64(header[24:32]),
+		}, nil
 	}
-	if numBytes != len(header) {
-		return 0, 0, 0, 0, newErrReadUnexpectedBytes("Header")
+	if numBytes != headerSize {
+		return nil, newErrReadUnexpectedBytes("Header")
 	}
-	dataSize = binary.LittleEndian.Uint64(header[:8])
-	indexSize = binary.LittleEndian.Uint64(header[8:16])
-	bloomSize = binary.LittleEndian.Uint64(header[16:24])
-	keyRangeSize = binary.LittleEndian.Uint64(header[24:])
-	return dataSize, indexSize, bloomSize, keyRangeSize, nil
+	return &sstHeader{
+		version:      binary.LittleEndian.Uint64(header[8:16]),
+		size:         headerSize,
+		dataSize:     binary.LittleEndian.Uint64(header[16:24]),
+		indexSize:    binary.LittleEndian.Uint64(header[24:32]),
+		bloomSize:    binary.LittleEndian.Uint64(header[32:40]),
+		keyRangeSize: binary.LittleEndian.Uint64(header[40:]),
+	}, nil
+}
+
+// dataOffset returns the offset of the data section in the file
+func (header *sstHeader) dataOffset() int64 {
+	return int64(header.size)
+}
+
+// indexOffset returns the offset of the index block in the file
+func (header *sstHeader) indexOffset() int64 {
+	return int64(header.size + header.dataSize)
+}
+
+// totalSize returns the size of all sections of the file excluding the header
+func (header *sstHeader) totalSize() int {
+	return int(header.dataSize + header.indexSize + header.bloomSize + header.keyRangeSize)
 }
@@ -2,23 +2,54 @@ package db
 
 import (
 	"errors"
-	"fmt"
 	"math"
 	"os"
 	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // DB is struct for database
 type DB struct {
+	directory string
+	opts      *Options
+	lock      *dirLock
 	oracle    *oracle
-	mutable   *memTable
-	immutable *memTable
 	lsm       *lsm
+	vlog      *valueLog
 	snaphots  *doublyLinkedList
 
-	writeChan chan *writeRequest
-	flushChan chan *memTable
-	close     chan struct{}
+	// mutable is the memtable written to. Full memtables are queued in immutables, oldest first, until they are flushed
+	mutable    *memTable
+	immutables []*memTable
+	memLock    sync.RWMutex
+
+	indexes   map[string]*index
+	indexLock sync.RWMutex
+
+	schemas    map[string]*Schema
+	schemaLock sync.RWMutex
+
+	wc *writeController
+
+	// replica is set if the DB was opened read only. It holds the WALs of the primary replayed into memtables
+	replica *replica
+
+	// closed is set by Close. Txn ops hold closeLock for reading while they run, so Close waits for them
+	closed    bool
+	closeLock sync.RWMutex
+	// closing is closed once Close is called, before it waits for txn ops, so writes stopped by a write stall
+	// return ErrDBClosed instead of keeping Close waiting
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	writeChan      chan *writeRequest
+	flushReqChan   chan chan error
+	flushChan      chan *memTable
+	flushDoneChan  chan error
+	checkpointChan chan *checkpointRequest
+	close          chan chan error
 }
 
 type writeRequest struct {
@@ -26,31 +57,52 @@ type writeRequest struct {
 	errChan chan error
 }
 
-// NewDB creates a new database by instantiating the lsm and Value Log
+// NewDB creates a new database with the default options by instantiating the lsm and Value Log
 func NewDB(directory string) (*DB, error) {
+	return NewDBWithOptions(directory, DefaultOptions())
+}
+
+// NewDBWithOptions creates a new database configured by the given options. It returns ErrDirectoryLocked if
+// another DB, in this process or another one, has the directory open
+func NewDBWithOptions(directory string, opts *Options) (*DB, error) {
 	err := os.MkdirAll(directory, dirPerm)
 	if err != nil {
 		return nil, err
 	}
-	lsm, err := newLSM(directory)
+	lock, err := lockDirectory(directory)
 	if err != nil {
 		return nil, err
 	}
-	memtable1, maxCommitTs1, err := newMemTable(directory, "1")
+	db, err := openDB(directory, opts, lock)
 	if err != nil {
+		lock.unlock()
 		return nil, err
 	}
-	memtable2, maxCommitTs2, err := newMemTable(directory, "2")
+	return db, nil
+}
+
+// openDB recovers the database in a locked directory and starts its goroutines
+func openDB(directory string, opts *Options, lock *dirLock) (*DB, error) {
+	lsm, err := newLSM(directory, opts, false)
 	if err != nil {
 		return nil, err
 	}
-
-	maxCommitTs := maxCommitTs1
-	if maxCommitTs2 > maxCommitTs {
-		maxCommitTs = maxCommitTs2
+	vlog, err := newValueLog(directory, opts, false)
+	if err != nil {
+		return nil, err
+	}
+	// Memtables left from before a restart are flushed again in the order they were written
+	immutables, maxCommitTs, maxID, err := recoverMemTables(directory, opts.MemTableType)
+	if err != nil {
+		return nil, err
 	}
-	// if last committed ts is 0, then there is possibility that immutable flushed
-	// and mutable did not receive any entries. So need to check all L0 files for last ts
+	mutable, _, err := newMemTable(directory, strconv.FormatUint(maxID+1, 10), opts.MemTableType)
+	if err != nil {
+		return nil, err
+	}
+
+	// if last committed ts is 0, then there is possibility that all memtables were flushed
+	// and no entries were written since. So need to check all L0 files for last ts
 	if maxCommitTs == 0 {
 		ts, err := lsm.RecoverTS()
 		if err != nil {
@@ -60,14 +112,28 @@ func NewDB(directory string) (*DB, error) {
 	}
 
 	db := &DB{
-		mutable:   memtable1,
-		immutable: memtable2,
+		directory: directory,
+		opts:      opts,
+		lock:      lock,
 		lsm:       lsm,
+		vlog:      vlog,
 		snaphots:  newDoublyLinkedList(),
 
-		writeChan: make(chan *writeRequest),
-		flushChan: make(chan *memTable),
-		close:     make(chan struct{}, 1),
+		mutable:    mutable,
+		immutables: immutables,
+
+		indexes: make(map[string]*index),
+		schemas: make(map[string]*Schema),
+
+		wc: &writeController{memTableID: maxID + 1},
+
+		writeChan:      make(chan *writeRequest),
+		flushReqChan:   make(chan chan error),
+		flushChan:      make(chan *memTable),
+		flushDoneChan:  make(chan error),
+		checkpointChan: make(chan *checkpointRequest),
+		close:          make(chan chan error),
+		closing:        make(chan struct{}),
 	}
 
 	oracle := newOracle(maxCommitTs+1, db)
@@ -76,26 +142,47 @@ func NewDB(directory string) (*DB, error) {
 	go db.run()
 	go db.runFlush()
 
+	err = db.loadIndexes()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	err = db.loadSchemas()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
 // ViewTxn implements a read only transaction to the DB. Ensures read only since it does not commit at end
 func (db *DB) ViewTxn(fn func(txn *Txn) error) error {
 	txn := db.StartTxn()
+	defer txn.Discard()
 	return fn(txn)
 }
 
 // UpdateTxn implements a read and write only transaction to the DB
 func (db *DB) UpdateTxn(fn func(txn *Txn) error) error {
 	txn := db.StartTxn()
+	defer txn.Discard()
 	if err := fn(txn); err != nil {
 		return err
 	}
 	return txn.Commit()
 }
 
-// write inserts multiple entries into DB
+// write inserts multiple entries into DB. Writes fail if the DB was opened read only, or while it is read only
+// because of a background error
 func (db *DB) write(entries []*Entry) error {
+	if db.replica != nil {
+		return newErrReadOnly()
+	}
+	err := db.lsm.bgErr.get()
+	if err != nil {
+		return err
+	}
 	errChan := make(chan error, 1)
 	req := &writeRequest{
 		entries: entries,
@@ -105,24 +192,38 @@ func (db *DB) write(entries []*Entry) error {
 	return <-errChan
 }
 
-// get retrieves Attributes for a given key or returns key not found
+// read retrieves Attributes for a given key or returns key not found
 func (db *DB) read(key string, ts uint64) (*Entry, error) {
-	if len(key) > KeySize {
-		return nil, newErrExceedMaxKeySize(key)
+	entry, err := db.find(key, ts)
+	if err != nil {
+		return nil, err
 	}
-	entry := db.mutable.table.Find(key, ts)
-	if entry != nil {
-		if entry.Attributes == nil {
-			return nil, newErrKeyNotFound()
+	result, err := db.vlog.resolve(entry)
+	if _, ok := err.(*ErrValueLogFileNotFound); ok {
+		// The value log file was garbage collected after the entry was found, which means
+		// its values have been rewritten in a newer version of the entry
+		entry, err = db.find(key, ts)
+		if err != nil {
+			return nil, err
 		}
-		return entry, nil
+		return db.vlog.resolve(entry)
 	}
-	entry = db.immutable.table.Find(key, ts)
-	if entry != nil {
-		if entry.Attributes == nil {
-			return nil, newErrKeyNotFound()
+	return result, err
+}
+
+// find retrieves the entry for a given key without resolving pointers into the value log
+func (db *DB) find(key string, ts uint64) (*Entry, error) {
+	if len(key) > KeySize {
+		return nil, newErrExceedMaxKeySize(key)
+	}
+	for _, mt := range db.memTables() {
+		entry := mt.table.Find(key, ts)
+		if entry != nil {
+			if entry.Attributes == nil {
+				return nil, newErrKeyNotFound()
+			}
+			return entry, nil
 		}
-		return entry, nil
 	}
 	entry, err := db.lsm.Read(key, ts)
 	if err != nil {
@@ -134,22 +235,51 @@ func (db *DB) read(key string, ts uint64) (*Entry, error) {
 	return entry, nil
 }
 
-// range finds all key, value pairs within the given range of keys
-func (db *DB) scan(startKey, endKey string, ts uint64) ([]*Entry, error) {
-	if len(startKey) > KeySize {
-		return nil, newErrExceedMaxKeySize(startKey)
+// scan finds all key, value pairs within the given range of keys
+func (db *DB) scan(keyRange *keyRange, ts uint64) ([]*Entry, error) {
+	entries, err := db.scanPointers(keyRange, ts)
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.resolveAll(entries)
+	if _, ok := err.(*ErrValueLogFileNotFound); ok {
+		entries, err = db.scanPointers(keyRange, ts)
+		if err != nil {
+			return nil, err
+		}
+		return db.resolveAll(entries)
+	}
+	return result, err
+}
+
+func (db *DB) resolveAll(entries []*Entry) ([]*Entry, error) {
+	result := make([]*Entry, len(entries))
+	for i, entry := range entries {
+		resolved, err := db.vlog.resolve(entry)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = resolved
+	}
+	return result, nil
+}
+
+// scanPointers finds all entries within the given range of keys without resolving pointers into the value log
+func (db *DB) scanPointers(keyRange *keyRange, ts uint64) ([]*Entry, error) {
+	if len(keyRange.startKey) > KeySize {
+		return nil, newErrExceedMaxKeySize(keyRange.startKey)
 	}
-	if len(endKey) > KeySize {
-		return nil, newErrExceedMaxKeySize(endKey)
+	if len(keyRange.endKey) > KeySize {
+		return nil, newErrExceedMaxKeySize(keyRange.endKey)
 	}
-	if startKey > endKey {
+	if keyRange.afterEnd(keyRange.startKey) {
 		return nil, errors.New("Start Key is greater than End Key")
 	}
-	keyRange := &keyRange{startKey: startKey, endKey: endKey}
 
 	all := []*Entry{}
-	all = append(all, db.mutable.table.Scan(keyRange, ts)...)
-	all = append(all, db.immutable.table.Scan(keyRange, ts)...)
+	for _, mt := range db.memTables() {
+		all = append(all, mt.table.Scan(keyRange, ts)...)
+	}
 
 	entries, err := db.lsm.Scan(keyRange, ts)
 	if err != nil {
@@ -194,8 +324,11 @@ func (db *DB) exists(key string) (bool, error) {
 
 // Flush takes all entries from the in-memory table and sends them to lsm
 func (db *DB) flush(mt *memTable) error {
-	entries := mt.table.Inorder()
-	dataBlocks, indexBlock, bloom, keyRange, err := writeEntries(entries)
+	entries, err := db.vlog.separate(mt.table.Inorder())
+	if err != nil {
+		return err
+	}
+	dataBlocks, indexBlock, bloom, keyRange, err := writeEntries(entries, db.opts.Compression)
 	if err != nil {
 		return err
 	}
@@ -204,17 +337,40 @@ func (db *DB) flush(mt *memTable) error {
 	if err != nil {
 		return err
 	}
-	// Truncate the WAL
-	err = mt.Truncate()
+	// The entries are in level 0 now so the WAL is no longer needed
+	return mt.Delete()
+}
+
+// memTables returns the mutable memtable followed by the immutable memtables, newest first
+func (db *DB) memTables() []*memTable {
+	db.memLock.RLock()
+	defer db.memLock.RUnlock()
+	mts := []*memTable{db.mutable}
+	for i := len(db.immutables) - 1; i >= 0; i-- {
+		mts = append(mts, db.immutables[i])
+	}
+	return mts
+}
+
+// Flush writes the mutable memtable to a level 0 SST file and returns once it and all earlier flushes are done
+func (db *DB) Flush() error {
+	err := db.acquireWrite()
 	if err != nil {
 		return err
 	}
-	return nil
+	defer db.release()
+	return db.flushMemTables()
 }
 
-// Close gracefully closes the database
-func (db *DB) Close() {
-	db.close <- struct{}{}
+// flushMemTables sends a Flush call to db.run and waits for it
+func (db *DB) flushMemTables() error {
+	err := db.lsm.bgErr.get()
+	if err != nil {
+		return err
+	}
+	errChan := make(chan error, 1)
+	db.flushReqChan <- errChan
+	return <-errChan
 }
 
 // ForceClose immediately shuts down the database. Good for testing
@@ -222,35 +378,50 @@ func (db *DB) forceClose() {
 	os.Exit(0)
 }
 
+// run serializes writes to the mutable memtable and decides when it is flushed. Writes are held back while
+// the mutable memtable is full and the queue of immutable memtables is too
 func (db *DB) run() {
+	ticker := time.NewTicker(writeStallCheckInterval)
+	defer ticker.Stop()
+	closing := db.closing
+
+	db.startFlush()
+
 	for {
 		select {
 		case req := <-db.writeChan:
-			err := db.mutable.Write(req.entries)
-			if err != nil {
-				req.errChan <- err
-			} else {
-				if db.mutable.size > MemTableSize {
-					db.flushChan <- db.mutable
-					db.mutable, db.immutable = db.immutable, db.mutable
+			// Writes queue up behind stalled writes so they are applied in commit order
+			if len(db.wc.stalled) > 0 || !db.processWrite(req) {
+				if db.wc.closing {
+					req.errChan <- newErrDBClosed()
+				} else if err := db.lsm.bgErr.get(); err != nil {
+					req.errChan <- err
+				} else {
+					db.wc.stalled = append(db.wc.stalled, req)
 				}
-				req.errChan <- nil
 			}
-		case <-db.close:
-			db.lsm.Close()
+		case errChan := <-db.flushReqChan:
+			db.wc.flushReqs = append(db.wc.flushReqs, &flushRequest{errChan: errChan})
+			db.processFlushRequests()
+		case err := <-db.flushDoneChan:
+			db.flushDone(err)
+		case <-ticker.C:
+			db.checkMemTables()
+		case req := <-db.checkpointChan:
+			db.runCheckpoint(req)
+		case <-closing:
+			closing = nil
+			db.stopStalled()
+		case errChan := <-db.close:
+			errChan <- db.stopMemTables()
 			return
 		}
 	}
 }
 
+// runFlush flushes the memtables sent by db.run until db.run closes flushChan
 func (db *DB) runFlush() {
-	for {
-		select {
-		case mt := <-db.flushChan:
-			err := db.flush(mt)
-			if err != nil {
-				fmt.Println(err)
-			}
-		}
+	for mt := range db.flushChan {
+		db.flushDoneChan <- db.flush(mt)
 	}
 }
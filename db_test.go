@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"sort"
 	"strconv"
@@ -263,6 +264,50 @@ func TestDBRange(t *testing.T) {
 	fmt.Printf("Duration reading range: %v\n", duration)
 }
 
+func TestDBScanUnbounded(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	// Keys with bytes above ASCII sort after any key made of ASCII, however long
+	keys := []string{"a", "b", "b\x00", "bz", "b\xff\xff", "c", "\xc3\xa9", "\xff\xff"}
+	for _, key := range keys {
+		err := db.Insert(key, map[string]*Value{"value": &Value{DataType: String, Data: []byte(key)}})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	for _, flush := range []bool{false, true} {
+		if flush {
+			err = db.Flush()
+			if err != nil {
+				t.Fatalf("Error flushing memtable: %v\n", err)
+			}
+		}
+		entries, err := db.Scan("b", []string{"value"})
+		if err != nil {
+			t.Fatalf("Error scanning db: %v\n", err)
+		}
+		if len(entries) != len(keys)-1 {
+			t.Fatalf("Scan length, Expected: %d, Got: %d\n", len(keys)-1, len(entries))
+		}
+		entries, err = db.scan(prefixRange("b"), math.MaxUint64)
+		if err != nil {
+			t.Fatalf("Error scanning prefix: %v\n", err)
+		}
+		if len(entries) != 4 {
+			t.Fatalf("Prefix scan length, Expected: 4, Got: %d\n", len(entries))
+		}
+		for _, entry := range entries {
+			if entry.Key[0] != 'b' {
+				t.Fatalf("Expected only keys starting with b, Got: %q\n", entry.Key)
+			}
+		}
+	}
+}
+
 func TestDBRandom(t *testing.T) {
 	db, err := setupDB("data")
 	if err != nil {
@@ -3,6 +3,10 @@ package db
 import (
 	"encoding/binary"
 	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Entry represents a row in the db where a key is mapped to multiple Attributes
@@ -18,7 +22,34 @@ type Value struct {
 	Data     []byte
 }
 
-// CreateValue converts an interface value to type Value
+// FixedPoint is a decimal number equal to Unscaled / 10^Scale. It is stored as a Decimal value.
+// Trailing zeros are not preserved, so 1.50 is parsed back as 1.5
+type FixedPoint struct {
+	Unscaled int64
+	Scale    uint8
+}
+
+// String formats the decimal with Scale digits after the decimal point
+func (d FixedPoint) String() string {
+	magnitude := uint64(d.Unscaled)
+	sign := ""
+	if d.Unscaled < 0 {
+		magnitude = uint64(-d.Unscaled)
+		sign = "-"
+	}
+	digits := strconv.FormatUint(magnitude, 10)
+	if d.Scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= int(d.Scale) {
+		digits = strings.Repeat("0", int(d.Scale)-len(digits)+1) + digits
+	}
+	point := len(digits) - int(d.Scale)
+	return sign + digits[:point] + "." + digits[point:]
+}
+
+// CreateValue converts an interface value to type Value. Besides the basic types, it supports
+// time.Time, FixedPoint, slices whose elements all have the same type, and maps with string keys
 func CreateValue(value interface{}) (*Value, error) {
 	switch v := value.(type) {
 	case bool:
@@ -45,8 +76,75 @@ func CreateValue(value interface{}) (*Value, error) {
 		return &Value{DataType: Bytes, Data: v}, nil
 	case nil:
 		return &Value{DataType: Tombstone, Data: []byte{}}, nil
+	case time.Time:
+		return &Value{DataType: Time, Data: encodeTime(v)}, nil
+	case FixedPoint:
+		return &Value{DataType: Decimal, Data: encodeDecimal(v)}, nil
+	case []interface{}:
+		data, err := encodeList(v)
+		if err != nil {
+			return nil, err
+		}
+		return &Value{DataType: List, Data: data}, nil
+	case map[string]interface{}:
+		data, err := encodeMap(v)
+		if err != nil {
+			return nil, err
+		}
+		return &Value{DataType: Map, Data: data}, nil
+	}
+	// Convert typed slices and maps such as []string or map[string]int64
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Slice:
+		elements := make([]interface{}, reflected.Len())
+		for i := range elements {
+			elements[i] = reflected.Index(i).Interface()
+		}
+		return CreateValue(elements)
+	case reflect.Map:
+		if reflected.Type().Key().Kind() != reflect.String {
+			return nil, newErrNoTypeFound()
+		}
+		document := make(map[string]interface{})
+		iter := reflected.MapRange()
+		for iter.Next() {
+			document[iter.Key().String()] = iter.Value().Interface()
+		}
+		return CreateValue(document)
+	}
+	return nil, newErrNoTypeFound()
+}
+
+// dataTypeName returns the name of a supported value type
+func dataTypeName(dataType uint8) string {
+	switch dataType {
+	case Bool:
+		return "Bool"
+	case Int:
+		return "Int"
+	case Uint:
+		return "Uint"
+	case Float:
+		return "Float"
+	case String:
+		return "String"
+	case Bytes:
+		return "Bytes"
+	case Tombstone:
+		return "Tombstone"
+	case Time:
+		return "Time"
+	case Decimal:
+		return "Decimal"
+	case List:
+		return "List"
+	case Map:
+		return "Map"
+	case valuePointer:
+		return "ValuePointer"
 	default:
-		return nil, newErrNoTypeFound()
+		return "Unknown"
 	}
 }
 
@@ -84,15 +182,41 @@ func ParseValue(value *Value) (interface{}, error) {
 		return string(data), nil
 	case Bytes:
 		return data, nil
+	case Time:
+		t, err := decodeTime(data)
+		if err != nil {
+			return nil, newErrParseValue(value)
+		}
+		return t, nil
+	case Decimal:
+		d, err := decodeDecimal(data)
+		if err != nil {
+			return nil, newErrParseValue(value)
+		}
+		return d, nil
+	case List:
+		elements, err := decodeList(data)
+		if err != nil {
+			return nil, newErrParseValue(value)
+		}
+		return elements, nil
+	case Map:
+		document, err := decodeMap(data)
+		if err != nil {
+			return nil, newErrParseValue(value)
+		}
+		return document, nil
 	default:
 		return nil, newErrParseValue(value)
 	}
 }
 
-// indexEntry is struct that represents an entry into an lsm Index Block
+// indexEntry locates a data block by its offset and size within the data section of an SST file.
+// The key is the last key in the block
 type indexEntry struct {
-	key   string
-	block uint32
+	key    string
+	offset uint64
+	size   uint64
 }
 
 func createEntry(ts uint64, key string, attributes map[string]interface{}) (*Entry, error) {
@@ -124,45 +248,123 @@ func createEntry(ts uint64, key string, attributes map[string]interface{}) (*Ent
 	return entry, nil
 }
 
+// entryFormatFlag is set in the size of every entry encoded with varint lengths. Legacy entries with
+// 8 bit key sizes and 16 bit attribute sizes are always far smaller than 2^31 bytes so they never have it set
+const entryFormatFlag = 1 << 31
+
+// encodeEntry encodes an entry as its size followed by its ts, key, and attributes.
+// All lengths are varints so keys and values are not limited by the encoding
 func encodeEntry(entry *Entry) (data []byte) {
 	tsBytes := make([]byte, 8)
 	binary.LittleEndian.PutUint64(tsBytes, entry.ts)
-	keySizeBytes := uint8(len(entry.Key))
-	keyBytes := []byte(entry.Key)
-	AttributesBytes := []byte{}
 
-	for name, value := range entry.Attributes {
-		nameSizeBytes := uint8(len(name))
-		nameBytes := []byte(name)
-		DataTypeBytes := value.DataType
-		dataSizeBytes := make([]byte, 2)
-		binary.LittleEndian.PutUint16(dataSizeBytes, uint16(len(value.Data)))
-		dataBytes := value.Data
+	data = append(data, tsBytes...)
+	data = appendUvarint(data, uint64(len(entry.Key)))
+	data = append(data, []byte(entry.Key)...)
+	data = encodeAttributes(data, entry.Attributes)
+
+	totalSizeBytes := make([]byte, 4)
+	binary.LittleEndian.PutUint32(totalSizeBytes, uint32(len(data))|entryFormatFlag)
 
-		fieldBytes := []byte{}
-		fieldBytes = append(fieldBytes, nameSizeBytes)
-		fieldBytes = append(fieldBytes, nameBytes...)
-		fieldBytes = append(fieldBytes, DataTypeBytes)
-		fieldBytes = append(fieldBytes, dataSizeBytes...)
-		fieldBytes = append(fieldBytes, dataBytes...)
+	return append(totalSizeBytes, data...)
+}
 
-		AttributesBytes = append(AttributesBytes, fieldBytes...)
+// readEntry decodes the entry at the start of data, written in either format, and returns the number of
+// bytes it used. A size of 0 marks the end of a block or WAL and returns a nil entry
+func readEntry(data []byte) (entry *Entry, n int, err error) {
+	if len(data) < 4 {
+		return nil, 0, newErrDecodeEntry()
+	}
+	entrySize := binary.LittleEndian.Uint32(data[:4])
+	if entrySize == 0 {
+		return nil, 4, nil
+	}
+	legacy := entrySize&entryFormatFlag == 0
+	entrySize &^= entryFormatFlag
+	if 4+int(entrySize) > len(data) {
+		return nil, 0, newErrBadFormattedSST()
 	}
+	body := data[4 : 4+int(entrySize)]
+	if legacy {
+		entry, err = decodeLegacyEntry(body)
+	} else {
+		entry, err = decodeEntry(body)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return entry, 4 + int(entrySize), nil
+}
 
-	data = append(data, tsBytes...)
-	data = append(data, keySizeBytes)
-	data = append(data, keyBytes...)
-	data = append(data, AttributesBytes...)
+// decodeEntry decodes an entry encoded by encodeEntry without its size
+func decodeEntry(data []byte) (*Entry, error) {
+	if len(data) < 8 {
+		return nil, newErrDecodeEntry()
+	}
+	entry := &Entry{
+		ts:         binary.LittleEndian.Uint64(data[:8]),
+		Key:        "",
+		Attributes: nil,
+	}
+	i := 8
+	keySize, n := binary.Uvarint(data[i:])
+	if n <= 0 || uint64(len(data)-i-n) < keySize {
+		return nil, newErrDecodeEntry()
+	}
+	i += n
+	entry.Key = string(data[i : i+int(keySize)])
+	i += int(keySize)
 
-	totalSize := uint32(len(data))
-	totalSizeBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(totalSizeBytes, totalSize)
+	attributes, err := decodeAttributes(data[i:])
+	if err != nil {
+		return nil, err
+	}
+	entry.Attributes = attributes
+	return entry, nil
+}
 
-	data = append(totalSizeBytes, data...)
+// encodeAttributes appends the name, type, and data of every attribute to data
+func encodeAttributes(data []byte, attributes map[string]*Value) []byte {
+	for name, value := range attributes {
+		data = appendUvarint(data, uint64(len(name)))
+		data = append(data, []byte(name)...)
+		data = append(data, value.DataType)
+		data = appendUvarint(data, uint64(len(value.Data)))
+		data = append(data, value.Data...)
+	}
 	return data
 }
 
-func decodeEntry(data []byte) (*Entry, error) {
+// decodeAttributes decodes attributes encoded by encodeAttributes. It returns nil if there are none
+func decodeAttributes(data []byte) (map[string]*Value, error) {
+	attributes := make(map[string]*Value)
+	i := 0
+	for i < len(data) {
+		nameSize, n := binary.Uvarint(data[i:])
+		if n <= 0 || uint64(len(data)-i-n) < nameSize+1 {
+			return nil, newErrDecodeEntry()
+		}
+		i += n
+		name := string(data[i : i+int(nameSize)])
+		i += int(nameSize)
+		dataType := data[i]
+		i++
+		dataSize, n := binary.Uvarint(data[i:])
+		if n <= 0 || uint64(len(data)-i-n) < dataSize {
+			return nil, newErrDecodeEntry()
+		}
+		i += n
+		attributes[name] = &Value{DataType: dataType, Data: data[i : i+int(dataSize)]}
+		i += int(dataSize)
+	}
+	if len(attributes) == 0 {
+		return nil, nil
+	}
+	return attributes, nil
+}
+
+// decodeLegacyEntry decodes an entry written before lengths were varints
+func decodeLegacyEntry(data []byte) (*Entry, error) {
 	const (
 		tsBytes uint8 = iota
 		keyBytes
@@ -202,6 +404,9 @@ func decodeEntry(data []byte) (*Entry, error) {
 			}
 			fieldName := string(data[i : i+int(fieldNameSize)])
 			i += int(fieldNameSize)
+			if i+1 > len(data) {
+				return nil, newErrDecodeEntry()
+			}
 			fieldType := uint8(data[i])
 			i++
 			if i+2 > len(data) {
@@ -225,76 +430,247 @@ func decodeEntry(data []byte) (*Entry, error) {
 	return entry, nil
 }
 
+// decodeEntries decodes all entries in a sequence of padded data blocks from files before compressedVersion.
+// Entries larger than a block start at a block boundary and span as many blocks as needed, so any bytes
+// that cannot hold an entry are padding
 func decodeEntries(data []byte) (entries []*Entry, err error) {
-	for i := 0; i < len(data); i += BlockSize {
-		block := data[i : i+BlockSize]
-		j := 0
-		for j < len(block) {
-			if j+4 > len(block) {
-				break
-			}
-			entrySize := binary.LittleEndian.Uint32(block[j : j+4])
-			j += 4
-			if j+int(entrySize) > len(block) {
-				return nil, newErrBadFormattedSST()
-			}
-			if entrySize == 0 {
-				break
-			}
-			entry, err := decodeEntry(block[j : j+int(entrySize)])
-			if err != nil {
-				return nil, err
-			}
-			j += int(entrySize)
-			entries = append(entries, entry)
+	i := 0
+	for i < len(data) {
+		blockEnd := (i/BlockSize + 1) * BlockSize
+		if i+4 > blockEnd || i+4 > len(data) {
+			i = blockEnd
+			continue
+		}
+		entry, n, err := readEntry(data[i:])
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			i = blockEnd
+			continue
 		}
+		i += n
+		entries = append(entries, entry)
 	}
 	return entries, nil
 }
 
-func writeEntries(entries []*Entry) (dataBlocks, indexBlock []byte, bloom *bloom, kr *keyRange, err error) {
-	kr = &keyRange{
-		startKey: entries[0].Key,
-		endKey:   entries[len(entries)-1].Key,
+// blockContents returns the encoded entries of a data block read from an SST file of the given version
+func blockContents(version uint64, data []byte) ([]byte, error) {
+	if version < compressedVersion {
+		return data, nil
+	}
+	return decompressBlock(data)
+}
+
+// decodeBlock decodes all entries in the contents of a data block from an SST file of the given version
+func decodeBlock(version uint64, block []byte) ([]*Entry, error) {
+	if version < compressedVersion {
+		return decodeEntries(block)
+	}
+	if version >= restartVersion {
+		return decodeRestartBlock(block)
 	}
-	bloom = newBloom(len(entries))
-	block := make([]byte, BlockSize)
-	currBlock := uint32(0)
+	entries := []*Entry{}
 	i := 0
-	for index, entry := range entries {
-		entryBytes := encodeEntry(entry)
-		// Create new block if current entry overflows block
-		if i+len(entryBytes) > BlockSize {
-			dataBlocks = append(dataBlocks, block...)
-			indexEntry := encodeIndexEntry(&indexEntry{
-				key:   entries[index-1].Key,
-				block: currBlock,
-			})
-			indexBlock = append(indexBlock, indexEntry...)
-			block = make([]byte, BlockSize)
-			currBlock++
-			i = 0
-		}
-		i += copy(block[i:], entryBytes)
-		bloom.Insert(entry.Key)
-		// If last entry, append data block and index entry
-		if index == len(entries)-1 {
-			dataBlocks = append(dataBlocks, block...)
-			indexEntry := encodeIndexEntry(&indexEntry{
-				key:   entry.Key,
-				block: currBlock,
-			})
-			indexBlock = append(indexBlock, indexEntry...)
-		}
-	}
-	return dataBlocks, indexBlock, bloom, kr, nil
+	for i < len(block) {
+		entry, n, err := readEntry(block[i:])
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, newErrBadFormattedSST()
+		}
+		i += n
+		entries = append(entries, entry)
+	}
+	return entries, nil
 }
 
-func encodeIndexEntry(entry *indexEntry) (data []byte) {
-	data = append(data, uint8(len(entry.key)))
-	data = append(data, []byte(entry.key)...)
-	blockBytes := make([]byte, 4)
-	binary.LittleEndian.PutUint32(blockBytes, entry.block)
-	data = append(data, blockBytes...)
-	return data
+// decodeDataBlocks decodes the entries of every data block in the index from data, which starts at the given
+// offset of the data section
+func decodeDataBlocks(version uint64, data []byte, offset uint64, index []*indexEntry) ([]*Entry, error) {
+	entries := []*Entry{}
+	for _, handle := range index {
+		if handle.offset < offset || handle.offset+handle.size-offset > uint64(len(data)) {
+			return nil, newErrBadFormattedSST()
+		}
+		block, err := blockContents(version, data[handle.offset-offset:handle.offset+handle.size-offset])
+		if err != nil {
+			return nil, err
+		}
+		blockEntries, err := decodeBlock(version, block)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, blockEntries...)
+	}
+	return entries, nil
+}
+
+// sstBuilder builds the data blocks, index block, and bloom filter of an SST file from entries added in sorted
+// order. Data blocks are compressed as soon as they reach BlockSize
+type sstBuilder struct {
+	compression CompressionType
+	builder     *blockBuilder
+	dataBlocks  []byte
+	index       []*indexEntry
+	indexSize   int
+	keys        []string
+	kr          *keyRange
+}
+
+func newSSTBuilder(compression CompressionType) *sstBuilder {
+	return &sstBuilder{
+		compression: compression,
+		builder:     newBlockBuilder(),
+		dataBlocks:  []byte{},
+		index:       []*indexEntry{},
+		keys:        []string{},
+	}
+}
+
+func (b *sstBuilder) empty() bool {
+	return len(b.keys) == 0
+}
+
+// lastKey returns the key of the last added entry
+func (b *sstBuilder) lastKey() string {
+	return b.keys[len(b.keys)-1]
+}
+
+// size estimates the size of the SST file if it was finished now
+func (b *sstBuilder) size() int {
+	size := headerSize + len(b.dataBlocks) + b.builder.size() + b.indexSize + int(bloomSize(len(b.keys)))
+	if b.kr != nil {
+		size += len(b.kr.startKey) + len(b.kr.endKey)
+	}
+	return size
+}
+
+func (b *sstBuilder) flushBlock() error {
+	compressed, err := compressBlock(b.compression, b.builder.finish())
+	if err != nil {
+		return err
+	}
+	b.index = append(b.index, &indexEntry{
+		key:    b.lastKey(),
+		offset: uint64(len(b.dataBlocks)),
+		size:   uint64(len(compressed)),
+	})
+	b.indexSize += len(b.lastKey()) + 2*binary.MaxVarintLen64
+	b.dataBlocks = append(b.dataBlocks, compressed...)
+	return nil
+}
+
+// add appends an entry to the current data block, starting a new block if the entry overflows it
+func (b *sstBuilder) add(entry *Entry) error {
+	value := encodeBlockEntry(entry)
+	if !b.builder.empty() && b.builder.size()+len(entry.Key)+len(value) > BlockSize {
+		err := b.flushBlock()
+		if err != nil {
+			return err
+		}
+	}
+	if b.kr == nil {
+		b.kr = &keyRange{startKey: entry.Key}
+	}
+	b.kr.endKey = entry.Key
+	if entry.ts > b.kr.maxTs {
+		b.kr.maxTs = entry.ts
+	}
+	b.builder.add(entry.Key, value)
+	b.keys = append(b.keys, entry.Key)
+	return nil
+}
+
+// finish flushes the last data block and returns the parts of the SST file
+func (b *sstBuilder) finish() (dataBlocks, indexBlock []byte, bloom *bloom, kr *keyRange, err error) {
+	if !b.builder.empty() {
+		err := b.flushBlock()
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	bloom = newBloom(len(b.keys))
+	for _, key := range b.keys {
+		bloom.Insert(key)
+	}
+	return b.dataBlocks, encodeIndexBlock(b.index), bloom, b.kr, nil
+}
+
+// writeEntries groups entries into data blocks of about BlockSize and compresses each block.
+// Blocks have variable length so the index block records the offset and size of each one
+func writeEntries(entries []*Entry, compression CompressionType) (dataBlocks, indexBlock []byte, bloom *bloom, kr *keyRange, err error) {
+	builder := newSSTBuilder(compression)
+	for _, entry := range entries {
+		err := builder.add(entry)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	return builder.finish()
+}
+
+// decodeIndex decodes an index block into its entries. Files before compressedVersion store block numbers
+// instead of offsets, and each of their data blocks extends up to the start of the next one
+func decodeIndex(version uint64, data []byte, dataSize uint64) ([]*indexEntry, error) {
+	if version >= restartVersion {
+		return decodeIndexBlock(data, dataSize)
+	}
+	entries := []*indexEntry{}
+	i := 0
+	for i < len(data) {
+		var keySize uint64
+		if version == legacyVersion {
+			keySize = uint64(data[i])
+			i++
+		} else {
+			size, n := binary.Uvarint(data[i:])
+			if n <= 0 {
+				return nil, newErrBadFormattedSST()
+			}
+			keySize = size
+			i += n
+		}
+		if uint64(len(data)-i) < keySize {
+			return nil, newErrBadFormattedSST()
+		}
+		key := string(data[i : i+int(keySize)])
+		i += int(keySize)
+		if version >= compressedVersion {
+			offset, n := binary.Uvarint(data[i:])
+			if n <= 0 {
+				return nil, newErrBadFormattedSST()
+			}
+			i += n
+			size, n := binary.Uvarint(data[i:])
+			if n <= 0 || offset+size > dataSize {
+				return nil, newErrBadFormattedSST()
+			}
+			i += n
+			entries = append(entries, &indexEntry{key: key, offset: offset, size: size})
+			continue
+		}
+		if len(data)-i < 4 {
+			return nil, newErrBadFormattedSST()
+		}
+		block := binary.LittleEndian.Uint32(data[i : i+4])
+		i += 4
+		entries = append(entries, &indexEntry{
+			key:    key,
+			offset: uint64(block) * BlockSize,
+		})
+	}
+	if version >= compressedVersion {
+		return entries, nil
+	}
+	for i, entry := range entries {
+		if i+1 < len(entries) {
+			entry.size = entries[i+1].offset - entry.offset
+		} else {
+			entry.size = dataSize - entry.offset
+		}
+	}
+	return entries, nil
 }
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -66,7 +68,7 @@ func TestEntryEncode(t *testing.T) {
 		t.Fatalf("Error setting up entry: %v\n", err)
 	}
 	data := encodeEntry(entry)
-	totalSize := binary.LittleEndian.Uint32(data[0:4])
+	totalSize := binary.LittleEndian.Uint32(data[0:4]) &^ entryFormatFlag
 	if int(totalSize)+4 != len(data) {
 		t.Fatalf("Wrong size in entry encode\n")
 	}
@@ -116,11 +118,15 @@ func TestEntryWrite(t *testing.T) {
 	for i := 0; i < 100; i++ {
 		entries = append(entries, entry)
 	}
-	dataBlocks, _, _, _, err := writeEntries(entries)
+	dataBlocks, indexBlock, _, _, err := writeEntries(entries, SnappyCompression)
 	if err != nil {
 		t.Fatalf("Error writing entries: %v\n", err)
 	}
-	result, err := decodeEntries(dataBlocks)
+	index, err := decodeIndex(sstVersion, indexBlock, uint64(len(dataBlocks)))
+	if err != nil {
+		t.Fatalf("Error decoding index: %v\n", err)
+	}
+	result, err := decodeDataBlocks(sstVersion, dataBlocks, 0, index)
 	if err != nil {
 		t.Fatalf("Error decoding entries: %v\n", err)
 	}
@@ -156,3 +162,88 @@ func TestEntryWrite(t *testing.T) {
 		}
 	}
 }
+
+func TestValueRichTypes(t *testing.T) {
+	attributes := map[string]interface{}{
+		"time":     time.Date(2019, 3, 14, 15, 9, 26, 535897932, time.UTC),
+		"decimal":  FixedPoint{Unscaled: -12345, Scale: 2},
+		"list":     []interface{}{"a", "b\x00c", ""},
+		"ints":     []int64{3, -1, 2},
+		"document": map[string]interface{}{"name": "test", "tags": []string{"x", "y"}, "inner": map[string]interface{}{"n": uint64(7)}},
+		"nilList":  []interface{}{nil, nil},
+		"nilMap":   map[string]interface{}{"a": nil, "b": "c"},
+	}
+	entry, err := createEntry(uint64(1), "test", attributes)
+	if err != nil {
+		t.Fatalf("Error creating entry: %v\n", err)
+	}
+	data := encodeEntry(entry)
+	result, err := decodeEntry(data[4:])
+	if err != nil {
+		t.Fatalf("Error decoding entry: %v\n", err)
+	}
+
+	expected := map[string]interface{}{
+		"time":     attributes["time"],
+		"decimal":  attributes["decimal"],
+		"list":     []interface{}{"a", "b\x00c", ""},
+		"ints":     []interface{}{int64(3), int64(-1), int64(2)},
+		"document": map[string]interface{}{"name": "test", "tags": []interface{}{"x", "y"}, "inner": map[string]interface{}{"n": uint64(7)}},
+		"nilList":  []interface{}{nil, nil},
+		"nilMap":   map[string]interface{}{"a": nil, "b": "c"},
+	}
+	for name, v1 := range expected {
+		v2, err := ParseValue(result.Attributes[name])
+		if err != nil {
+			t.Fatalf("Error parsing value %v: %v\n", name, err)
+		}
+		if !reflect.DeepEqual(v1, v2) {
+			t.Fatalf("Attribute %v, Expected: %v, Got: %v\n", name, v1, v2)
+		}
+	}
+}
+
+func TestValueOrdering(t *testing.T) {
+	ordered := [][]interface{}{
+		[]interface{}{time.Unix(-100, 0), time.Unix(0, 0), time.Unix(0, 1), time.Unix(1<<40, 0)},
+		[]interface{}{
+			FixedPoint{Unscaled: -1000, Scale: 0},
+			FixedPoint{Unscaled: -125, Scale: 2},
+			FixedPoint{Unscaled: -12, Scale: 1},
+			FixedPoint{Unscaled: 0, Scale: 3},
+			FixedPoint{Unscaled: 5, Scale: 3},
+			FixedPoint{Unscaled: 12, Scale: 1},
+			FixedPoint{Unscaled: 125, Scale: 2},
+			FixedPoint{Unscaled: 1000, Scale: 0},
+		},
+		[]interface{}{[]int64{}, []int64{-5}, []int64{-5, 1}, []int64{0}, []int64{1, -1}},
+		[]interface{}{[]string{"a"}, []string{"a", ""}, []string{"a\x00"}, []string{"b"}},
+	}
+	for _, values := range ordered {
+		for i := 1; i < len(values); i++ {
+			a, err := CreateValue(values[i-1])
+			if err != nil {
+				t.Fatalf("Error creating value: %v\n", err)
+			}
+			b, err := CreateValue(values[i])
+			if err != nil {
+				t.Fatalf("Error creating value: %v\n", err)
+			}
+			if compareValues(a, b) >= 0 {
+				t.Fatalf("Expected %v < %v\n", values[i-1], values[i])
+			}
+		}
+	}
+
+	a, _ := CreateValue(FixedPoint{Unscaled: 150, Scale: 2})
+	b, _ := CreateValue(FixedPoint{Unscaled: 15, Scale: 1})
+	if compareValues(a, b) != 0 {
+		t.Fatalf("Expected 1.50 == 1.5\n")
+	}
+	if _, err := CreateValue([]interface{}{"a", int64(1)}); err == nil {
+		t.Fatalf("Expected: ErrHeterogeneousList\n")
+	}
+	if s := (FixedPoint{Unscaled: -5, Scale: 2}).String(); s != "-0.05" {
+		t.Fatalf("Expected: -0.05, Got: %v\n", s)
+	}
+}
@@ -58,22 +58,7 @@ func newErrIncorrectValueSize(valueType uint8, valueSize int) *ErrIncorrectValue
 }
 
 func (e *ErrIncorrectValueSize) Error() string {
-	valueType := ""
-	switch e.valueType {
-	case Bool:
-		valueType = "Bool"
-	case Int:
-		valueType = "Int"
-	case Float:
-		valueType = "Float"
-	case String:
-		valueType = "String"
-	case Bytes:
-		valueType = "Bytes"
-	case Tombstone:
-		valueType = "Tombstone"
-	}
-	return fmt.Sprintf("Value byte size %d is not appropriate for %s", e.valueSize, valueType)
+	return fmt.Sprintf("Value byte size %d is not appropriate for %s", e.valueSize, dataTypeName(e.valueType))
 }
 
 type ErrIncompatibleValue struct {
@@ -87,22 +72,7 @@ func newErrIncompatibleValue(valueType uint8) *ErrIncompatibleValue {
 }
 
 func (e *ErrIncompatibleValue) Error() string {
-	valueType := ""
-	switch e.valueType {
-	case Bool:
-		valueType = "Bool"
-	case Int:
-		valueType = "Int"
-	case Float:
-		valueType = "Float"
-	case String:
-		valueType = "String"
-	case Bytes:
-		valueType = "Bytes"
-	case Tombstone:
-		valueType = "Tombstone"
-	}
-	return fmt.Sprintf("Incompatible value bytes for %s", valueType)
+	return fmt.Sprintf("Incompatible value bytes for %s", dataTypeName(e.valueType))
 }
 
 type ErrNoTypeFound struct{}
@@ -222,3 +192,277 @@ func newErrKeyAlreadyExists(key string) *ErrKeyAlreadyExists {
 func (e *ErrKeyAlreadyExists) Error() string {
 	return fmt.Sprintf("Key: %v already exists in the DB", e.key)
 }
+
+type ErrInvalidRange struct{}
+
+func newErrInvalidRange() *ErrInvalidRange {
+	return &ErrInvalidRange{}
+}
+
+func (e *ErrInvalidRange) Error() string {
+	return "Start of range is greater than end of range"
+}
+
+type ErrReservedKey struct {
+	key string
+}
+
+func newErrReservedKey(key string) *ErrReservedKey {
+	return &ErrReservedKey{key: key}
+}
+
+func (e *ErrReservedKey) Error() string {
+	return fmt.Sprintf("Key: %q is reserved for internal use", e.key)
+}
+
+type ErrInvalidIndex struct {
+	name string
+}
+
+func newErrInvalidIndex(name string) *ErrInvalidIndex {
+	return &ErrInvalidIndex{name: name}
+}
+
+func (e *ErrInvalidIndex) Error() string {
+	return fmt.Sprintf("Index: %q must have a name without null bytes and an attribute", e.name)
+}
+
+type ErrIndexNotFound struct {
+	name string
+}
+
+func newErrIndexNotFound(name string) *ErrIndexNotFound {
+	return &ErrIndexNotFound{name: name}
+}
+
+func (e *ErrIndexNotFound) Error() string {
+	return fmt.Sprintf("Index: %v does not exist", e.name)
+}
+
+type ErrIndexAlreadyExists struct {
+	name string
+}
+
+func newErrIndexAlreadyExists(name string) *ErrIndexAlreadyExists {
+	return &ErrIndexAlreadyExists{name: name}
+}
+
+func (e *ErrIndexAlreadyExists) Error() string {
+	return fmt.Sprintf("Index: %v already exists in the DB", e.name)
+}
+
+type ErrIndexInconsistent struct {
+	name string
+	key  string
+}
+
+func newErrIndexInconsistent(name, key string) *ErrIndexInconsistent {
+	return &ErrIndexInconsistent{name: name, key: key}
+}
+
+func (e *ErrIndexInconsistent) Error() string {
+	return fmt.Sprintf("Index: %v is inconsistent with the DB at key: %q", e.name, e.key)
+}
+
+type ErrSchemaViolation struct {
+	key       string
+	attribute string
+	reason    string
+}
+
+func newErrSchemaViolation(key, attribute, reason string) *ErrSchemaViolation {
+	return &ErrSchemaViolation{key: key, attribute: attribute, reason: reason}
+}
+
+func (e *ErrSchemaViolation) Error() string {
+	return fmt.Sprintf("Key: %v violates schema at attribute %v: %v", e.key, e.attribute, e.reason)
+}
+
+type ErrInvalidSchema struct {
+	prefix string
+	reason string
+}
+
+func newErrInvalidSchema(prefix, reason string) *ErrInvalidSchema {
+	return &ErrInvalidSchema{prefix: prefix, reason: reason}
+}
+
+func (e *ErrInvalidSchema) Error() string {
+	return fmt.Sprintf("Schema for prefix: %q is invalid: %v", e.prefix, e.reason)
+}
+
+type ErrHeterogeneousList struct {
+	expected uint8
+	got      uint8
+}
+
+func newErrHeterogeneousList(expected, got uint8) *ErrHeterogeneousList {
+	return &ErrHeterogeneousList{expected: expected, got: got}
+}
+
+func (e *ErrHeterogeneousList) Error() string {
+	return fmt.Sprintf("List elements must all have the same type. Expected: %s, Got: %s", dataTypeName(e.expected), dataTypeName(e.got))
+}
+
+type ErrValueLogFileNotFound struct {
+	fileID uint32
+}
+
+func newErrValueLogFileNotFound(fileID uint32) *ErrValueLogFileNotFound {
+	return &ErrValueLogFileNotFound{fileID: fileID}
+}
+
+func (e *ErrValueLogFileNotFound) Error() string {
+	return fmt.Sprintf("Value log file %d does not exist", e.fileID)
+}
+
+type ErrCorruptValueLog struct {
+	fileID uint32
+	offset uint64
+}
+
+func newErrCorruptValueLog(fileID uint32, offset uint64) *ErrCorruptValueLog {
+	return &ErrCorruptValueLog{fileID: fileID, offset: offset}
+}
+
+func (e *ErrCorruptValueLog) Error() string {
+	return fmt.Sprintf("Corrupt value log record in file %d at offset %d", e.fileID, e.offset)
+}
+
+type ErrUnknownCompression struct {
+	compression uint8
+}
+
+func newErrUnknownCompression(compression uint8) *ErrUnknownCompression {
+	return &ErrUnknownCompression{compression: compression}
+}
+
+func (e *ErrUnknownCompression) Error() string {
+	return fmt.Sprintf("Unknown block compression type: %d", e.compression)
+}
+
+type ErrMMapUnsupported struct{}
+
+func newErrMMapUnsupported() *ErrMMapUnsupported {
+	return &ErrMMapUnsupported{}
+}
+
+func (e *ErrMMapUnsupported) Error() string {
+	return fmt.Sprintf("Memory mapped SST reads are not supported on this platform")
+}
+
+type ErrDBClosed struct{}
+
+func newErrDBClosed() *ErrDBClosed {
+	return &ErrDBClosed{}
+}
+
+func (e *ErrDBClosed) Error() string {
+	return "Database is closed"
+}
+
+type ErrWriteStall struct {
+	reason string
+}
+
+func newErrWriteStall(reason string) *ErrWriteStall {
+	return &ErrWriteStall{reason: reason}
+}
+
+func (e *ErrWriteStall) Error() string {
+	return fmt.Sprintf("Write stalled until %s catches up", e.reason)
+}
+
+type ErrBackgroundError struct {
+	err error
+}
+
+func newErrBackgroundError(err error) *ErrBackgroundError {
+	return &ErrBackgroundError{err: err}
+}
+
+func (e *ErrBackgroundError) Error() string {
+	return fmt.Sprintf("Database is read only because of a background error: %v", e.err)
+}
+
+type ErrDirectoryLocked struct {
+	directory string
+}
+
+func newErrDirectoryLocked(directory string) *ErrDirectoryLocked {
+	return &ErrDirectoryLocked{directory: directory}
+}
+
+func (e *ErrDirectoryLocked) Error() string {
+	return fmt.Sprintf("Directory %s is already in use by another open DB", e.directory)
+}
+
+type ErrReadOnly struct{}
+
+func newErrReadOnly() *ErrReadOnly {
+	return &ErrReadOnly{}
+}
+
+func (e *ErrReadOnly) Error() string {
+	return "Database is opened read only"
+}
+
+type ErrNotSecondary struct{}
+
+func newErrNotSecondary() *ErrNotSecondary {
+	return &ErrNotSecondary{}
+}
+
+func (e *ErrNotSecondary) Error() string {
+	return "Database is not opened as a secondary instance"
+}
+
+type ErrBackupNotFound struct {
+	id uint64
+}
+
+func newErrBackupNotFound(id uint64) *ErrBackupNotFound {
+	return &ErrBackupNotFound{id: id}
+}
+
+func (e *ErrBackupNotFound) Error() string {
+	return fmt.Sprintf("Backup %d not found", e.id)
+}
+
+type ErrBackupCorrupted struct {
+	id     uint64
+	file   string
+	reason string
+}
+
+func newErrBackupCorrupted(id uint64, file, reason string) *ErrBackupCorrupted {
+	return &ErrBackupCorrupted{id: id, file: file, reason: reason}
+}
+
+func (e *ErrBackupCorrupted) Error() string {
+	return fmt.Sprintf("Backup %d is corrupted, %s: %s", e.id, e.file, e.reason)
+}
+
+type ErrDirectoryNotEmpty struct {
+	directory string
+}
+
+func newErrDirectoryNotEmpty(directory string) *ErrDirectoryNotEmpty {
+	return &ErrDirectoryNotEmpty{directory: directory}
+}
+
+func (e *ErrDirectoryNotEmpty) Error() string {
+	return fmt.Sprintf("Directory %s is not empty", e.directory)
+}
+
+type ErrInvalidNumBackups struct {
+	numToKeep int
+}
+
+func newErrInvalidNumBackups(numToKeep int) *ErrInvalidNumBackups {
+	return &ErrInvalidNumBackups{numToKeep: numToKeep}
+}
+
+func (e *ErrInvalidNumBackups) Error() string {
+	return fmt.Sprintf("Cannot keep %d backups", e.numToKeep)
+}
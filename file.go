@@ -1,8 +1,8 @@
 package db
 
 import (
-	"encoding/binary"
 	"os"
+	"sort"
 )
 
 func writeNewFile(filename string, data []byte) error {
@@ -25,25 +25,29 @@ func writeNewFile(filename string, data []byte) error {
 	return nil
 }
 
-func mmap(filename string) (entries []*Entry, err error) {
-	f, err := os.OpenFile(filename, os.O_RDONLY, filePerm)
-	defer f.Close()
-	if err != nil {
-		return nil, err
-	}
-	dataSize, _, _, _, err := readHeader(f)
-	if err != nil {
-		return nil, err
-	}
-	data := make([]byte, dataSize)
-	numBytes, err := f.ReadAt(data, headerSize)
+// writeNewFileChunks writes data to a new file one chunk of rateLimiterChunkSize at a time, calling
+// before with each chunk before it is written
+func writeNewFileChunks(filename string, data []byte, before func(chunk []byte)) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, filePerm)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if numBytes != len(data) {
-		return nil, newErrReadUnexpectedBytes(filename)
+	defer f.Close()
+	for offset := 0; offset < len(data); offset += rateLimiterChunkSize {
+		end := offset + rateLimiterChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		before(data[offset:end])
+		numBytes, err := f.Write(data[offset:end])
+		if err != nil {
+			return err
+		}
+		if numBytes != end-offset {
+			return newErrWriteUnexpectedBytes(filename)
+		}
 	}
-	return decodeEntries(data)
+	return f.Sync()
 }
 
 // recoverFile reads a file and returns key range, bloom filter, and total size of the file
@@ -53,112 +57,67 @@ func recoverFile(filename string) (keyRange *keyRange, bloom *bloom, size int, e
 	if err != nil {
 		return nil, nil, 0, err
 	}
-	dataSize, indexSize, bloomSize, keyRangeSize, err := readHeader(f)
+	header, err := readHeader(f)
 	if err != nil {
 		return nil, nil, 0, err
 	}
-	bitsAndkeyRange := make([]byte, bloomSize+keyRangeSize)
-	numBytes, err := f.ReadAt(bitsAndkeyRange, int64(headerSize+dataSize+indexSize))
+	bitsAndkeyRange := make([]byte, header.bloomSize+header.keyRangeSize)
+	numBytes, err := f.ReadAt(bitsAndkeyRange, header.indexOffset()+int64(header.indexSize))
 	if err != nil {
 		return nil, nil, 0, err
 	}
 	if numBytes != len(bitsAndkeyRange) {
 		return nil, nil, 0, newErrWriteUnexpectedBytes(filename)
 	}
-	bits := bitsAndkeyRange[:bloomSize]
-	keyRangeBytes := bitsAndkeyRange[bloomSize:]
+	bits := bitsAndkeyRange[:header.bloomSize]
+	keyRangeBytes := bitsAndkeyRange[header.bloomSize:]
 	bloom = recoverBloom(bits)
-	keyRange = parsekeyRangeEntry(keyRangeBytes)
-	return keyRange, bloom, int(dataSize + indexSize + bloomSize + keyRangeSize), nil
-}
-
-func fileFind(filename, key string, ts uint64) (entry *Entry, err error) {
-	f, err := os.OpenFile(filename, os.O_RDONLY, filePerm)
-	defer f.Close()
-	if err != nil {
-		return nil, err
-	}
-	dataSize, indexSize, _, _, err := readHeader(f)
-	if err != nil {
-		return nil, err
-	}
-	index := make([]byte, indexSize)
-	numBytes, err := f.ReadAt(index, headerSize+int64(dataSize))
-	if err != nil {
-		return nil, err
-	}
-	if numBytes != int(indexSize) {
-		return nil, newErrReadUnexpectedBytes("SST File, Index Block")
-	}
-	blockIndex, err := findDataBlock(key, index)
-	if err != nil {
-		return nil, err
-	}
-	block := make([]byte, BlockSize)
-	numBytes, err = f.ReadAt(block, headerSize+int64(BlockSize*int(blockIndex)))
+	keyRange, err = parsekeyRangeEntry(header.version, keyRangeBytes)
 	if err != nil {
-		return nil, err
-	}
-	if numBytes != BlockSize {
-		return nil, newErrReadUnexpectedBytes("SST File, Data Block")
+		return nil, nil, 0, err
 	}
-	return findKeyInBlock(key, ts, block)
+	return keyRange, bloom, header.totalSize(), nil
 }
 
-func fileRange(filename string, keyRange *keyRange, ts uint64) (entries []*Entry, err error) {
-	f, err := os.OpenFile(filename, os.O_RDONLY, filePerm)
-	defer f.Close()
+// readIndex reads the header and index block of an open SST file
+func readIndex(f *os.File) (*sstHeader, []*indexEntry, error) {
+	header, err := readHeader(f)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	dataSize, indexSize, _, _, err := readHeader(f)
+	index := make([]byte, header.indexSize)
+	numBytes, err := f.ReadAt(index, header.indexOffset())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	index := make([]byte, indexSize)
-	numBytes, err := f.ReadAt(index, headerSize+int64(dataSize))
-	if err != nil {
-		return nil, err
-	}
-	if numBytes != int(indexSize) {
-		return nil, newErrReadUnexpectedBytes("SST File, Index Block")
+	if numBytes != int(header.indexSize) {
+		return nil, nil, newErrReadUnexpectedBytes("SST File, Index Block")
 	}
-	startBlock, endBlock := rangeDataBlocks(keyRange.startKey, keyRange.endKey, index)
-	size := int(endBlock-startBlock+1) * BlockSize
-	blocks := make([]byte, size)
-	numBytes, err = f.ReadAt(blocks, headerSize+int64(BlockSize*int(startBlock)))
+	entries, err := decodeIndex(header.version, index, header.dataSize)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if numBytes != size {
-		return nil, newErrReadUnexpectedBytes("SST File, Data Block")
-	}
-	return findKeysInBlocks(keyRange, ts, blocks)
+	return header, entries, nil
 }
 
-func findDataBlock(key string, data []byte) (uint32, error) {
-	i := 0
-	for i < len(data) {
-		size := uint8(data[i])
-		i++
-		if i+int(size) > len(data) {
-			break
-		}
-		indexKey := string(data[i : i+int(size)])
-		i += int(size)
-		if i+4 > len(data) {
-			break
-		}
-		if key <= indexKey {
-			return binary.LittleEndian.Uint32(data[i : i+4]), nil
-		}
-		i += 4
-	}
-	return 0, newErrKeyNotFound()
+// findDataBlock binary searches the index for the position of the first data block that may contain the key
+func findDataBlock(key string, index []*indexEntry) (int, error) {
+	i := sort.Search(len(index), func(i int) bool {
+		return key <= index[i].key
+	})
+	if i == len(index) {
+		return 0, newErrKeyNotFound()
+	}
+	return i, nil
 }
 
-func findKeyInBlock(key string, ts uint64, data []byte) (*Entry, error) {
-	entries, err := decodeEntries(data)
+// findKeyInBlock returns the latest version of the key older than ts in a data block. Blocks of restartVersion
+// files are binary searched, older blocks are decoded entirely
+func findKeyInBlock(key string, ts uint64, version uint64, block []byte) (*Entry, error) {
+	if version >= restartVersion {
+		return seekRestartBlock(key, ts, block)
+	}
+	entries, err := decodeBlock(version, block)
 	if err != nil {
 		return nil, err
 	}
@@ -170,44 +129,27 @@ func findKeyInBlock(key string, ts uint64, data []byte) (*Entry, error) {
 	return nil, newErrKeyNotFound()
 }
 
-func rangeDataBlocks(startKey, endKey string, data []byte) (startBlock, endBlock uint32) {
-	foundStartBlock := false
-	block := uint32(0)
-	i := 0
-	for i < len(data) {
-		size := uint8(data[i])
-		i++
-		if i+int(size) > len(data) {
-			break
-		}
-		indexKey := string(data[i : i+int(size)])
-		i += int(size)
-		if i+4 > len(data) {
-			break
-		}
-		block = binary.LittleEndian.Uint32(data[i : i+4])
-		i += 4
-		if !foundStartBlock && startKey <= indexKey {
-			startBlock = block
-			foundStartBlock = true
-		}
-		if endKey <= indexKey {
-			return startBlock, block
-		}
-	}
-	return startBlock, block
+// rangeDataBlocks returns the positions in the index of the first and last data blocks that overlap the range
+func rangeDataBlocks(keyRange *keyRange, index []*indexEntry) (startBlock, endBlock int) {
+	startBlock = sort.Search(len(index), func(i int) bool {
+		return keyRange.startKey <= index[i].key
+	})
+	endBlock = sort.Search(len(index), func(i int) bool {
+		return keyRange.afterEnd(index[i].key)
+	})
+	if startBlock == len(index) {
+		startBlock = len(index) - 1
+	}
+	if endBlock == len(index) {
+		endBlock = len(index) - 1
+	}
+	return startBlock, endBlock
 }
 
-func findKeysInBlocks(keyRange *keyRange, ts uint64, data []byte) (result []*Entry, err error) {
-	startKey := keyRange.startKey
-	endKey := keyRange.endKey
-	entries, err := decodeEntries(data)
-	if err != nil {
-		return nil, err
-	}
+func findKeysInBlocks(keyRange *keyRange, ts uint64, entries []*Entry) (result []*Entry, err error) {
 	set := make(map[string]struct{})
 	for _, entry := range entries {
-		if _, ok := set[entry.Key]; !ok && startKey <= entry.Key && entry.Key <= endKey && entry.ts < ts {
+		if _, ok := set[entry.Key]; !ok && keyRange.contains(entry.Key) && entry.ts < ts {
 			result = append(result, entry)
 		}
 	}
@@ -3,129 +3,83 @@ package db
 // fileManager handles all write and read operations on files in lsm.
 // Centralized file manager is required to prevent 'too many files open' error
 type fileManager struct {
-	fileWriteChan chan *fileWriteReq
-	fileMmapChan  chan *fileMmapReq
-	fileFindChan  chan *fileFindReq
-	fileRangeChan chan *fileRangeReq
+	cache   *blockCache
+	tables  *tableCache
+	limiter *rateLimiter
+	deleter *fileDeleter
 }
 
-type fileWriteReq struct {
-	filename string
-	data     []byte
-	errChan  chan error
-}
-
-type fileMmapReq struct {
-	filename  string
-	replyChan chan []*Entry
-	errChan   chan error
-}
-
-type fileFindReq struct {
-	filename  string
-	key       string
-	ts        uint64
-	replyChan chan *Entry
-	errChan   chan error
-}
-
-type fileRangeReq struct {
-	filename  string
-	keyRange  *keyRange
-	ts        uint64
-	replyChan chan []*Entry
-	errChan   chan error
-}
-
-// newfileManager creates a new file manager that spawns allotted file workers
-func newFileManager() *fileManager {
-	fm := &fileManager{
-		fileWriteChan: make(chan *fileWriteReq),
-		fileMmapChan:  make(chan *fileMmapReq),
-		fileFindChan:  make(chan *fileFindReq),
-		fileRangeChan: make(chan *fileRangeReq),
-	}
-	for i := 0; i < numWorkers; i++ {
-		go fm.spawnFileWorker()
-	}
-	return fm
-}
-
-// spawnFileWorker takes care of all open file operations. This prevents 'too many open files' error by
-// restricting amount of workers who can open files
-func (fm *fileManager) spawnFileWorker() {
-	for {
-		select {
-		case req := <-fm.fileWriteChan:
-			err := writeNewFile(req.filename, req.data)
-			req.errChan <- err
-		case req := <-fm.fileMmapChan:
-			entries, err := mmap(req.filename)
-			req.errChan <- err
-			req.replyChan <- entries
-		case req := <-fm.fileFindChan:
-			entry, err := fileFind(req.filename, req.key, req.ts)
-			req.errChan <- err
-			req.replyChan <- entry
-		case req := <-fm.fileRangeChan:
-			entries, err := fileRange(req.filename, req.keyRange, req.ts)
-			req.errChan <- err
-			req.replyChan <- entries
-		}
+// newfileManager creates a new file manager that keeps up to maxOpenFiles files open.
+// Reads go through the given block cache, and memory map files if mmapReads is set
+func newFileManager(cache *blockCache, maxOpenFiles int, mmapReads bool) *fileManager {
+	return &fileManager{
+		cache:   cache,
+		tables:  newTableCache(maxOpenFiles, mmapReads && mmapSupported),
+		deleter: &fileDeleter{},
 	}
 }
 
 // Write writes an arbitrary sized byte slice to a file
 func (fm *fileManager) Write(filename string, data []byte) error {
-	errChan := make(chan error, 1)
-	req := &fileWriteReq{
-		filename: filename,
-		data:     data,
-		errChan:  errChan,
+	fm.tables.reserve()
+	defer fm.tables.unreserve()
+	return writeNewFile(filename, data)
+}
+
+// WriteRateLimited writes a byte slice to a file in chunks, waiting on the rate limiter before each chunk.
+// Without a rate limiter it is the same as Write
+func (fm *fileManager) WriteRateLimited(filename string, data []byte, priority ioPriority) error {
+	if fm.limiter == nil {
+		return fm.Write(filename, data)
 	}
-	fm.fileWriteChan <- req
-	return <-errChan
+	fm.tables.reserve()
+	defer fm.tables.unreserve()
+	return writeNewFileChunks(filename, data, func(chunk []byte) {
+		fm.limiter.request(len(chunk), priority)
+	})
 }
 
 // MMap reads a file's data block and converts it to a slice of lsmDataEntry
 func (fm *fileManager) MMap(filename string) ([]*Entry, error) {
-	replyChan := make(chan []*Entry, 1)
-	errChan := make(chan error, 1)
-	req := &fileMmapReq{
-		filename:  filename,
-		replyChan: replyChan,
-		errChan:   errChan,
+	t, err := fm.tables.acquire(filename, fm.cache)
+	if err != nil {
+		return nil, err
 	}
-	fm.fileMmapChan <- req
-	return <-replyChan, <-errChan
+	defer fm.tables.release(t)
+	return t.entries()
+}
+
+// Iterator returns an iterator over all entries of the file that reads one data block at a time
+func (fm *fileManager) Iterator(filename string) (*tableIterator, error) {
+	t, err := fm.tables.acquire(filename, fm.cache)
+	if err != nil {
+		return nil, err
+	}
+	return &tableIterator{tables: fm.tables, t: t}, nil
 }
 
 // Find attempts to find a lsmDataEntry that matches the given key within the file
 func (fm *fileManager) Find(filename, key string, ts uint64) (*Entry, error) {
-	replyChan := make(chan *Entry, 1)
-	errChan := make(chan error, 1)
-	req := &fileFindReq{
-		filename:  filename,
-		key:       key,
-		ts:        ts,
-		replyChan: replyChan,
-		errChan:   errChan,
+	t, err := fm.tables.acquire(filename, fm.cache)
+	if err != nil {
+		return nil, err
 	}
-	fm.fileFindChan <- req
-	return <-replyChan, <-errChan
+	defer fm.tables.release(t)
+	return t.find(fm.cache, key, ts)
 }
 
 // Range returns all lsmDataEntry within in the specified key range within the file
 func (fm *fileManager) Range(filename string, keyRange *keyRange, ts uint64) ([]*Entry, error) {
-	replyChan := make(chan []*Entry, 1)
-	errChan := make(chan error, 1)
-	req := &fileRangeReq{
-		filename:  filename,
-		keyRange:  keyRange,
-		ts:        ts,
-		replyChan: replyChan,
-		errChan:   errChan,
+	t, err := fm.tables.acquire(filename, fm.cache)
+	if err != nil {
+		return nil, err
 	}
-	fm.fileRangeChan <- req
-	return <-replyChan, <-errChan
+	defer fm.tables.release(t)
+	return t.rangeScan(fm.cache, keyRange, ts)
+}
+
+// Evict drops a deleted or moved file from the table and block caches
+func (fm *fileManager) Evict(filename string) {
+	fm.tables.evict(filename)
+	fm.cache.evictFile(sstFileID(filename))
 }
@@ -1,9 +1,11 @@
 package db
 
 import (
+	"encoding/binary"
 	"math"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -20,7 +22,7 @@ func TestFileGet(t *testing.T) {
 		entries = append(entries, entry)
 	}
 
-	dataBlocks, indexBlock, bloom, keyRange, err := writeEntries(entries)
+	dataBlocks, indexBlock, bloom, keyRange, err := writeEntries(entries, SnappyCompression)
 	if err != nil {
 		t.Fatalf("Error writing data entries: %v\n", err)
 	}
@@ -33,8 +35,23 @@ func TestFileGet(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Error writing to file: %v\n", err)
 	}
+	kr, _, _, err := recoverFile("data/L0/test.sst")
+	if err != nil {
+		t.Fatalf("Error recovering file: %v\n", err)
+	}
+	if kr.startKey != "1000" || kr.endKey != "9999" || kr.maxTs != 9999 {
+		t.Fatalf("Expected key range 1000-9999 with max ts 9999, Got: %+v\n", kr)
+	}
+	// Key ranges written before the max ts was recorded end after the end key
+	kr, err = parsekeyRangeEntry(sstVersion, keyRangeEntry[:len(keyRangeEntry)-2])
+	if err != nil {
+		t.Fatalf("Error parsing key range: %v\n", err)
+	}
+	if kr.endKey != "9999" || kr.maxTs != 0 {
+		t.Fatalf("Expected key range without max ts, Got: %+v\n", kr)
+	}
 
-	fm := newFileManager()
+	fm := newFileManager(newBlockCache(MB), 10, false)
 	var wg sync.WaitGroup
 	replyChan := make(chan *Entry)
 	errChan := make(chan error)
@@ -88,6 +105,7 @@ func TestFileRange(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Error setting up DB: %v\n", err)
 	}
+	fm := newFileManager(nil, 10, false)
 	entries := []*Entry{}
 	for i := 0; i < 10000; i++ {
 		key := strconv.Itoa(int(math.Pow10(9)) + i)
@@ -95,7 +113,7 @@ func TestFileRange(t *testing.T) {
 		entries = append(entries, entry)
 	}
 
-	dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries)
+	dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries, SnappyCompression)
 	if err != nil {
 		t.Fatalf("Error writing data entries: %v\n", err)
 	}
@@ -124,7 +142,7 @@ func TestFileRange(t *testing.T) {
 	f.Close()
 
 	kr = &keyRange{startKey: strconv.Itoa(int(math.Pow10(9))), endKey: strconv.Itoa(int(math.Pow10(9)) + 1000000)}
-	entries, err = fileRange("data/L0/test.sst", kr, uint64(10001))
+	entries, err = fm.Range("data/L0/test.sst", kr, uint64(10001))
 	if err != nil {
 		t.Fatalf("Error range query on file: %v\n", err)
 	}
@@ -135,3 +153,336 @@ func TestFileRange(t *testing.T) {
 		}
 	}
 }
+
+// encodeLegacyEntry encodes an entry the way SST files and WALs were written before varint lengths
+func encodeLegacyEntry(entry *Entry) []byte {
+	data := uint64ToBytes(entry.ts)
+	data = append(data, uint8(len(entry.Key)))
+	data = append(data, []byte(entry.Key)...)
+	for name, value := range entry.Attributes {
+		data = append(data, uint8(len(name)))
+		data = append(data, []byte(name)...)
+		data = append(data, value.DataType)
+		size := make([]byte, 2)
+		binary.LittleEndian.PutUint16(size, uint16(len(value.Data)))
+		data = append(data, size...)
+		data = append(data, value.Data...)
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(data)))
+	return append(size, data...)
+}
+
+func TestFileLegacyFormat(t *testing.T) {
+	_, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	fm := newFileManager(nil, 10, false)
+
+	dataBlocks := []byte{}
+	indexBlock := []byte{}
+	block := make([]byte, BlockSize)
+	i := 0
+	numBlocks := uint32(0)
+	for key := 1000; key < 3000; key++ {
+		entryBytes := encodeLegacyEntry(simpleEntry(uint64(key), strconv.Itoa(key), strconv.Itoa(key)))
+		if i+len(entryBytes) > BlockSize || key == 2999 {
+			if key == 2999 {
+				i += copy(block[i:], entryBytes)
+			}
+			dataBlocks = append(dataBlocks, block...)
+			lastKey := strconv.Itoa(key - 1)
+			if key == 2999 {
+				lastKey = strconv.Itoa(key)
+			}
+			indexBlock = append(indexBlock, uint8(len(lastKey)))
+			indexBlock = append(indexBlock, []byte(lastKey)...)
+			blockBytes := make([]byte, 4)
+			binary.LittleEndian.PutUint32(blockBytes, numBlocks)
+			indexBlock = append(indexBlock, blockBytes...)
+			numBlocks++
+			block = make([]byte, BlockSize)
+			i = 0
+		}
+		i += copy(block[i:], entryBytes)
+	}
+	bloom := newBloom(2000)
+	for key := 1000; key < 3000; key++ {
+		bloom.Insert(strconv.Itoa(key))
+	}
+	keyRangeEntry := []byte{4}
+	keyRangeEntry = append(keyRangeEntry, []byte("1000")...)
+	keyRangeEntry = append(keyRangeEntry, 4)
+	keyRangeEntry = append(keyRangeEntry, []byte("2999")...)
+
+	header := []byte{}
+	for _, size := range []int{len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry)} {
+		header = append(header, uint64ToBytes(uint64(size))...)
+	}
+	data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+	err = writeNewFile("data/L0/legacy.sst", data)
+	if err != nil {
+		t.Fatalf("Error writing to file: %v\n", err)
+	}
+
+	kr, _, _, err := recoverFile("data/L0/legacy.sst")
+	if err != nil {
+		t.Fatalf("Error recovering file: %v\n", err)
+	}
+	if kr.startKey != "1000" || kr.endKey != "2999" {
+		t.Fatalf("Key range, Expected: [1000, 2999], Got: %v\n", kr)
+	}
+	for key := 1000; key < 3000; key += 7 {
+		entry, err := fm.Find("data/L0/legacy.sst", strconv.Itoa(key), 10000)
+		if err != nil {
+			t.Fatalf("Error finding key %d: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != strconv.Itoa(key) {
+			t.Fatalf("Value expected: %d, got: %v\n", key, string(entry.Attributes["value"].Data))
+		}
+	}
+	entries, err := fm.MMap("data/L0/legacy.sst")
+	if err != nil {
+		t.Fatalf("Error mmaping file: %v\n", err)
+	}
+	if len(entries) != 2000 {
+		t.Fatalf("Expected length of entries: %d, Got %d\n", 2000, len(entries))
+	}
+}
+
+func TestFileLargeEntries(t *testing.T) {
+	_, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	fm := newFileManager(nil, 10, false)
+	entries := []*Entry{}
+	for i := 0; i < 20; i++ {
+		key := strconv.Itoa(10+i) + strings.Repeat("k", 1000*i)
+		value := strings.Repeat(strconv.Itoa(i), 1+(i%4)*50000)
+		entries = append(entries, simpleEntry(uint64(i), key, value))
+	}
+	dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries, SnappyCompression)
+	if err != nil {
+		t.Fatalf("Error writing data entries: %v\n", err)
+	}
+	keyRangeEntry := createkeyRangeEntry(kr)
+	header := createHeader(len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry))
+	data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+	err = writeNewFile("data/L0/large.sst", data)
+	if err != nil {
+		t.Fatalf("Error writing to file: %v\n", err)
+	}
+	for _, expected := range entries {
+		entry, err := fm.Find("data/L0/large.sst", expected.Key, 100)
+		if err != nil {
+			t.Fatalf("Error finding key of length %d: %v\n", len(expected.Key), err)
+		}
+		if string(entry.Attributes["value"].Data) != string(expected.Attributes["value"].Data) {
+			t.Fatalf("Wrong value for key of length %d\n", len(expected.Key))
+		}
+	}
+	result, err := fm.Range("data/L0/large.sst", kr, 100)
+	if err != nil {
+		t.Fatalf("Error range query on file: %v\n", err)
+	}
+	if len(result) != len(entries) {
+		t.Fatalf("Expected length of entries: %d, Got %d\n", len(entries), len(result))
+	}
+}
+
+func TestFileCompression(t *testing.T) {
+	_, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	fm := newFileManager(nil, 10, false)
+	entries := []*Entry{}
+	for i := 1000; i < 5000; i++ {
+		key := strconv.Itoa(i)
+		entries = append(entries, simpleEntry(uint64(i), key, strings.Repeat(key, 10)))
+	}
+
+	sizes := make(map[CompressionType]int)
+	for _, compression := range []CompressionType{NoCompression, SnappyCompression, ZstdCompression} {
+		dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries, compression)
+		if err != nil {
+			t.Fatalf("Error writing data entries: %v\n", err)
+		}
+		sizes[compression] = len(dataBlocks)
+		index, err := decodeIndex(sstVersion, indexBlock, uint64(len(dataBlocks)))
+		if err != nil {
+			t.Fatalf("Error decoding index: %v\n", err)
+		}
+		for _, handle := range index {
+			if CompressionType(dataBlocks[handle.offset]) != compression {
+				t.Fatalf("Block compression, Expected: %d, Got: %d\n", compression, dataBlocks[handle.offset])
+			}
+		}
+
+		keyRangeEntry := createkeyRangeEntry(kr)
+		header := createHeader(len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry))
+		data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+		filename := "data/L0/compressed" + strconv.Itoa(int(compression)) + ".sst"
+		err = writeNewFile(filename, data)
+		if err != nil {
+			t.Fatalf("Error writing to file: %v\n", err)
+		}
+		for i := 1000; i < 5000; i += 13 {
+			key := strconv.Itoa(i)
+			entry, err := fm.Find(filename, key, 10000)
+			if err != nil {
+				t.Fatalf("Error finding key %v: %v\n", key, err)
+			}
+			if string(entry.Attributes["value"].Data) != strings.Repeat(key, 10) {
+				t.Fatalf("Wrong value for key %v\n", key)
+			}
+		}
+		result, err := fm.Range(filename, &keyRange{startKey: "2000", endKey: "2999"}, 10000)
+		if err != nil {
+			t.Fatalf("Error range query on file: %v\n", err)
+		}
+		if len(result) != 1000 {
+			t.Fatalf("Expected length of range: %d, Got %d\n", 1000, len(result))
+		}
+		all, err := fm.MMap(filename)
+		if err != nil {
+			t.Fatalf("Error mmaping file: %v\n", err)
+		}
+		if len(all) != len(entries) {
+			t.Fatalf("Expected length of entries: %d, Got %d\n", len(entries), len(all))
+		}
+	}
+	if sizes[SnappyCompression] >= sizes[NoCompression] || sizes[ZstdCompression] >= sizes[NoCompression] {
+		t.Fatalf("Expected compressed data to be smaller than %d, Got snappy: %d, zstd: %d\n", sizes[NoCompression], sizes[SnappyCompression], sizes[ZstdCompression])
+	}
+}
+
+func TestFileRestartPoints(t *testing.T) {
+	_, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	fm := newFileManager(nil, 10, false)
+	prefix := strings.Repeat("user/profile/", 10)
+	entries := []*Entry{}
+	for i := 1000; i < 3000; i++ {
+		key := prefix + strconv.Itoa(i)
+		// Every key has three versions, sorted from newest to oldest
+		for ts := uint64(30); ts >= 10; ts -= 10 {
+			entries = append(entries, simpleEntry(ts, key, strconv.Itoa(i)+"-"+strconv.Itoa(int(ts))))
+		}
+	}
+	dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries, NoCompression)
+	if err != nil {
+		t.Fatalf("Error writing data entries: %v\n", err)
+	}
+	if len(dataBlocks) >= len(entries)*len(prefix) {
+		t.Fatalf("Expected shared key prefixes to be compressed, Got %d bytes of data\n", len(dataBlocks))
+	}
+	keyRangeEntry := createkeyRangeEntry(kr)
+	header := createHeader(len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry))
+	data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+	err = writeNewFile("data/L0/restart.sst", data)
+	if err != nil {
+		t.Fatalf("Error writing to file: %v\n", err)
+	}
+
+	for i := 1000; i < 3000; i += 7 {
+		key := prefix + strconv.Itoa(i)
+		for _, ts := range []uint64{15, 25, 100} {
+			entry, err := fm.Find("data/L0/restart.sst", key, ts)
+			if err != nil {
+				t.Fatalf("Error finding key %d at ts %d: %v\n", i, ts, err)
+			}
+			expected := strconv.Itoa(i) + "-" + strconv.Itoa(int(ts/10*10))
+			if ts == 100 {
+				expected = strconv.Itoa(i) + "-30"
+			}
+			if string(entry.Attributes["value"].Data) != expected {
+				t.Fatalf("Value expected: %v, Got: %v\n", expected, string(entry.Attributes["value"].Data))
+			}
+		}
+		if _, err := fm.Find("data/L0/restart.sst", key, 10); err == nil {
+			t.Fatalf("Expected no version of key %d older than ts 10\n", i)
+		}
+	}
+	for _, key := range []string{prefix + "0999", prefix + "1000a", prefix + "3000", "a"} {
+		if _, err := fm.Find("data/L0/restart.sst", key, 100); err == nil {
+			t.Fatalf("Expected key %v to not be found\n", key)
+		}
+	}
+	all, err := fm.MMap("data/L0/restart.sst")
+	if err != nil {
+		t.Fatalf("Error mmaping file: %v\n", err)
+	}
+	if len(all) != len(entries) {
+		t.Fatalf("Expected length of entries: %d, Got %d\n", len(entries), len(all))
+	}
+	for i, entry := range all {
+		if entry.Key != entries[i].Key || entry.ts != entries[i].ts {
+			t.Fatalf("Entry %d, Expected: %v@%d, Got: %v@%d\n", i, entries[i].Key, entries[i].ts, entry.Key, entry.ts)
+		}
+	}
+}
+
+func TestFileCompressedVersion(t *testing.T) {
+	_, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	fm := newFileManager(nil, 10, false)
+
+	// Write a file in the format before restart points: whole entries in compressed blocks
+	dataBlocks := []byte{}
+	indexBlock := []byte{}
+	block := []byte{}
+	appendBlock := func(lastKey string) {
+		compressed, err := compressBlock(SnappyCompression, block)
+		if err != nil {
+			t.Fatalf("Error compressing block: %v\n", err)
+		}
+		indexBlock = appendUvarint(indexBlock, uint64(len(lastKey)))
+		indexBlock = append(indexBlock, []byte(lastKey)...)
+		indexBlock = appendUvarint(indexBlock, uint64(len(dataBlocks)))
+		indexBlock = appendUvarint(indexBlock, uint64(len(compressed)))
+		dataBlocks = append(dataBlocks, compressed...)
+		block = []byte{}
+	}
+	bloom := newBloom(2000)
+	for key := 1000; key < 3000; key++ {
+		entryBytes := encodeEntry(simpleEntry(uint64(key), strconv.Itoa(key), strconv.Itoa(key)))
+		if len(block) > 0 && len(block)+len(entryBytes) > BlockSize {
+			appendBlock(strconv.Itoa(key - 1))
+		}
+		block = append(block, entryBytes...)
+		bloom.Insert(strconv.Itoa(key))
+	}
+	appendBlock("2999")
+	keyRangeEntry := createkeyRangeEntry(&keyRange{startKey: "1000", endKey: "2999"})
+	header := createHeader(len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry))
+	binary.LittleEndian.PutUint64(header[8:16], compressedVersion)
+	data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+	err = writeNewFile("data/L0/compressed.sst", data)
+	if err != nil {
+		t.Fatalf("Error writing to file: %v\n", err)
+	}
+
+	for key := 1000; key < 3000; key += 7 {
+		entry, err := fm.Find("data/L0/compressed.sst", strconv.Itoa(key), 10000)
+		if err != nil {
+			t.Fatalf("Error finding key %d: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != strconv.Itoa(key) {
+			t.Fatalf("Value expected: %d, got: %v\n", key, string(entry.Attributes["value"].Data))
+		}
+	}
+	result, err := fm.Range("data/L0/compressed.sst", &keyRange{startKey: "2000", endKey: "2499"}, 10000)
+	if err != nil {
+		t.Fatalf("Error range query on file: %v\n", err)
+	}
+	if len(result) != 500 {
+		t.Fatalf("Expected length of range: %d, Got %d\n", 500, len(result))
+	}
+}
@@ -0,0 +1,364 @@
+package db
+
+import (
+	"math"
+	"strings"
+)
+
+// Keys starting with internalPrefix are reserved for data the DB keeps about itself
+const internalPrefix = "\x00simpledb\x00"
+
+const indexMetaPrefix = internalPrefix + "meta\x00index\x00"
+const indexPrefix = internalPrefix + "index\x00"
+
+// index is a secondary index that maps the values of an attribute to the primary keys of entries containing it
+type index struct {
+	name      string
+	attribute string
+}
+
+// indexReq asks the oracle to catch up a backfilled index with the commits since its snapshot and to write it
+type indexReq struct {
+	index      *index
+	snapshotTs uint64
+	entries    map[string]*Entry
+	replyChan  chan error
+}
+
+func isInternalKey(key string) bool {
+	return strings.HasPrefix(key, internalPrefix)
+}
+
+// prefix returns the start of every key in the index keyspace belonging to this index
+func (idx *index) prefix() string {
+	return indexPrefix + idx.name + "\x00"
+}
+
+// key returns the index key for an entry whose indexed attribute has the given value.
+// The primary key is appended so multiple entries can share the same value
+func (idx *index) key(value *Value, primaryKey string) (string, error) {
+	key := idx.prefix() + string(encodeOrdered(value)) + "\x00" + primaryKey
+	if len(key) > KeySize {
+		return "", newErrExceedMaxKeySize(key)
+	}
+	return key, nil
+}
+
+// entry creates an index entry pointing at the primary key, or a tombstone that removes it. Its ts is set once the
+// oracle assigns the commit ts
+func (idx *index) entry(value *Value, primaryKey string, tombstone bool) (*Entry, error) {
+	key, err := idx.key(value, primaryKey)
+	if err != nil {
+		return nil, err
+	}
+	if tombstone {
+		return &Entry{Key: key, Attributes: nil}, nil
+	}
+	return &Entry{
+		Key: key,
+		Attributes: map[string]*Value{
+			"key":   &Value{DataType: String, Data: []byte(primaryKey)},
+			"value": value,
+		},
+	}, nil
+}
+
+// indexedValue returns the value of an entry's indexed attribute or nil if the entry does not have one
+func (idx *index) indexedValue(entry *Entry) *Value {
+	if entry == nil || entry.Attributes == nil {
+		return nil
+	}
+	value, ok := entry.Attributes[idx.attribute]
+	if !ok || value == nil || value.DataType == Tombstone {
+		return nil
+	}
+	return value
+}
+
+// CreateIndex creates a secondary index on an attribute and backfills it with all existing entries
+func (db *DB) CreateIndex(name, attribute string) error {
+	if name == "" || strings.Contains(name, "\x00") || attribute == "" {
+		return newErrInvalidIndex(name)
+	}
+	db.indexLock.RLock()
+	_, ok := db.indexes[name]
+	db.indexLock.RUnlock()
+	if ok {
+		return newErrIndexAlreadyExists(name)
+	}
+	idx := &index{name: name, attribute: attribute}
+	// The txn pins the snapshot, so compactions keep the versions the backfill reads while commits go on
+	return db.ViewTxn(func(txn *Txn) error {
+		entries, err := db.backfillIndex(idx, txn.startTs)
+		if err != nil {
+			return err
+		}
+		return db.oracle.createIndex(idx, txn.startTs, entries)
+	})
+}
+
+// backfillIndex returns the index entries for every entry in the DB as of the ts, mapped by their primary key
+func (db *DB) backfillIndex(idx *index, ts uint64) (map[string]*Entry, error) {
+	all, err := db.scan(prefixRange(""), ts)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*Entry)
+	for _, entry := range all {
+		if isInternalKey(entry.Key) {
+			continue
+		}
+		value := idx.indexedValue(entry)
+		if value == nil {
+			continue
+		}
+		indexEntry, err := idx.entry(value, entry.Key, false)
+		if err != nil {
+			return nil, err
+		}
+		entries[entry.Key] = indexEntry
+	}
+	return entries, nil
+}
+
+// catchUpIndex updates the backfilled index entries of the keys committed after the snapshot they were read at.
+// It must only be called by the oracle so the values read are the latest committed ones
+func (db *DB) catchUpIndex(idx *index, entries map[string]*Entry, keys []string) error {
+	for _, key := range keys {
+		if isInternalKey(key) {
+			continue
+		}
+		entry, err := db.read(key, math.MaxUint64)
+		if err != nil {
+			if _, ok := err.(*ErrKeyNotFound); !ok {
+				return err
+			}
+			entry = nil
+		}
+		value := idx.indexedValue(entry)
+		if value == nil {
+			delete(entries, key)
+			continue
+		}
+		indexEntry, err := idx.entry(value, key, false)
+		if err != nil {
+			return err
+		}
+		entries[key] = indexEntry
+	}
+	return nil
+}
+
+// writeIndex writes the index entries along with the index definition at the ts and adds the index, so commits
+// afterwards keep it consistent. It must only be called by the oracle so no commit is left out
+func (db *DB) writeIndex(idx *index, entries map[string]*Entry, ts uint64) error {
+	db.indexLock.RLock()
+	_, ok := db.indexes[idx.name]
+	db.indexLock.RUnlock()
+	if ok {
+		return newErrIndexAlreadyExists(idx.name)
+	}
+	writes := []*Entry{
+		&Entry{
+			ts:         ts,
+			Key:        indexMetaPrefix + idx.name,
+			Attributes: map[string]*Value{"attribute": &Value{DataType: String, Data: []byte(idx.attribute)}},
+		},
+	}
+	for _, entry := range entries {
+		entry.ts = ts
+		writes = append(writes, entry)
+	}
+	err := db.write(writes)
+	if err != nil {
+		return err
+	}
+	db.indexLock.Lock()
+	db.indexes[idx.name] = idx
+	db.indexLock.Unlock()
+	return nil
+}
+
+// indexEntries creates the index entries that keep every index consistent with a txn's write set.
+// It must only be called by the oracle so the previous values read are the latest committed ones
+func (db *DB) indexEntries(writeSet map[string]*Entry) (entries []*Entry, err error) {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+
+	if len(db.indexes) == 0 {
+		return nil, nil
+	}
+	for key, entry := range writeSet {
+		if isInternalKey(key) {
+			continue
+		}
+		old, err := db.read(key, math.MaxUint64)
+		if err != nil {
+			if _, ok := err.(*ErrKeyNotFound); !ok {
+				return nil, err
+			}
+			old = nil
+		}
+		for _, idx := range db.indexes {
+			oldValue := idx.indexedValue(old)
+			newValue := idx.indexedValue(entry)
+			if oldValue != nil && newValue != nil && compareValues(oldValue, newValue) == 0 {
+				continue
+			}
+			if oldValue != nil {
+				indexEntry, err := idx.entry(oldValue, key, true)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, indexEntry)
+			}
+			if newValue != nil {
+				indexEntry, err := idx.entry(newValue, key, false)
+				if err != nil {
+					return nil, err
+				}
+				entries = append(entries, indexEntry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// loadIndexes reads all index definitions stored in the DB
+func (db *DB) loadIndexes() error {
+	entries, err := db.scan(prefixRange(indexMetaPrefix), math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	db.indexLock.Lock()
+	defer db.indexLock.Unlock()
+	for _, entry := range entries {
+		if entry.Attributes == nil {
+			continue
+		}
+		attribute, ok := entry.Attributes["attribute"]
+		if !ok {
+			continue
+		}
+		name := strings.TrimPrefix(entry.Key, indexMetaPrefix)
+		db.indexes[name] = &index{name: name, attribute: string(attribute.Data)}
+	}
+	return nil
+}
+
+func (db *DB) getIndex(name string) (*index, error) {
+	db.indexLock.RLock()
+	defer db.indexLock.RUnlock()
+	idx, ok := db.indexes[name]
+	if !ok {
+		return nil, newErrIndexNotFound(name)
+	}
+	return idx, nil
+}
+
+// QueryIndex returns all entries whose indexed attribute is equal to value
+func (txn *Txn) QueryIndex(name string, value *Value) ([]*Entry, error) {
+	return txn.QueryIndexRange(name, value, value)
+}
+
+// QueryIndexRange returns all entries whose indexed attribute falls within the inclusive range of values.
+// Results are ordered by the indexed value
+func (txn *Txn) QueryIndexRange(name string, start, end *Value) ([]*Entry, error) {
+	idx, err := txn.db.getIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	if compareValues(start, end) > 0 {
+		return nil, newErrInvalidRange()
+	}
+	startKey := idx.prefix() + string(encodeOrdered(start))
+	// Every key with the end value is followed by the separator "\x00", so "\x01" bounds all of them
+	endKey := idx.prefix() + string(encodeOrdered(end)) + "\x01"
+	indexEntries, err := txn.db.scan(&keyRange{startKey: startKey, endKey: endKey}, txn.startTs)
+	if err != nil {
+		return nil, err
+	}
+	result := []*Entry{}
+	for _, indexEntry := range indexEntries {
+		if indexEntry.Attributes == nil {
+			continue
+		}
+		value, ok := indexEntry.Attributes["value"]
+		if !ok || compareValues(value, start) < 0 || compareValues(value, end) > 0 {
+			continue
+		}
+		primaryKey, ok := indexEntry.Attributes["key"]
+		if !ok {
+			return nil, newErrIndexInconsistent(name, indexEntry.Key)
+		}
+		entry, err := txn.Read(string(primaryKey.Data))
+		if err != nil {
+			if _, ok := err.(*ErrKeyNotFound); ok {
+				return nil, newErrIndexInconsistent(name, string(primaryKey.Data))
+			}
+			return nil, err
+		}
+		if current := idx.indexedValue(entry); current == nil || compareValues(current, value) != 0 {
+			return nil, newErrIndexInconsistent(name, entry.Key)
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// VerifyIndex checks that an index contains exactly one entry for every entry with the indexed attribute
+// and nothing else. It returns ErrIndexInconsistent for the first mismatch found
+func (db *DB) VerifyIndex(name string) error {
+	idx, err := db.getIndex(name)
+	if err != nil {
+		return err
+	}
+	return db.ViewTxn(func(txn *Txn) error {
+		all, err := db.scan(prefixRange(""), txn.startTs)
+		if err != nil {
+			return err
+		}
+		expected := make(map[string]struct{})
+		actual := make(map[string]struct{})
+		for _, entry := range all {
+			if entry.Attributes == nil {
+				continue
+			}
+			if strings.HasPrefix(entry.Key, idx.prefix()) {
+				primaryKey, ok := entry.Attributes["key"]
+				if !ok {
+					return newErrIndexInconsistent(name, entry.Key)
+				}
+				actual[entry.Key] = struct{}{}
+				primary, err := db.read(string(primaryKey.Data), txn.startTs)
+				if err != nil {
+					return newErrIndexInconsistent(name, string(primaryKey.Data))
+				}
+				value := idx.indexedValue(primary)
+				if value == nil {
+					return newErrIndexInconsistent(name, primary.Key)
+				}
+				if key, err := idx.key(value, primary.Key); err != nil || key != entry.Key {
+					return newErrIndexInconsistent(name, primary.Key)
+				}
+				continue
+			}
+			if isInternalKey(entry.Key) {
+				continue
+			}
+			if value := idx.indexedValue(entry); value != nil {
+				key, err := idx.key(value, entry.Key)
+				if err != nil {
+					return err
+				}
+				expected[key] = struct{}{}
+			}
+		}
+		for key := range expected {
+			if _, ok := actual[key]; !ok {
+				return newErrIndexInconsistent(name, key)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestIndexQuery(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		city, _ := CreateValue("city" + strconv.Itoa(i%5))
+		err := db.Insert(strconv.Itoa(i), map[string]*Value{"city": city})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+
+	err = db.CreateIndex("byCity", "city")
+	if err != nil {
+		t.Fatalf("Error creating index: %v\n", err)
+	}
+	if _, ok := db.CreateIndex("byCity", "city").(*ErrIndexAlreadyExists); !ok {
+		t.Fatalf("Expected: ErrIndexAlreadyExists\n")
+	}
+
+	city, _ := CreateValue("city0")
+	err = db.ViewTxn(func(txn *Txn) error {
+		entries, err := txn.QueryIndex("byCity", city)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 20 {
+			t.Fatalf("Index query length, Expected: 20, Got: %d\n", len(entries))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error querying index: %v\n", err)
+	}
+
+	// Move one entry to another city and delete another
+	newCity, _ := CreateValue("city1")
+	err = db.Update("0", map[string]*Value{"city": newCity})
+	if err != nil {
+		t.Fatalf("Error updating db: %v\n", err)
+	}
+	err = db.Delete("5")
+	if err != nil {
+		t.Fatalf("Error deleting from db: %v\n", err)
+	}
+
+	err = db.ViewTxn(func(txn *Txn) error {
+		entries, err := txn.QueryIndex("byCity", city)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 18 {
+			t.Fatalf("Index query length, Expected: 18, Got: %d\n", len(entries))
+		}
+		entries, err = txn.QueryIndex("byCity", newCity)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 21 {
+			t.Fatalf("Index query length, Expected: 21, Got: %d\n", len(entries))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error querying index: %v\n", err)
+	}
+
+	err = db.VerifyIndex("byCity")
+	if err != nil {
+		t.Fatalf("Error verifying index: %v\n", err)
+	}
+
+	entries, err := db.Scan("", []string{"city"})
+	if err != nil {
+		t.Fatalf("Error scanning db: %v\n", err)
+	}
+	for _, entry := range entries {
+		if isInternalKey(entry.Key) {
+			t.Fatalf("Scan returned internal key: %q\n", entry.Key)
+		}
+	}
+}
+
+func TestIndexRange(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	err = db.CreateIndex("byAge", "age")
+	if err != nil {
+		t.Fatalf("Error creating index: %v\n", err)
+	}
+
+	for i := -50; i < 50; i++ {
+		age, _ := CreateValue(int64(i))
+		err := db.Insert(strconv.Itoa(i), map[string]*Value{"age": age})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+
+	start, _ := CreateValue(int64(-10))
+	end, _ := CreateValue(int64(10))
+	err = db.ViewTxn(func(txn *Txn) error {
+		entries, err := txn.QueryIndexRange("byAge", start, end)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 21 {
+			t.Fatalf("Index range length, Expected: 21, Got: %d\n", len(entries))
+		}
+		for i, entry := range entries {
+			age, err := ParseValue(entry.Attributes["age"])
+			if err != nil {
+				return err
+			}
+			if age.(int64) != int64(i-10) {
+				t.Fatalf("Index range order, Expected: %d, Got: %d\n", i-10, age.(int64))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error querying index: %v\n", err)
+	}
+
+	db.Close()
+
+	db, err = NewDB("data")
+	if err != nil {
+		t.Fatalf("Error creating DB: %v\n", err)
+	}
+	err = db.VerifyIndex("byAge")
+	if err != nil {
+		t.Fatalf("Error verifying index after recovery: %v\n", err)
+	}
+}
+
+func TestIndexReservedKey(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	err = db.UpdateTxn(func(txn *Txn) error {
+		txn.Write(indexPrefix+"test", map[string]*Value{})
+		return nil
+	})
+	if _, ok := err.(*ErrReservedKey); !ok {
+		t.Fatalf("Expected: ErrReservedKey, Got: %v\n", err)
+	}
+}
+
+func TestIndexCatchUp(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		city, _ := CreateValue("city" + strconv.Itoa(i%5))
+		err := db.Insert(strconv.Itoa(i), map[string]*Value{"city": city})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+
+	// Commit changes between the backfill and the oracle writing the index
+	idx := &index{name: "byCity", attribute: "city"}
+	txn := db.StartTxn()
+	defer txn.Discard()
+	entries, err := db.backfillIndex(idx, txn.startTs)
+	if err != nil {
+		t.Fatalf("Error backfilling index: %v\n", err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("Backfilled entries, Expected: 100, Got: %d\n", len(entries))
+	}
+	city, _ := CreateValue("city0")
+	newCity, _ := CreateValue("city1")
+	err = db.Update("0", map[string]*Value{"city": newCity})
+	if err != nil {
+		t.Fatalf("Error updating db: %v\n", err)
+	}
+	err = db.Delete("5")
+	if err != nil {
+		t.Fatalf("Error deleting from db: %v\n", err)
+	}
+	err = db.Insert("100", map[string]*Value{"city": city})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+	err = db.oracle.createIndex(idx, txn.startTs, entries)
+	if err != nil {
+		t.Fatalf("Error creating index: %v\n", err)
+	}
+
+	err = db.ViewTxn(func(txn *Txn) error {
+		entries, err := txn.QueryIndex("byCity", city)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 19 {
+			t.Fatalf("Index query length, Expected: 19, Got: %d\n", len(entries))
+		}
+		entries, err = txn.QueryIndex("byCity", newCity)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 21 {
+			t.Fatalf("Index query length, Expected: 21, Got: %d\n", len(entries))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error querying index: %v\n", err)
+	}
+	err = db.VerifyIndex("byCity")
+	if err != nil {
+		t.Fatalf("Error verifying index: %v\n", err)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/google/uuid"
 )
@@ -18,16 +17,33 @@ import (
 type keyRange struct {
 	startKey string
 	endKey   string
+	// prefixEnd extends the range to every key starting with endKey, so a range with an empty endKey has no end
+	prefixEnd bool
+	// maxTs is the newest ts of the entries of the SST file with this key range, 0 if the file does not record it
+	maxTs uint64
 }
 
-type merge struct {
-	files    []string
-	keyRange *keyRange
+// prefixRange returns the range of every key starting with prefix. prefixRange("") covers all keys
+func prefixRange(prefix string) *keyRange {
+	return &keyRange{startKey: prefix, endKey: prefix, prefixEnd: true}
+}
+
+// afterEnd returns whether key sorts after every key in the range
+func (kr *keyRange) afterEnd(key string) bool {
+	if kr.prefixEnd && strings.HasPrefix(key, kr.endKey) {
+		return false
+	}
+	return key > kr.endKey
 }
 
-type compactReply struct {
-	files []string
-	err   error
+// contains returns whether key is within the range
+func (kr *keyRange) contains(key string) bool {
+	return kr.startKey <= key && !kr.afterEnd(key)
+}
+
+// overlaps returns whether any key between startKey and endKey is within the range
+func (kr *keyRange) overlaps(startKey, endKey string) bool {
+	return kr.startKey <= endKey && !kr.afterEnd(startKey)
 }
 
 // level represents struct for level in lsm tree
@@ -37,39 +53,40 @@ type level struct {
 	size      int
 	directory string
 
-	merging   map[string]struct{}
-	mergeLock sync.RWMutex
-
 	manifest     map[string]*keyRange
 	manifestSync map[string]*keyRange
+	sizes        map[string]int
 	manifestLock sync.RWMutex
 
 	blooms    map[string]*bloom
 	bloomLock sync.RWMutex
 
-	compactReqChan   chan []*merge
-	compactReplyChan chan []string
+	// cursor is the end key of the file last compacted from this level. It is only used by the compactor
+	cursor string
 
 	above *level
 	below *level
 
-	fm *fileManager
-
-	close chan struct{}
+	fm   *fileManager
+	opts *Options
+	// readOnly is set if the level belongs to a read only DB, which never changes the directory
+	readOnly bool
 }
 
-// newLevel creates a new level in the lsm tree
-func newLevel(numLevel int, directory string, fm *fileManager) (*level, error) {
-	err := os.MkdirAll(filepath.Join(directory, "L"+strconv.Itoa(numLevel)), dirPerm)
-	if err != nil {
-		return nil, err
+// newLevel creates a new level in the lsm tree. A read only level is left empty for catchUp to fill
+func newLevel(numLevel int, directory string, fm *fileManager, opts *Options, readOnly bool) (*level, error) {
+	if !readOnly {
+		err := os.MkdirAll(filepath.Join(directory, "L"+strconv.Itoa(numLevel)), dirPerm)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	capacity := 0
 	if numLevel == 0 {
 		capacity = 2 * MemTableSize
 	} else {
-		capacity = int(math.Pow10(numLevel)) * multiplier
+		capacity = opts.BaseLevelSize * int(math.Pow(float64(opts.LevelSizeMultiplier), float64(numLevel-1)))
 	}
 
 	lvl := &level{
@@ -78,26 +95,24 @@ func newLevel(numLevel int, directory string, fm *fileManager) (*level, error) {
 		size:      0,
 		directory: filepath.Join(directory, "L"+strconv.Itoa(numLevel)),
 
-		merging: make(map[string]struct{}),
-
 		manifest:     make(map[string]*keyRange),
 		manifestSync: make(map[string]*keyRange),
+		sizes:        make(map[string]int),
 
 		blooms: make(map[string]*bloom),
 
-		compactReqChan:   make(chan []*merge, 16),
-		compactReplyChan: make(chan []string, 16),
-
 		above: nil,
 		below: nil,
 
-		fm: fm,
-
-		close: make(chan struct{}),
+		fm:       fm,
+		opts:     opts,
+		readOnly: readOnly,
 	}
-	go lvl.run()
 
-	err = lvl.Recoverlevel()
+	if readOnly {
+		return lvl, nil
+	}
+	err := lvl.Recoverlevel()
 	if err != nil {
 		return nil, err
 	}
@@ -110,48 +125,53 @@ func (level *level) Find(key string, ts uint64) (*Entry, error) {
 	if len(filenames) == 0 {
 		return nil, newErrKeyNotFound()
 	}
-	if len(filenames) == 1 {
-		return level.fm.Find(filenames[0], key, ts)
-	}
 
-	replyChan := make(chan *Entry)
-	errChan := make(chan error)
 	replies := []*Entry{}
-
-	var wg sync.WaitGroup
 	var errs []error
 
-	wg.Add(len(filenames))
-	for _, filename := range filenames {
-		go func(filename string) {
-			entry, err := level.fm.Find(filename, key, ts)
-			if err != nil {
-				errChan <- err
-			} else {
-				replyChan <- entry
-			}
-		}(filename)
-	}
+	// A single file, as on every level below L0, is read without a goroutine. Its errors still go through the
+	// handling below, as a compaction can remove the file in the meantime.
+	if len(filenames) == 1 {
+		entry, err := level.fm.Find(filenames[0], key, ts)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			replies = append(replies, entry)
+		}
+	} else {
+		replyChan := make(chan *Entry)
+		errChan := make(chan error)
+
+		for _, filename := range filenames {
+			go func(filename string) {
+				entry, err := level.fm.Find(filename, key, ts)
+				if err != nil {
+					errChan <- err
+				} else {
+					replyChan <- entry
+				}
+			}(filename)
+		}
 
-	go func() {
-		for {
+		for range filenames {
 			select {
 			case reply := <-replyChan:
 				replies = append(replies, reply)
-				wg.Done()
 			case err := <-errChan:
 				errs = append(errs, err)
-				wg.Done()
 			}
 		}
-	}()
-	wg.Wait()
+	}
 
 	for _, err := range errs {
 		switch err.(type) {
 		case *ErrKeyNotFound:
 			continue
 		case *os.PathError:
+			// A read only DB cannot tell where the primary moved the entries of a removed file until it catches up
+			if level.readOnly {
+				return nil, err
+			}
 			// If encounter race condition of non existent file, make sure to delete it from manifest
 			fmt.Println(key, err)
 			filename := strings.Fields(err.Error())[1]
@@ -193,65 +213,103 @@ func (level *level) getUniqueID() string {
 	return level.getUniqueID()
 }
 
-// Merge takes an empty or existing file at the current level and merges it with file(s) from the level above
-func (level *level) Merge(files []string) ([]string, error) {
-	if len(files) == 1 {
-		file := files[0]
-		info, err := os.Stat(file)
-		if err != nil {
-			return nil, err
-		}
-		size := int(info.Size())
-		fileArr := strings.Split(file, "/")
-		oldFileID := strings.Split(fileArr[len(fileArr)-1], ".")[0]
-		newFileID := level.getUniqueID()
-
-		// Get key range and bloom filter
-		level.above.manifestLock.RLock()
-		level.above.bloomLock.RLock()
-		keyRange := level.above.manifest[oldFileID]
-		bloom := level.above.blooms[oldFileID]
-		level.above.manifestLock.RUnlock()
-		level.above.bloomLock.RUnlock()
-
-		level.NewSSTFile(newFileID, keyRange, bloom)
-		level.size += size
-		err = os.Rename(file, filepath.Join(level.directory, newFileID+".sst"))
+// sstFile is an SST file written by a compaction before it is added to the manifest of its level
+type sstFile struct {
+	fileID   string
+	filename string
+	keyRange *keyRange
+	bloom    *bloom
+	size     int
+}
+
+// compact streams the entries of the files through a k-way merge into new SST files at the level. A new file is
+// started once the current one reaches targetFileSize, but all versions of a key stay in the same file.
+// The new files are not added to the manifest. If compaction fails, the files it already wrote are deleted.
+// Of the versions of a key older than the watermark, only the newest is kept, and not even that if it is a tombstone,
+// so the watermark must only be set when no older version of the key is left in another file. 0 keeps every version
+func (level *level) compact(files []string, targetFileSize int, watermark uint64) ([]*sstFile, error) {
+	iters := []*tableIterator{}
+	for _, file := range files {
+		it, err := level.fm.Iterator(file)
 		if err != nil {
-			level.manifestLock.Lock()
-			delete(level.manifest, newFileID)
-			level.manifestLock.Unlock()
-			level.size -= size
+			for _, it := range iters {
+				it.close()
+			}
 			return nil, err
 		}
-		// Delete old key range and bloom filter
-		level.above.manifestLock.Lock()
-		level.above.mergeLock.Lock()
-		level.above.bloomLock.Lock()
-		delete(level.above.manifest, oldFileID)
-		delete(level.above.blooms, oldFileID)
-		delete(level.above.merging, oldFileID)
-		level.above.manifestLock.Unlock()
-		level.above.mergeLock.Unlock()
-		level.above.bloomLock.Unlock()
-		return nil, nil
+		iters = append(iters, it)
 	}
-
-	entries, err := level.mergeSort(files)
+	merged, err := newMergeIterator(iters)
 	if err != nil {
 		return nil, err
 	}
-	err = level.writeMerge(entries)
+	defer merged.close()
+
+	written := []*sstFile{}
+	err = func() error {
+		builder := newSSTBuilder(level.opts.Compression)
+		// visible is set once a version of the current key older than the watermark is seen. Every txn reads
+		// that version or a newer one, so older versions are dropped, and so is that version if it is a tombstone
+		var last *Entry
+		visible := false
+		for {
+			entry, err := merged.next()
+			if err != nil {
+				return err
+			}
+			if entry == nil {
+				break
+			}
+			if last == nil || entry.Key != last.Key {
+				visible = false
+			}
+			last = entry
+			if entry.ts < watermark {
+				if visible {
+					continue
+				}
+				visible = true
+				if entry.Attributes == nil {
+					continue
+				}
+			}
+			if targetFileSize > 0 && !builder.empty() && builder.size() >= targetFileSize && entry.Key != builder.lastKey() {
+				file, err := level.writeMerge(builder)
+				if err != nil {
+					return err
+				}
+				written = append(written, file)
+				builder = newSSTBuilder(level.opts.Compression)
+			}
+			err = builder.add(entry)
+			if err != nil {
+				return err
+			}
+		}
+		if builder.empty() {
+			return nil
+		}
+		file, err := level.writeMerge(builder)
+		if err != nil {
+			return err
+		}
+		written = append(written, file)
+		return nil
+	}()
 	if err != nil {
+		for _, file := range written {
+			os.Remove(file.filename)
+		}
 		return nil, err
 	}
-	return files, nil
+	return written, nil
 }
 
-func (level *level) writeMerge(entries []*Entry) error {
-	dataBlocks, indexBlock, bloom, keyRange, err := writeEntries(entries)
+// writeMerge writes the SST file built by a compaction to the level's directory
+func (level *level) writeMerge(builder *sstBuilder) (*sstFile, error) {
+	dataBlocks, indexBlock, bloom, keyRange, err := builder.finish()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	keyRangeEntry := createkeyRangeEntry(keyRange)
@@ -261,26 +319,27 @@ func (level *level) writeMerge(entries []*Entry) error {
 	fileID := level.getUniqueID()
 	filename := filepath.Join(level.directory, fileID+".sst")
 
-	err = level.fm.Write(filename, data)
+	err = level.fm.WriteRateLimited(filename, data, compactionPriority)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	level.NewSSTFile(fileID, keyRange, bloom)
-	level.size += len(data)
-
-	return nil
+	return &sstFile{
+		fileID:   fileID,
+		filename: filename,
+		keyRange: keyRange,
+		bloom:    bloom,
+		size:     len(data),
+	}, nil
 }
 
 // Range gets all files at a specific level whose key range fall within the given range query.
 // It then concurrently reads all files and returns the result to the given channel
 func (level *level) Range(keyRange *keyRange, ts uint64) (entries []*Entry, err error) {
-	filenames := level.RangeSSTFiles(keyRange.startKey, keyRange.endKey)
+	filenames := level.RangeSSTFiles(keyRange)
 	replyChan := make(chan []*Entry)
 	errChan := make(chan error)
 	errs := make(map[string]int)
-	var wg sync.WaitGroup
 
-	wg.Add(len(filenames))
 	for _, filename := range filenames {
 		go func(filename string) {
 			entries, err := level.fm.Range(filename, keyRange, ts)
@@ -292,25 +351,27 @@ func (level *level) Range(keyRange *keyRange, ts uint64) (entries []*Entry, err
 		}(filename)
 	}
 
-	go func() {
-		for {
-			select {
-			case reply := <-replyChan:
-				entries = append(entries, reply...)
-				wg.Done()
-			case err := <-errChan:
-				if _, ok := errs[err.Error()]; !ok {
-					errs[err.Error()] = 1
-				} else {
-					errs[err.Error()]++
-				}
-				wg.Done()
+	var missing error
+	for range filenames {
+		select {
+		case reply := <-replyChan:
+			entries = append(entries, reply...)
+		case err := <-errChan:
+			if os.IsNotExist(err) {
+				missing = err
+			}
+			if _, ok := errs[err.Error()]; !ok {
+				errs[err.Error()] = 1
+			} else {
+				errs[err.Error()]++
 			}
 		}
-	}()
-
-	wg.Wait()
+	}
 
+	// A file removed by compaction after it was looked up is reported as is so the scan can be retried
+	if missing != nil {
+		return nil, missing
+	}
 	if len(errs) > 0 {
 		return entries, fmt.Errorf("Errors during range query on level %d: %v", level.level, errs)
 	}
@@ -338,8 +399,7 @@ func (level *level) Recoverlevel() error {
 		if err != nil {
 			return err
 		}
-		level.NewSSTFile(fileID, keyRange, bloom)
-		level.size += size
+		level.NewSSTFile(fileID, keyRange, bloom, size)
 	}
 
 	return nil
@@ -363,74 +423,3 @@ func (level *level) RecoverTS() (uint64, error) {
 	}
 	return maxCommitTs, nil
 }
-
-// Close closes all level's operations including merging, compacting, and adding SST files.
-func (level *level) Close() {
-	level.close <- struct{}{}
-}
-
-func (level *level) run() {
-	exceedCapacity := time.NewTicker(1 * time.Second)
-
-	for {
-		select {
-		case compact := <-level.compactReqChan:
-			var merged bool
-			level.manifestLock.RLock()
-			level.mergeLock.Lock()
-			for fileID, keyRange := range level.manifest {
-				if _, ok := level.merging[fileID]; !ok {
-					merge := &merge{
-						files:    []string{filepath.Join(level.directory, fileID+".sst")},
-						keyRange: keyRange,
-					}
-					merged, compact = mergeInterval(compact, merge)
-					if merged {
-						level.merging[fileID] = struct{}{}
-					}
-				}
-			}
-			level.manifestLock.RUnlock()
-			level.mergeLock.Unlock()
-
-			var wg sync.WaitGroup
-
-			for _, merge := range compact {
-				wg.Add(1)
-				go func(files []string) {
-					defer wg.Done()
-					removeFiles, err := level.Merge(files)
-					if err != nil {
-						fmt.Println(err)
-					} else {
-						aboveFiles := []string{}
-						belowFiles := []string{}
-						for _, file := range removeFiles {
-							if strings.Contains(file, "L"+strconv.Itoa(level.level)) {
-								belowFiles = append(belowFiles, file)
-							} else {
-								aboveFiles = append(aboveFiles, file)
-							}
-						}
-						level.above.compactReplyChan <- aboveFiles
-						level.compactReplyChan <- belowFiles
-					}
-				}(merge.files)
-			}
-			wg.Wait()
-		case files := <-level.compactReplyChan:
-			err := level.DeleteSSTFiles(files)
-			if err != nil {
-				fmt.Println(err)
-			}
-		case <-exceedCapacity.C:
-			if level.size > level.capacity && level.below != nil {
-				level.size = 0
-				compact := level.mergeManifest()
-				level.below.compactReqChan <- compact
-			}
-		case <-level.close:
-			return
-		}
-	}
-}
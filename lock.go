@@ -0,0 +1,42 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// dirLock is the exclusive lock a DB holds on its data directory while it is open, so that no other process or
+// DB in the same process writes to it at the same time
+type dirLock struct {
+	f *os.File
+}
+
+// lockDirectory takes the lock on the LOCK file of the directory. It returns ErrDirectoryLocked if another DB holds it
+func lockDirectory(directory string) (*dirLock, error) {
+	f, err := os.OpenFile(filepath.Join(directory, lockFileName), os.O_CREATE|os.O_RDWR, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		if err == errLocked {
+			return nil, newErrDirectoryLocked(directory)
+		}
+		return nil, err
+	}
+	return &dirLock{f: f}, nil
+}
+
+// unlock releases the lock. The LOCK file is kept for the next open
+func (lock *dirLock) unlock() error {
+	if lock.f == nil {
+		return nil
+	}
+	err := unlockFile(lock.f)
+	if closeErr := lock.f.Close(); err == nil {
+		err = closeErr
+	}
+	lock.f = nil
+	return err
+}
@@ -0,0 +1,47 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// flockSupported reports whether the directory lock also keeps out other processes on this platform
+const flockSupported = false
+
+var errLocked = errors.New("file is locked")
+
+// lockedFiles are the LOCK files held by DBs of this process. Without flock, other processes are not kept out
+var (
+	lockedFiles     = make(map[string]struct{})
+	lockedFilesLock sync.Mutex
+)
+
+func lockFile(f *os.File) error {
+	name, err := filepath.Abs(f.Name())
+	if err != nil {
+		return err
+	}
+	lockedFilesLock.Lock()
+	defer lockedFilesLock.Unlock()
+	if _, ok := lockedFiles[name]; ok {
+		return errLocked
+	}
+	lockedFiles[name] = struct{}{}
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	name, err := filepath.Abs(f.Name())
+	if err != nil {
+		return err
+	}
+	lockedFilesLock.Lock()
+	defer lockedFilesLock.Unlock()
+	delete(lockedFiles, name)
+	return nil
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestDirectoryLock(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	_, err = NewDB("data")
+	if _, ok := err.(*ErrDirectoryLocked); !ok {
+		t.Fatalf("Expected second open in the same process to return ErrDirectoryLocked, Got: %v\n", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Error closing db: %v\n", err)
+	}
+	db, err = NewDB("data")
+	if err != nil {
+		t.Fatalf("Error opening DB after close: %v\n", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Error closing db: %v\n", err)
+	}
+}
+
+// TestDirectoryLockProcess opens the DB in another process while this process holds it
+func TestDirectoryLockProcess(t *testing.T) {
+	if os.Getenv("SIMPLEDB_LOCK_HELPER") == "1" {
+		_, err := NewDB("data")
+		if _, ok := err.(*ErrDirectoryLocked); !ok {
+			t.Fatalf("Expected open in another process to return ErrDirectoryLocked, Got: %v\n", err)
+		}
+		return
+	}
+	if !flockSupported {
+		t.Skip("Directory lock does not keep out other processes on this platform")
+	}
+
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDirectoryLockProcess$")
+	cmd.Env = append(os.Environ(), "SIMPLEDB_LOCK_HELPER=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Error in helper process: %v\n%s\n", err, out)
+	}
+}
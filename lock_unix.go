@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package db
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flockSupported reports whether the directory lock also keeps out other processes on this platform
+const flockSupported = true
+
+var errLocked = errors.New("file is locked")
+
+// lockFile takes an exclusive flock on the file without waiting for it. flock locks belong to the open file, so
+// a second open of the same directory fails in the same process too
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
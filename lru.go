@@ -89,6 +89,16 @@ func (lru *lru) Insert(key string, ts uint64) {
 	lru.size++
 }
 
+// Since returns the keys inserted with a ts after the given one. Keys are inserted in ts order, so they are the
+// most recently used ones
+func (lru *lru) Since(ts uint64) []string {
+	keys := []string{}
+	for node := lru.list.tail.prev; node != lru.list.head && node.ts > ts; node = node.prev {
+		keys = append(keys, node.key)
+	}
+	return keys
+}
+
 func (lru *lru) Get(key string) (uint64, bool) {
 	if node, ok := lru.lookup[key]; ok {
 		return node.ts, true
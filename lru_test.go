@@ -36,4 +36,8 @@ func TestLRU(t *testing.T) {
 	if ts != 7 {
 		t.Fatalf("lru expected ts: 7, Got: %v\n", ts)
 	}
+
+	if keys := strings.Join(lru.Since(6), ","); keys != "6,2" {
+		t.Fatalf("lru expected keys since 6: %v, Got: %v\n", "6,2", keys)
+	}
 }
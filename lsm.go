@@ -2,22 +2,41 @@ package db
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
-	"sync"
 )
 
 // LSM is struct for all levels in an LSM
 type lsm struct {
+	// watermark is the start ts of the oldest active txn, published by the oracle. It is first so it is 64 bit
+	// aligned for atomic operations. Compactions into the bottommost level drop versions that no txn starting
+	// at or after it can read. 0 keeps every version
+	watermark uint64
+
 	levels []*level
 	fm     *fileManager
+	opts   *Options
+	// readOnly is set if the LSM belongs to a read only DB. Its levels only change when it catches up
+	readOnly bool
+
+	bgErr *backgroundError
+	// compactErrors is the amount of compactions in a row that failed. It is only used by the compactor
+	compactErrors int
+
+	strategy      CompactionStrategy
+	compactChan   chan struct{}
+	manualChan    chan *manualCompaction
+	compactorDone chan struct{}
+	close         chan struct{}
 }
 
-// newLSM instatiates all levels for a new LSM tree
-func newLSM(directory string) (*lsm, error) {
-	fm := newFileManager()
+// newLSM instatiates all levels for a new LSM tree. A read only LSM never compacts and its levels are filled by catchUp
+func newLSM(directory string, opts *Options, readOnly bool) (*lsm, error) {
+	fm := newFileManager(newBlockCache(opts.BlockCacheSize), opts.MaxOpenFiles, opts.MMapReads)
+	fm.limiter = newRateLimiter(opts.RateLimit)
 	levels := []*level{}
 	for i := 0; i < 7; i++ {
-		level, err := newLevel(i, directory, fm)
+		level, err := newLevel(i, directory, fm, opts, readOnly)
 		if err != nil {
 			return nil, err
 		}
@@ -29,10 +48,30 @@ func newLSM(directory string) (*lsm, error) {
 		levels = append(levels, level)
 	}
 
-	return &lsm{
+	lsm := &lsm{
 		levels: levels,
 		fm:     fm,
-	}, nil
+		opts:   opts,
+
+		readOnly: readOnly,
+
+		bgErr: &backgroundError{},
+
+		strategy:      opts.CompactionStrategy,
+		compactChan:   make(chan struct{}, 1),
+		manualChan:    make(chan *manualCompaction),
+		compactorDone: make(chan struct{}),
+		close:         make(chan struct{}),
+	}
+	if lsm.strategy == nil {
+		lsm.strategy = LeveledCompaction()
+	}
+	if readOnly {
+		close(lsm.compactorDone)
+	} else {
+		go lsm.runCompactor()
+	}
+	return lsm, nil
 }
 
 // Write takes data blocks, an index block, and a key range as input and writes an SST File to level 0.
@@ -46,12 +85,13 @@ func (lsm *lsm) Write(blocks, index []byte, bloom *bloom, keyRange *keyRange) er
 	header := createHeader(len(blocks), len(index), len(bloom.bits), len(keyRangeEntry))
 	data := append(header, append(append(append(blocks, index...), bloom.bits...), keyRangeEntry...)...)
 
-	err := lsm.fm.Write(filename, data)
+	err := lsm.fm.WriteRateLimited(filename, data, flushPriority)
 	if err != nil {
 		return err
 	}
 
-	level.NewSSTFile(fileID, keyRange, bloom)
+	level.NewSSTFile(fileID, keyRange, bloom, len(data))
+	lsm.maybeCompact()
 
 	return nil
 }
@@ -76,15 +116,16 @@ func (lsm *lsm) Read(key string, ts uint64) (*Entry, error) {
 }
 
 // Scan concurrently finds all keys in the LSM tree that fall within the range query.
-// Concurrency is achieved by going through each level on its own goroutine
+// Concurrency is achieved by going through each level on its own goroutine. If a compaction removes a file
+// while it is scanned, the scan is retried since the entries of the file may already have been skipped in the
+// level below. A read only LSM returns the error instead, since its levels only change when it catches up
 func (lsm *lsm) Scan(keyRange *keyRange, ts uint64) ([]*Entry, error) {
 	replyChan := make(chan []*Entry)
 	errChan := make(chan error)
 	result := []*Entry{}
 	errs := make(map[string]int)
-	var wg sync.WaitGroup
+	retry := false
 
-	wg.Add(7)
 	for _, lvl := range lsm.levels {
 		go func(level *level) {
 			entries, err := level.Range(keyRange, ts)
@@ -96,24 +137,25 @@ func (lsm *lsm) Scan(keyRange *keyRange, ts uint64) ([]*Entry, error) {
 		}(lvl)
 	}
 
-	go func() {
-		for {
-			select {
-			case reply := <-replyChan:
-				result = append(result, reply...)
-				wg.Done()
-			case err := <-errChan:
-				if _, ok := errs[err.Error()]; !ok {
-					errs[err.Error()] = 1
-				} else {
-					errs[err.Error()]++
-				}
-				wg.Done()
+	for range lsm.levels {
+		select {
+		case reply := <-replyChan:
+			result = append(result, reply...)
+		case err := <-errChan:
+			if os.IsNotExist(err) {
+				retry = true
+			}
+			if _, ok := errs[err.Error()]; !ok {
+				errs[err.Error()] = 1
+			} else {
+				errs[err.Error()]++
 			}
 		}
-	}()
-	wg.Wait()
+	}
 
+	if retry && !lsm.readOnly {
+		return lsm.Scan(keyRange, ts)
+	}
 	if len(errs) > 0 {
 		return result, fmt.Errorf("Errors during LSM range query: %v", errs)
 	}
@@ -135,9 +177,16 @@ func (lsm *lsm) RecoverTS() (uint64, error) {
 	return 0, nil
 }
 
-// Close closes all levels in the LSM
-func (lsm *lsm) Close() {
-	for _, level := range lsm.levels {
-		level.Close()
-	}
+// Close stops the compactor once its current compaction is done, then closes all open SST files. Writes waiting
+// on the rate limiter are let through so the compaction finishes without delay
+func (lsm *lsm) Close() error {
+	close(lsm.close)
+	lsm.fm.limiter.Close()
+	<-lsm.compactorDone
+	return lsm.fm.tables.close()
+}
+
+// SetRateLimit changes the bytes per second flushes and compactions may write. 0 stops limiting them
+func (lsm *lsm) SetRateLimit(bytesPerSec int) {
+	lsm.fm.limiter.setRate(bytesPerSec)
 }
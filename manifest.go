@@ -2,26 +2,40 @@ package db
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 )
 
-// NewSSTFile adds new SST file to in-memory manifest and sends update request to manifest channel
-func (level *level) NewSSTFile(fileID string, keyRange *keyRange, bloom *bloom) {
+// NewSSTFile adds new SST file of the given size to in-memory manifest
+func (level *level) NewSSTFile(fileID string, keyRange *keyRange, bloom *bloom, size int) {
 	level.manifestLock.Lock()
 	level.manifest[fileID] = keyRange
+	level.sizes[fileID] = size
+	level.size += size
 	level.manifestLock.Unlock()
 
 	level.bloomLock.Lock()
 	level.blooms[fileID] = bloom
 	level.bloomLock.Unlock()
+}
+
+// numFiles returns the amount of files in the level
+func (level *level) numFiles() int {
+	level.manifestLock.RLock()
+	defer level.manifestLock.RUnlock()
+	return len(level.manifest)
+}
 
-	if level.level == 0 && len(level.manifest)-len(level.merging) > compactThreshold {
-		compact := level.mergeManifest()
-		level.below.compactReqChan <- compact
+// bloomsSize returns the memory used by the bloom filters of the files in the level
+func (level *level) bloomsSize() int {
+	level.bloomLock.RLock()
+	defer level.bloomLock.RUnlock()
+	size := 0
+	for _, bloom := range level.blooms {
+		size += len(bloom.bits)
 	}
+	return size
 }
 
 // FindSSTFile finds files in level where key falls in their key range
@@ -42,12 +56,12 @@ func (level *level) FindSSTFile(key string) (filenames []string) {
 }
 
 // RangeSSTFiles finds files in level where their key range falls in the range query
-func (level *level) RangeSSTFiles(startKey, endKey string) (filenames []string) {
+func (level *level) RangeSSTFiles(keyRange *keyRange) (filenames []string) {
 	level.manifestLock.RLock()
 	defer level.manifestLock.RUnlock()
 
 	for filename, item := range level.manifest {
-		if (item.startKey <= startKey && startKey <= item.endKey) || (item.startKey <= endKey && endKey <= item.endKey) || (startKey <= item.startKey && endKey >= item.endKey) {
+		if keyRange.overlaps(item.startKey, item.endKey) {
 			filenames = append(filenames, filepath.Join(level.directory, filename+".sst"))
 		}
 	}
@@ -56,49 +70,82 @@ func (level *level) RangeSSTFiles(startKey, endKey string) (filenames []string)
 
 // DeleteSSTFiles deletes SST files and updates in-memory manifest
 func (level *level) DeleteSSTFiles(files []string) error {
+	level.ReplaceSSTFiles(nil, files)
+	return removeSSTFiles(level.fm, files)
+}
+
+// ReplaceSSTFiles adds the files written by a compaction to the in-memory manifest and removes the files they
+// replace in a single step, so reads at the level never see both or neither
+func (level *level) ReplaceSSTFiles(added []*sstFile, removed []string) {
 	level.manifestLock.Lock()
-	level.mergeLock.Lock()
 	level.bloomLock.Lock()
-	for _, file := range files {
-		arr := strings.Split(file, "/")
-		id := strings.Split(arr[len(arr)-1], ".")[0]
+	for _, file := range added {
+		level.manifest[file.fileID] = file.keyRange
+		level.sizes[file.fileID] = file.size
+		level.size += file.size
+		level.blooms[file.fileID] = file.bloom
+	}
+	for _, file := range removed {
+		id := sstFileID(file)
+		if _, ok := level.manifest[id]; !ok {
+			continue
+		}
+		level.size -= level.sizes[id]
 		delete(level.manifest, id)
-		delete(level.merging, id)
+		delete(level.sizes, id)
 		delete(level.blooms, id)
 	}
 	level.manifestLock.Unlock()
-	level.mergeLock.Unlock()
 	level.bloomLock.Unlock()
+}
 
+// removeSSTFiles evicts SST files from the caches and deletes them, once no checkpoint is linking them
+func removeSSTFiles(fm *fileManager, files []string) error {
 	for _, file := range files {
-		err := os.RemoveAll(file)
+		fm.Evict(file)
+		err := fm.deleter.remove(file)
 		if err != nil {
 			return err
 		}
 	}
-
 	return nil
 }
 
-func (level *level) mergeManifest() []*merge {
-	level.mergeLock.Lock()
+// sstFileID returns the ID of an SST file from its path
+func sstFileID(file string) string {
+	arr := strings.Split(file, "/")
+	return strings.Split(arr[len(arr)-1], ".")[0]
+}
+
+// sortedSSTFiles returns the files in the level sorted by start key
+func (level *level) sortedSSTFiles() []*sstFile {
 	level.manifestLock.RLock()
-	defer level.mergeLock.Unlock()
 	defer level.manifestLock.RUnlock()
 
-	compact := []*merge{}
-
+	files := []*sstFile{}
 	for fileID, keyRange := range level.manifest {
-		if _, ok := level.merging[fileID]; !ok {
-			merge := &merge{
-				files:    []string{filepath.Join(level.directory, fileID+".sst")},
-				keyRange: keyRange,
-			}
-			compact = append(compact, merge)
-			level.merging[fileID] = struct{}{}
+		files = append(files, &sstFile{
+			fileID:   fileID,
+			filename: filepath.Join(level.directory, fileID+".sst"),
+			keyRange: keyRange,
+			size:     level.sizes[fileID],
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].keyRange.startKey < files[j].keyRange.startKey
+	})
+	return files
+}
+
+// overlappingSSTFiles returns the files in the level whose key range overlaps the given range, sorted by start key
+func (level *level) overlappingSSTFiles(startKey, endKey string) []*sstFile {
+	files := []*sstFile{}
+	for _, file := range level.sortedSSTFiles() {
+		if file.keyRange.startKey <= endKey && startKey <= file.keyRange.endKey {
+			files = append(files, file)
 		}
 	}
-	return mergeIntervals(compact)
+	return files
 }
 
 func (level *level) printManifest() {
@@ -1,45 +1,96 @@
 package db
 
-import (
-	"time"
-)
-
-type memory struct {
-	currMemory int
-	maxMemory  int
+// MemoryUsage reports the memory used by the DB, broken down by what uses it
+type MemoryUsage struct {
+	// MutableMemTable is the memory used by the entries of the memtable being written to
+	MutableMemTable int
+	// ImmutableMemTables is the memory used by the entries of the memtables waiting to be flushed
+	ImmutableMemTables int
+	// BlockCache is the memory used by data blocks in the block cache
+	BlockCache int
+	// IndexCache is the memory used by decoded index blocks in the block cache
+	IndexCache int
+	// BloomFilters is the memory used by the bloom filters of all SST files
+	BloomFilters int
+	// Total is the sum of all of the above
+	Total int
 }
 
-func newMemory() *memory {
-	m := &memory{
-		currMemory: 0,
-		maxMemory:  10,
+// entryMemSize estimates the memory used by an entry once it is put into a memtable
+func entryMemSize(entry *Entry) int {
+	size := len(entry.Key) + memEntryOverhead
+	for name, value := range entry.Attributes {
+		size += len(name) + memAttributeOverhead
+		if value != nil {
+			size += len(value.Data)
+		}
 	}
-	go m.run()
-	return m
+	return size
 }
 
-func (m *memory) run() {
-	checkMemory := time.NewTicker(5 * time.Second)
-	for {
-		select {
-		case <-checkMemory.C:
-			// PrintMemUsage()
-			continue
+// memTablesUsage returns the memory used by the mutable memtable and by the immutable memtables
+func (db *DB) memTablesUsage() (mutable, immutables int) {
+	for i, mt := range db.memTables() {
+		if i == 0 {
+			mutable = mt.memoryUsage()
+		} else {
+			immutables += mt.memoryUsage()
 		}
 	}
+	return mutable, immutables
+}
+
+// bloomsUsage returns the memory used by the bloom filters of all levels
+func (db *DB) bloomsUsage() int {
+	size := 0
+	for _, level := range db.lsm.levels {
+		size += level.bloomsSize()
+	}
+	return size
+}
+
+// applyMemoryBudget gives the block cache whatever memory of the budget is not used by memtables and bloom filters,
+// evicting cached blocks if the cache shrinks. Only db.run calls it, every stall check interval and after flushes
+func (db *DB) applyMemoryBudget() {
+	if db.opts.MemoryBudget <= 0 {
+		return
+	}
+	db.wc.bloomsSize = db.bloomsUsage()
+	mutable, immutables := db.memTablesUsage()
+	capacity := db.opts.MemoryBudget - mutable - immutables - db.wc.bloomsSize
+	if capacity > db.opts.BlockCacheSize {
+		capacity = db.opts.BlockCacheSize
+	}
+	db.lsm.fm.cache.setCapacity(capacity)
 }
 
-// PrintMemUsage outputs the current, total and OS memory being used. As well as the number
-// of garage collection cycles completed.
-// func printMemUsage() {
-// 	var m runtime.MemStats
-// 	runtime.ReadMemStats(&m)
-// 	// For info on each, see: https://golang.org/pkg/runtime/#MemStats
-// 	fmt.Printf("Alloc = %v MiB", bToMb(m.Alloc))
-// 	fmt.Printf("\tSys = %v MiB", bToMb(m.Sys))
-// 	fmt.Printf("\tNumGC = %v\n", m.NumGC)
-// }
-
-// func bToMb(b uint64) uint64 {
-// 	return b / 1024 / 1024
-// }
+// overBudget returns whether the memtables and bloom filters alone use more than the memory budget, so even an
+// empty block cache does not keep the DB within it. Only db.run calls it
+func (db *DB) overBudget() bool {
+	if db.opts.MemoryBudget <= 0 {
+		return false
+	}
+	mutable, immutables := db.memTablesUsage()
+	return mutable+immutables+db.wc.bloomsSize > db.opts.MemoryBudget
+}
+
+// flushEarly returns whether the mutable memtable should be flushed before it is full because the DB is over its
+// memory budget. Memtables already waiting to be flushed free their memory once they are, so while there are any,
+// writes stop instead of queueing more small memtables
+func (db *DB) flushEarly() bool {
+	return db.mutable.size > 0 && len(db.immutables) == 0 && db.overBudget()
+}
+
+// MemoryUsage returns the memory used by memtables, the block cache, and bloom filters
+func (db *DB) MemoryUsage() MemoryUsage {
+	usage := MemoryUsage{}
+	usage.MutableMemTable, usage.ImmutableMemTables = db.memTablesUsage()
+
+	cache := db.lsm.fm.cache.stats()
+	usage.BlockCache = cache.Size - cache.IndexSize
+	usage.IndexCache = cache.IndexSize
+
+	usage.BloomFilters = db.bloomsUsage()
+	usage.Total = usage.MutableMemTable + usage.ImmutableMemTables + usage.BlockCache + usage.IndexCache + usage.BloomFilters
+	return usage
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryUsage(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	numKeys := 100
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	usage := db.MemoryUsage()
+	if usage.MutableMemTable < numKeys*(len("10000")*2+memEntryOverhead) {
+		t.Fatalf("Expected mutable memtable to use at least the size of its entries, Got: %d\n", usage.MutableMemTable)
+	}
+	if usage.BloomFilters != 0 || usage.BlockCache != 0 {
+		t.Fatalf("Expected no SST memory before flush, Got: %+v\n", usage)
+	}
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	for i := 0; i < numKeys; i++ {
+		_, err := db.Read(strconv.Itoa(10000+i), []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key: %v\n", err)
+		}
+	}
+	usage = db.MemoryUsage()
+	if usage.MutableMemTable != 0 || usage.ImmutableMemTables != 0 {
+		t.Fatalf("Expected memtables to be empty after flush, Got: %+v\n", usage)
+	}
+	if usage.BloomFilters == 0 || usage.BlockCache == 0 || usage.IndexCache == 0 {
+		t.Fatalf("Expected memory used by bloom filters, data blocks, and index blocks, Got: %+v\n", usage)
+	}
+	if usage.Total != usage.BlockCache+usage.IndexCache+usage.BloomFilters {
+		t.Fatalf("Expected total to be the sum of all memory, Got: %+v\n", usage)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemoryBudget = 8 * KB
+	opts.CompactionStrategy = &noCompaction{}
+	opts.L0SlowdownWritesTrigger = 1000
+	opts.L0StopWritesTrigger = 1000
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	// The WAL of these writes is smaller than a memtable, so without the budget nothing would be flushed
+	numKeys := 100
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if db.lsm.levels[0].numFiles() == 0 {
+		t.Fatalf("Expected memtables over budget to be flushed early\n")
+	}
+	usage := db.MemoryUsage()
+	if usage.MutableMemTable+usage.ImmutableMemTables > opts.MemoryBudget+KB {
+		t.Fatalf("Expected memtables to stay around the budget of %d, Got: %+v\n", opts.MemoryBudget, usage)
+	}
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		entry, err := db.Read(key, []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != key {
+			t.Fatalf("Value expected: %v, Got: %v\n", key, string(entry.Attributes["value"].Data))
+		}
+	}
+
+	// Reads fill the block cache, which is shrunk to what the memtables and bloom filters leave of the budget
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < numKeys; i++ {
+		_, err := db.Read(strconv.Itoa(10000+i), []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key: %v\n", err)
+		}
+	}
+	if db.BlockCacheStats().Capacity >= opts.BlockCacheSize {
+		t.Fatalf("Expected block cache to be shrunk to the budget, Got capacity: %d\n", db.BlockCacheStats().Capacity)
+	}
+	usage = db.MemoryUsage()
+	if usage.BlockCache+usage.IndexCache == 0 {
+		t.Fatalf("Expected blocks to be cached within the budget, Got: %+v\n", usage)
+	}
+	if usage.Total > opts.MemoryBudget {
+		t.Fatalf("Expected total memory to stay within the budget of %d, Got: %+v\n", opts.MemoryBudget, usage)
+	}
+}
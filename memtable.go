@@ -2,28 +2,60 @@ package db
 
 import (
 	"encoding/binary"
-	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
 )
 
+// MemTableType is the data structure memtables keep their entries in
+type MemTableType uint8
+
+// Supported memtable types
+const (
+	// AVLMemTable is an AVL tree behind a single lock, so writes block reads
+	AVLMemTable MemTableType = iota
+	// SkipListMemTable is a skip list that is read without locks while it is written
+	SkipListMemTable
+)
+
+// memStore is the sorted in-memory structure of a memtable. Versions of a key are kept newest first
+type memStore interface {
+	Put(entry *Entry)
+	Find(key string, ts uint64) *Entry
+	Scan(keyRange *keyRange, ts uint64) []*Entry
+	Inorder() []*Entry
+}
+
+// newMemStore creates an empty memStore of the given type
+func newMemStore(memTableType MemTableType) memStore {
+	if memTableType == SkipListMemTable {
+		return newSkipList()
+	}
+	return newAVLTree()
+}
+
 // memTable is struct for Write-Ahead-Log and memtable
 type memTable struct {
-	table   *avlTree
+	table   memStore
 	wal     *os.File
 	walName string
 	size    int
+
+	// memSize is the memory used by the entries of the memtable. It is read by MemoryUsage while the memtable is written
+	memSize int64
 }
 
 // newMemTable creates a file for the WAL and a new Memtable
-func newMemTable(directory string, id string) (mt *memTable, maxCommitTs uint64, err error) {
+func newMemTable(directory string, id string, memTableType MemTableType) (mt *memTable, maxCommitTs uint64, err error) {
 	err = os.MkdirAll(filepath.Join(directory, "memtables"), dirPerm)
 	if err != nil {
 		return nil, 0, err
 	}
 	mt = &memTable{
-		table:   newAVLTree(),
+		table:   newMemStore(memTableType),
 		wal:     nil,
 		walName: filepath.Join(directory, "memtables", id),
 		size:    0,
@@ -61,12 +93,23 @@ func (mt *memTable) Write(entries []*Entry) error {
 	}
 	// Put entries into memory structure after append to WAL to ensure consistency
 	for _, entry := range entries {
-		mt.table.Put(entry)
+		mt.put(entry)
 	}
 	mt.size += len(data)
 	return nil
 }
 
+// put inserts an entry into the in-memory table and accounts for the memory it uses
+func (mt *memTable) put(entry *Entry) {
+	mt.table.Put(entry)
+	atomic.AddInt64(&mt.memSize, int64(entryMemSize(entry)))
+}
+
+// memoryUsage returns the memory used by the entries of the memtable
+func (mt *memTable) memoryUsage() int {
+	return int(atomic.LoadInt64(&mt.memSize))
+}
+
 // AppendWAL encodes an lsmDataEntry into bytes and appends to the WAL
 func (mt *memTable) AppendWAL(data []byte) error {
 	numBytes, err := mt.wal.Write(data)
@@ -83,38 +126,79 @@ func (mt *memTable) AppendWAL(data []byte) error {
 	return nil
 }
 
-func (mt *memTable) Truncate() error {
+// Close closes the WAL of a memtable. Its entries are recovered from the WAL when the DB is opened again
+func (mt *memTable) Close() error {
+	return mt.wal.Close()
+}
+
+// Delete closes and removes the WAL of a memtable whose entries were flushed to level 0
+func (mt *memTable) Delete() error {
 	err := mt.wal.Close()
 	if err != nil {
 		return err
 	}
-	err = mt.truncate()
-	if err != nil {
-		return err
-	}
-	err = mt.SetWAL()
-	if err != nil {
-		return err
-	}
-	mt.table = newAVLTree()
-	mt.size = 0
-	return nil
+	return os.Remove(mt.walName)
 }
 
-func (mt *memTable) truncate() error {
-	f, err := os.OpenFile(mt.walName, os.O_TRUNC, filePerm)
-	defer f.Close()
+// recoverMemTables opens the WAL of every memtable in the directory. Memtables with entries are returned oldest
+// first, ordered by their max commit ts, along with the highest WAL id in use. Empty WALs are removed
+func recoverMemTables(directory string, memTableType MemTableType) (mts []*memTable, maxCommitTs uint64, maxID uint64, err error) {
+	err = os.MkdirAll(filepath.Join(directory, "memtables"), dirPerm)
 	if err != nil {
-		return err
+		return nil, 0, 0, err
 	}
-	ret, err := f.Seek(0, 0)
+	files, err := ioutil.ReadDir(filepath.Join(directory, "memtables"))
 	if err != nil {
-		return err
+		return nil, 0, 0, err
+	}
+	commitTs := make(map[*memTable]uint64)
+	for _, file := range files {
+		id, err := strconv.ParseUint(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		if id > maxID {
+			maxID = id
+		}
+		mt, ts, err := newMemTable(directory, file.Name(), memTableType)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if mt.size == 0 {
+			err = mt.Delete()
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			continue
+		}
+		commitTs[mt] = ts
+		if ts > maxCommitTs {
+			maxCommitTs = ts
+		}
+		mts = append(mts, mt)
 	}
-	if ret != 0 {
-		return errors.New("Seek did not go to 0")
+	sort.Slice(mts, func(i, j int) bool {
+		return commitTs[mts[i]] < commitTs[mts[j]]
+	})
+	return mts, maxCommitTs, maxID, nil
+}
+
+// replayWAL decodes the complete entries at the start of WAL data. An entry that is still being appended is left
+// for the next replay. It returns the entries along with the amount of bytes they take up
+func replayWAL(data []byte) (entries []*Entry, n int, err error) {
+	for n+4 <= len(data) {
+		size := binary.LittleEndian.Uint32(data[n:n+4]) &^ entryFormatFlag
+		if size == 0 || n+4+int(size) > len(data) {
+			break
+		}
+		entry, entrySize, err := readEntry(data[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+		n += entrySize
 	}
-	return nil
+	return entries, n, nil
 }
 
 // RecoverWAL reads the WAL and repopulates the memtable
@@ -134,23 +218,18 @@ func (mt *memTable) RecoverWAL() (maxCommitTs uint64, err error) {
 				if i+4 > len(data) {
 					break
 				}
-				entrySize := binary.LittleEndian.Uint32(data[i : i+4])
-				i += 4
-				if i+int(entrySize) > len(data) {
-					return 0, newErrBadFormattedSST()
-				}
-				if entrySize == 0 {
-					break
-				}
-				entry, err := decodeEntry(data[i : i+int(entrySize)])
+				entry, n, err := readEntry(data[i:])
 				if err != nil {
 					return 0, err
 				}
-				i += int(entrySize)
+				if entry == nil {
+					break
+				}
+				i += n
 				entries = append(entries, entry)
 			}
 			for _, entry := range entries {
-				mt.table.Put(entry)
+				mt.put(entry)
 				if entry.ts > maxCommitTs {
 					maxCommitTs = entry.ts
 				}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestMemTableQueue(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxImmutableMemTables = 8
+	// Only the first flush goes through right away, the memtables after it queue up
+	opts.RateLimit = KB
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	numKeys := 400
+	for version := 0; version < 4; version++ {
+		for i := 0; i < numKeys; i++ {
+			key := strconv.Itoa(10000 + i)
+			value, _ := CreateValue(key + "-" + strconv.Itoa(version))
+			err := db.UpdateTxn(func(txn *Txn) error {
+				return txn.Write(key, map[string]*Value{"value": value})
+			})
+			if err != nil {
+				t.Fatalf("Error writing key %v: %v\n", key, err)
+			}
+		}
+	}
+	if mts := db.memTables(); len(mts) < 3 {
+		t.Fatalf("Expected at least 2 immutable memtables, Got: %d\n", len(mts)-1)
+	}
+	if stats := db.WriteStallStats(); stats.MemTableStops != 0 {
+		t.Fatalf("Expected no stopped writes, Got: %d\n", stats.MemTableStops)
+	}
+
+	checkValues := func() {
+		for i := 0; i < numKeys; i++ {
+			key := strconv.Itoa(10000 + i)
+			entry, err := db.Read(key, []string{"value"})
+			if err != nil {
+				t.Fatalf("Error reading key %v: %v\n", key, err)
+			}
+			if string(entry.Attributes["value"].Data) != key+"-3" {
+				t.Fatalf("Value expected: %v, Got: %v\n", key+"-3", string(entry.Attributes["value"].Data))
+			}
+		}
+		entries, err := db.Scan("10000", []string{"value"})
+		if err != nil {
+			t.Fatalf("Error scanning db: %v\n", err)
+		}
+		if len(entries) != numKeys {
+			t.Fatalf("Scan length, Expected: %d, Got: %d\n", numKeys, len(entries))
+		}
+	}
+	checkValues()
+
+	db.SetRateLimit(0)
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtables: %v\n", err)
+	}
+	if mts := db.memTables(); len(mts) != 1 {
+		t.Fatalf("Expected all immutable memtables to be flushed, Got: %d\n", len(mts)-1)
+	}
+	wals, err := ioutil.ReadDir("data/memtables")
+	if err != nil {
+		t.Fatalf("Error reading memtables directory: %v\n", err)
+	}
+	if len(wals) != 1 {
+		t.Fatalf("Expected only the WAL of the mutable memtable, Got: %d\n", len(wals))
+	}
+	checkValues()
+}
+
+func TestMemTableRecovery(t *testing.T) {
+	err := deleteData("data")
+	if err != nil {
+		t.Fatalf("Error deleting data: %v\n", err)
+	}
+	// WALs left by a crash. The WAL with the lower id holds the newer versions, so recovery has to order
+	// memtables by commit ts
+	for id, ts := range map[string]uint64{"5": 20, "7": 10} {
+		mt, _, err := newMemTable("data", id, SkipListMemTable)
+		if err != nil {
+			t.Fatalf("Error creating memtable: %v\n", err)
+		}
+		entries := []*Entry{}
+		for i := 0; i < 100; i++ {
+			key := strconv.Itoa(10000 + i)
+			entries = append(entries, simpleEntry(ts, key, key+"-"+strconv.Itoa(int(ts))))
+		}
+		err = mt.Write(entries)
+		if err != nil {
+			t.Fatalf("Error writing to memtable: %v\n", err)
+		}
+		mt.wal.Close()
+	}
+	emptyWAL, err := os.Create("data/memtables/6")
+	if err != nil {
+		t.Fatalf("Error creating WAL: %v\n", err)
+	}
+	emptyWAL.Close()
+
+	db, err := NewDB("data")
+	if err != nil {
+		t.Fatalf("Error opening DB: %v\n", err)
+	}
+	defer db.Close()
+
+	if _, err := os.Stat("data/memtables/6"); !os.IsNotExist(err) {
+		t.Fatalf("Expected empty WAL to be removed, Got: %v\n", err)
+	}
+	if _, err := os.Stat("data/memtables/8"); err != nil {
+		t.Fatalf("Expected new WAL after the highest id: %v\n", err)
+	}
+	checkValues := func() {
+		for i := 0; i < 100; i++ {
+			key := strconv.Itoa(10000 + i)
+			entry, err := db.Read(key, []string{"value"})
+			if err != nil {
+				t.Fatalf("Error reading key %v: %v\n", key, err)
+			}
+			if string(entry.Attributes["value"].Data) != key+"-20" {
+				t.Fatalf("Value expected: %v, Got: %v\n", key+"-20", string(entry.Attributes["value"].Data))
+			}
+		}
+	}
+	checkValues()
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtables: %v\n", err)
+	}
+	for _, id := range []string{"5", "7"} {
+		if _, err := os.Stat("data/memtables/" + id); !os.IsNotExist(err) {
+			t.Fatalf("Expected WAL %v to be removed after flush, Got: %v\n", id, err)
+		}
+	}
+	checkValues()
+
+	// Commits after recovery get a ts after every recovered entry
+	value, _ := CreateValue("new")
+	err = db.UpdateTxn(func(txn *Txn) error {
+		return txn.Write("10000", map[string]*Value{"value": value})
+	})
+	if err != nil {
+		t.Fatalf("Error writing key: %v\n", err)
+	}
+	entry, err := db.Read("10000", []string{"value"})
+	if err != nil || string(entry.Attributes["value"].Data) != "new" {
+		t.Fatalf("Error reading new value: %v\n", err)
+	}
+}
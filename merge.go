@@ -1,112 +1,83 @@
 package db
 
 import (
-	"sort"
+	"container/heap"
 )
 
-func (level *level) mergeSort(files []string) ([]*Entry, error) {
-	if len(files) > 1 {
-		mid := len(files) / 2
-		left, err := level.mergeSort(files[:mid])
-		if err != nil {
-			return nil, err
-		}
-		right, err := level.mergeSort(files[mid:])
-		if err != nil {
-			return nil, err
-		}
-		result := mergeHelper(left, right)
-		return result, nil
-	}
-	return level.fm.MMap(files[0])
+// mergeItem is the next entry of one of the iterators being merged
+type mergeItem struct {
+	entry *Entry
+	it    *tableIterator
 }
 
-func mergeHelper(left, right []*Entry) (entries []*Entry) {
-	entries = append(left, right...)
-	sort.Slice(entries, func(i, j int) bool {
-		if entries[i].Key == entries[j].Key {
-			return entries[i].ts > entries[j].ts
-		}
-		return entries[i].Key < entries[j].Key
-	})
-	return entries
-}
-
-func mergeIntervals(intervals []*merge) []*merge {
-	sort.Slice(intervals, func(i, j int) bool {
-		return intervals[i].keyRange.startKey < intervals[j].keyRange.startKey
-	})
+// mergeHeap orders entries by key, then by newest version first
+type mergeHeap []*mergeItem
 
-	result := []*merge{}
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].entry.Key == h[j].entry.Key {
+		return h[i].entry.ts > h[j].entry.ts
+	}
+	return h[i].entry.Key < h[j].entry.Key
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
 
-	for i, interval := range intervals {
-		if i == 0 {
-			result = append(result, interval)
-		} else {
-			curr := result[len(result)-1]
-			currEnd := curr.keyRange.endKey
-			nextStart := interval.keyRange.startKey
-			nextEnd := interval.keyRange.endKey
+// mergeIterator merges sorted table iterators into a single sorted stream of entries. Only the current
+// data block of each table is held in memory
+type mergeIterator struct {
+	iters []*tableIterator
+	heap  mergeHeap
+}
 
-			if nextStart > currEnd {
-				result = append(result, interval)
-			} else {
-				if nextEnd > currEnd {
-					curr.keyRange.endKey = nextEnd
-				}
-				curr.files = append(curr.files, interval.files...)
-			}
+// newMergeIterator takes ownership of the iterators and closes them if it fails
+func newMergeIterator(iters []*tableIterator) (*mergeIterator, error) {
+	m := &mergeIterator{
+		iters: iters,
+		heap:  mergeHeap{},
+	}
+	for _, it := range iters {
+		entry, err := it.next()
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		if entry != nil {
+			m.heap = append(m.heap, &mergeItem{entry: entry, it: it})
 		}
 	}
-
-	return result
+	heap.Init(&m.heap)
+	return m, nil
 }
 
-// mergeInterval joins the interval into the list if it overlaps with an interval. Else it returns the original list.
-func mergeInterval(intervals []*merge, newInterval *merge) (merged bool, result []*merge) {
-	merged = false
-	newLeft := newInterval.keyRange.startKey
-	newRight := newInterval.keyRange.endKey
-	newFiles := newInterval.files
-
-	for i, interval := range intervals {
-		left := interval.keyRange.startKey
-		right := interval.keyRange.endKey
-
-		if right < newLeft {
-			result = append(result, interval)
-		} else if (left <= newLeft && newLeft <= right) || (left <= newRight && newRight <= right) || (newLeft <= left && newRight >= right) {
-			if left < newLeft {
-				newLeft = left
-			}
-			if right > newRight {
-				newRight = right
-			}
-			newFiles = append(newFiles, interval.files...)
-			merged = true
-		} else {
-			if merged {
-				result = append(result, &merge{
-					files: newFiles,
-					keyRange: &keyRange{
-						startKey: newLeft,
-						endKey:   newRight,
-					},
-				})
-				return true, append(result, intervals[i:]...)
-			}
-			return false, intervals
-		}
+// next returns the smallest entry left in all iterators, or nil once all entries have been read
+func (m *mergeIterator) next() (*Entry, error) {
+	if len(m.heap) == 0 {
+		return nil, nil
 	}
+	item := m.heap[0]
+	entry := item.entry
+	next, err := item.it.next()
+	if err != nil {
+		return nil, err
+	}
+	if next == nil {
+		heap.Pop(&m.heap)
+	} else {
+		item.entry = next
+		heap.Fix(&m.heap, 0)
+	}
+	return entry, nil
+}
 
-	if merged {
-		return true, append(result, &merge{
-			files: newFiles,
-			keyRange: &keyRange{
-				startKey: newLeft,
-				endKey:   newRight,
-			},
-		})
+func (m *mergeIterator) close() {
+	for _, it := range m.iters {
+		it.close()
 	}
-	return false, intervals
 }
@@ -1,8 +1,8 @@
 package db
 
 import (
+	"os"
 	"strconv"
-	"strings"
 	"testing"
 
 	"github.com/google/uuid"
@@ -24,7 +24,7 @@ func TestMergeMMap(t *testing.T) {
 		memorykv[key] = value
 	}
 
-	dataBlocks, indexBlock, bloom, keyRange, err := writeEntries(entries)
+	dataBlocks, indexBlock, bloom, keyRange, err := writeEntries(entries, SnappyCompression)
 	if err != nil {
 		t.Fatalf("Error writing data entries: %v\n", err)
 	}
@@ -38,7 +38,7 @@ func TestMergeMMap(t *testing.T) {
 		t.Fatalf("Error writing to file: %v\n", err)
 	}
 
-	entries, err = mmap("data/L0/test.sst")
+	entries, err = newFileManager(nil, 1, false).MMap("data/L0/test.sst")
 	if err != nil {
 		t.Fatalf("Error mmaping file: %v\n", err)
 	}
@@ -54,129 +54,95 @@ func TestMergeMMap(t *testing.T) {
 	}
 }
 
-func TestMergeIntervals(t *testing.T) {
-	intervals := []*merge{
-		&merge{
-			files: []string{"a"},
-			keyRange: &keyRange{
-				startKey: "a",
-				endKey:   "c",
-			},
-		},
-		&merge{
-			files: []string{"b"},
-			keyRange: &keyRange{
-				startKey: "b",
-				endKey:   "f",
-			},
-		},
-		&merge{
-			files: []string{"c"},
-			keyRange: &keyRange{
-				startKey: "h",
-				endKey:   "j",
-			},
-		},
-		&merge{
-			files: []string{"d"},
-			keyRange: &keyRange{
-				startKey: "o",
-				endKey:   "r",
-			},
-		},
-	}
-
-	intervals = mergeIntervals(intervals)
-
-	expected := []*merge{
-		&merge{
-			files: []string{"a", "b"},
-			keyRange: &keyRange{
-				startKey: "a",
-				endKey:   "f",
-			},
-		},
-		&merge{
-			files: []string{"c"},
-			keyRange: &keyRange{
-				startKey: "h",
-				endKey:   "j",
-			},
-		},
-		&merge{
-			files: []string{"d"},
-			keyRange: &keyRange{
-				startKey: "o",
-				endKey:   "r",
-			},
-		},
-	}
-
-	if len(expected) != len(intervals) {
-		t.Fatalf("Expected intervals to have length: %d, got %d\n", len(expected), len(intervals))
+func TestMergeCompaction(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TargetFileSize = 64 * KB
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
 	}
+	defer db.Close()
 
-	for i := 0; i < len(expected); i++ {
-		interval := intervals[i]
-		expect := expected[i]
-		if strings.Join(interval.files, ",") != strings.Join(expect.files, ",") {
-			t.Fatalf("Files, Expected: %v, Got: %v\n", strings.Join(expect.files, ","), strings.Join(interval.files, ","))
+	// Each file holds a newer version of every (i+1)th key
+	files := []string{}
+	numEntries := 0
+	for i := 0; i < 3; i++ {
+		entries := []*Entry{}
+		for key := 10000; key < 30000; key += i + 1 {
+			entries = append(entries, simpleEntry(uint64(i+1), strconv.Itoa(key), strconv.Itoa(key)+"-"+strconv.Itoa(i)))
+		}
+		numEntries += len(entries)
+		dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries, SnappyCompression)
+		if err != nil {
+			t.Fatalf("Error writing data entries: %v\n", err)
 		}
-		if interval.keyRange.startKey != expect.keyRange.startKey || interval.keyRange.endKey != expect.keyRange.endKey {
-			t.Fatalf("Interval, Expected: %v, Got: %v\n", expect.keyRange, interval.keyRange)
+		keyRangeEntry := createkeyRangeEntry(kr)
+		header := createHeader(len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry))
+		data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+		filename := "data/L0/merge" + strconv.Itoa(i) + ".sst"
+		err = writeNewFile(filename, data)
+		if err != nil {
+			t.Fatalf("Error writing to file: %v\n", err)
 		}
+		files = append(files, filename)
 	}
-}
 
-func TestMergeInterval(t *testing.T) {
-	intervals := []*merge{
-		&merge{
-			files: []string{"a"},
-			keyRange: &keyRange{
-				startKey: "a",
-				endKey:   "c",
-			},
-		},
+	level := db.lsm.levels[1]
+	outputs, err := level.compact(files, opts.TargetFileSize, 0)
+	if err != nil {
+		t.Fatalf("Error merging files: %v\n", err)
 	}
-
-	interval := &merge{
-		files: []string{"b"},
-		keyRange: &keyRange{
-			startKey: "b",
-			endKey:   "f",
-		},
+	if len(outputs) < 2 {
+		t.Fatalf("Expected compaction to write multiple files, Got: %d\n", len(outputs))
 	}
+	level.ReplaceSSTFiles(outputs, nil)
 
-	merged, intervals := mergeInterval(intervals, interval)
-	if !merged {
-		t.Fatalf("Expected interval to be merged\n")
+	merged := []*Entry{}
+	for i, output := range outputs {
+		if i > 0 && outputs[i-1].keyRange.endKey >= output.keyRange.startKey {
+			t.Fatalf("Expected output files to not overlap, Got: %v and %v\n", outputs[i-1].keyRange, output.keyRange)
+		}
+		if output.size > 2*opts.TargetFileSize {
+			t.Fatalf("Expected file size near target %d, Got: %d\n", opts.TargetFileSize, output.size)
+		}
+		entries, err := db.lsm.fm.MMap(output.filename)
+		if err != nil {
+			t.Fatalf("Error mmaping file: %v\n", err)
+		}
+		merged = append(merged, entries...)
+	}
+	if len(merged) != numEntries {
+		t.Fatalf("Expected length of entries: %d, Got %d\n", numEntries, len(merged))
 	}
-	if strings.Join(intervals[0].files, ",") != "a,b" && strings.Join(intervals[0].files, ",") != "b,a" {
-		t.Fatalf("Files, Expected: %v, Got: %v\n", "a,b", strings.Join(intervals[0].files, ","))
+	for i := 1; i < len(merged); i++ {
+		prev, entry := merged[i-1], merged[i]
+		if prev.Key > entry.Key || (prev.Key == entry.Key && prev.ts <= entry.ts) {
+			t.Fatalf("Entries out of order: %v@%d before %v@%d\n", prev.Key, prev.ts, entry.Key, entry.ts)
+		}
 	}
-	if intervals[0].keyRange.startKey != "a" || intervals[0].keyRange.endKey != "f" {
-		t.Fatalf("Interval, Expected: %v, Got: %v\n", &keyRange{startKey: "a", endKey: "f"}, intervals[0].keyRange)
+	entry, err := level.Find("16000", 10)
+	if err != nil {
+		t.Fatalf("Error finding key: %v\n", err)
 	}
-
-	interval = &merge{
-		files: []string{"c"},
-		keyRange: &keyRange{
-			startKey: "h",
-			endKey:   "j",
-		},
+	if string(entry.Attributes["value"].Data) != "16000-2" {
+		t.Fatalf("Value expected: 16000-2, Got: %v\n", string(entry.Attributes["value"].Data))
 	}
 
-	merged, intervals = mergeInterval(intervals, interval)
-	if merged {
-		t.Fatalf("Expected interval to not be merged\n")
-	}
-	if len(intervals) > 1 {
-		t.Fatalf("Len(intervals), Expected: 1, Got: %d\n", len(intervals))
+	// A file removed by a compaction in the middle of a read is dropped from the manifest, not returned as an error
+	for _, output := range outputs {
+		if output.keyRange.contains("16000") {
+			db.lsm.fm.Evict(output.filename)
+			err = os.Remove(output.filename)
+			if err != nil {
+				t.Fatalf("Error removing file: %v\n", err)
+			}
+		}
 	}
-	if strings.Join(intervals[0].files, ",") != "a,b" && strings.Join(intervals[0].files, ",") != "b,a" {
-		t.Fatalf("Files, Expected: %v, Got: %v\n", "a,b", strings.Join(intervals[0].files, ","))
+	_, err = level.Find("16000", 10)
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Fatalf("Expected ErrKeyNotFound, Got: %v\n", err)
 	}
-	if intervals[0].keyRange.startKey != "a" || intervals[0].keyRange.endKey != "f" {
-		t.Fatalf("Interval, Expected: %v, Got: %v\n", &keyRange{startKey: "a", endKey: "f"}, intervals[0].keyRange)
+	if filenames := level.FindSSTFile("16000"); len(filenames) != 0 {
+		t.Fatalf("Expected removed file to be dropped from the manifest, Got: %v\n", filenames)
 	}
 }
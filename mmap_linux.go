@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapSupported reports whether SST files can be memory mapped on this platform
+const mmapSupported = true
+
+// mmapFile maps the first size bytes of a file into memory as read only
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
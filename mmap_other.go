@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package db
+
+import (
+	"os"
+)
+
+// mmapSupported reports whether SST files can be memory mapped on this platform
+const mmapSupported = false
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, newErrMMapUnsupported()
+}
+
+func munmapFile(data []byte) error {
+	return newErrMMapUnsupported()
+}
@@ -0,0 +1,76 @@
+package db
+
+// Options configures a DB when it is opened with NewDBWithOptions
+type Options struct {
+	// ValueThreshold is the size in bytes above which an attribute value is moved into the value log when its
+	// memtable is flushed. SST files then only hold a pointer to the value. Set it to EntrySize to disable
+	ValueThreshold int
+	// ValueLogFileSize is the size a value log file grows to before a new one is started
+	ValueLogFileSize int
+	// Compression is the algorithm used to compress SST data blocks written from now on
+	Compression CompressionType
+	// BlockCacheSize is the max amount of bytes of SST data and index blocks kept in memory. 0 disables the cache
+	BlockCacheSize int
+	// MaxOpenFiles is the max amount of SST files kept open at once, including files being written. A compaction
+	// keeps all of its input files open
+	MaxOpenFiles int
+	// MMapReads memory maps SST files instead of reading their blocks into buffers. It is ignored on platforms
+	// other than linux
+	MMapReads bool
+	// TargetFileSize is the size of SST files written by compaction, which starts a new file once the current one
+	// reaches it. 0 writes all merged entries into a single file
+	TargetFileSize int
+	// BaseLevelSize is the size of level 1 above which it is compacted into level 2
+	BaseLevelSize int
+	// LevelSizeMultiplier is how many times larger each level below level 1 may grow than the level above it
+	LevelSizeMultiplier int
+	// RateLimit is the max bytes per second written by memtable flushes and compactions, so they leave disk
+	// bandwidth for reads. Flushes are let through before compactions. 0 does not limit them
+	RateLimit int
+	// MemTableType is the data structure memtables keep their entries in. AVLMemTable is the default, so options
+	// without it keep the memtable they used before SkipListMemTable was added
+	MemTableType MemTableType
+	// MaxImmutableMemTables is the amount of full memtables that may wait to be flushed, each with its own WAL.
+	// Writes stop once the mutable memtable fills up while the queue is full. It must be at least 1
+	MaxImmutableMemTables int
+	// MemoryBudget is the max memory used by memtables, the block cache, and bloom filters together, as reported by
+	// MemoryUsage. The block cache only gets what the memtables and bloom filters leave, up to BlockCacheSize. If
+	// memtables and bloom filters alone exceed it, the mutable memtable is flushed early, or writes stop while other
+	// memtables wait to be flushed. The cache is resized every stall check interval, so usage may briefly exceed it.
+	// 0 does not limit memory
+	MemoryBudget int
+	// L0SlowdownWritesTrigger is the amount of level 0 files at which every write is delayed so compaction can catch
+	// up. Tiered compaction scales it by how many more runs than leveled compaction it collects before compacting
+	// level 0. FIFO compaction ignores it since it never compacts level 0
+	L0SlowdownWritesTrigger int
+	// L0StopWritesTrigger is the amount of level 0 files at which writes wait until compaction brings it back down.
+	// It is scaled or ignored like L0SlowdownWritesTrigger
+	L0StopWritesTrigger int
+	// NonBlockingWrites makes writes that would be delayed or stopped return ErrWriteStall instead of waiting
+	NonBlockingWrites bool
+	// FlushOnClose makes Close flush all memtables to level 0 so the next open does not replay their WALs
+	FlushOnClose bool
+	// CompactionStrategy decides which SST files are compacted: LeveledCompaction, TieredCompaction, or FIFOCompaction
+	CompactionStrategy CompactionStrategy
+}
+
+// DefaultOptions returns the options used by NewDB
+func DefaultOptions() *Options {
+	return &Options{
+		ValueThreshold:      defaultValueThreshold,
+		ValueLogFileSize:    defaultValueLogFileSize,
+		Compression:         SnappyCompression,
+		BlockCacheSize:      defaultBlockCacheSize,
+		MaxOpenFiles:        defaultMaxOpenFiles,
+		TargetFileSize:      defaultTargetFileSize,
+		BaseLevelSize:       defaultBaseLevelSize,
+		LevelSizeMultiplier: defaultLevelSizeMultiplier,
+		RateLimit:           defaultRateLimit,
+		CompactionStrategy:  LeveledCompaction(),
+
+		MemTableType:            AVLMemTable,
+		MaxImmutableMemTables:   defaultMaxImmutableMemTables,
+		L0SlowdownWritesTrigger: defaultL0SlowdownWritesTrigger,
+		L0StopWritesTrigger:     defaultL0StopWritesTrigger,
+	}
+}
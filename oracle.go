@@ -1,28 +1,64 @@
 package db
 
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
 // oracle is struct that is responsible for Optimistic Concurrency Control for ACID Txns
 type oracle struct {
-	ts           uint64
-	reqChan      chan chan uint64
-	commitChan   chan *commitReq
-	commitedTxns *lru
-	db           *DB
+	ts            uint64
+	reqChan       chan chan uint64
+	doneChan      chan uint64
+	tsChan        chan chan uint64
+	watermarkChan chan chan uint64
+	statsChan     chan chan TxnStats
+	commitChan    chan *commitReq
+	indexChan     chan *indexReq
+	rewriteChan   chan *rewriteReq
+	advanceChan   chan uint64
+	commitedTxns  *lru
+	// activeTxns maps the start ts of every txn that is neither committed nor discarded to when it started
+	activeTxns map[uint64]time.Time
+	db         *DB
+
+	// close stops the oracle. Requests made after it is closed return ErrDBClosed
+	close   chan struct{}
+	runDone chan struct{}
 }
 
 type commitReq struct {
+	startTs   uint64
 	readSet   map[string]uint64
 	writeSet  map[string]*Entry
 	replyChan chan error
 }
 
+type rewriteReq struct {
+	fileID    uint32
+	keys      []string
+	replyChan chan error
+}
+
 // newOracle creates a new oracle that keeps track of current and committed Txns
 func newOracle(ts uint64, db *DB) *oracle {
 	oracle := &oracle{
-		ts:           ts,
-		reqChan:      make(chan chan uint64),
-		commitChan:   make(chan *commitReq),
-		commitedTxns: newLRU(oracleSize),
-		db:           db,
+		ts:            ts,
+		reqChan:       make(chan chan uint64),
+		doneChan:      make(chan uint64),
+		tsChan:        make(chan chan uint64),
+		watermarkChan: make(chan chan uint64),
+		statsChan:     make(chan chan TxnStats),
+		commitChan:    make(chan *commitReq),
+		indexChan:     make(chan *indexReq),
+		rewriteChan:   make(chan *rewriteReq),
+		advanceChan:   make(chan uint64),
+		commitedTxns:  newLRU(oracleSize),
+		activeTxns:    make(map[uint64]time.Time),
+		db:            db,
+		close:         make(chan struct{}),
+		runDone:       make(chan struct{}),
 	}
 	go oracle.run()
 	return oracle
@@ -34,31 +70,148 @@ func (oracle *oracle) next() uint64 {
 	return result
 }
 
+// requestStart returns the start ts of a new txn, or 0 once the oracle is stopped
 func (oracle *oracle) requestStart() uint64 {
 	replyChan := make(chan uint64, 1)
-	oracle.reqChan <- replyChan
-	return <-replyChan
+	select {
+	case oracle.reqChan <- replyChan:
+		return <-replyChan
+	case <-oracle.close:
+		return 0
+	}
+}
+
+// done marks the txn with the given start ts as committed or discarded
+func (oracle *oracle) done(startTs uint64) {
+	select {
+	case oracle.doneChan <- startTs:
+	case <-oracle.close:
+	}
+}
+
+// nextTs returns the ts the next txn will start at, or 0 once the oracle is stopped
+func (oracle *oracle) nextTs() uint64 {
+	replyChan := make(chan uint64, 1)
+	select {
+	case oracle.tsChan <- replyChan:
+		return <-replyChan
+	case <-oracle.close:
+		return 0
+	}
+}
+
+// watermark returns the start ts of the oldest active txn, or the next ts if there are no active txns.
+// No active or future txn can read a version that was overwritten before the watermark. It is 0 once the
+// oracle is stopped
+func (oracle *oracle) watermark() uint64 {
+	replyChan := make(chan uint64, 1)
+	select {
+	case oracle.watermarkChan <- replyChan:
+		return <-replyChan
+	case <-oracle.close:
+		return 0
+	}
+}
+
+// stats returns the active txns and the watermark they pin, or empty stats once the oracle is stopped
+func (oracle *oracle) stats() TxnStats {
+	replyChan := make(chan TxnStats, 1)
+	select {
+	case oracle.statsChan <- replyChan:
+		return <-replyChan
+	case <-oracle.close:
+		return TxnStats{}
+	}
 }
 
-func (oracle *oracle) commit(readSet map[string]uint64, writeSet map[string]*Entry) error {
+// commit checks the read set for conflicts and writes the write set. The txn with the given start ts is
+// no longer active afterwards. Writes that do not belong to a txn use a start ts of 0
+func (oracle *oracle) commit(startTs uint64, readSet map[string]uint64, writeSet map[string]*Entry) error {
 	replyChan := make(chan error, 1)
 	commitReq := &commitReq{
+		startTs:   startTs,
 		readSet:   readSet,
 		writeSet:  writeSet,
 		replyChan: replyChan,
 	}
-	oracle.commitChan <- commitReq
-	return <-replyChan
+	select {
+	case oracle.commitChan <- commitReq:
+		return <-replyChan
+	case <-oracle.close:
+		return newErrDBClosed()
+	}
+}
+
+// createIndex sends a new index backfilled as of the snapshot ts to the oracle, so it catches up with the commits
+// since then and writes the index without any concurrent commits
+func (oracle *oracle) createIndex(idx *index, snapshotTs uint64, entries map[string]*Entry) error {
+	replyChan := make(chan error, 1)
+	req := &indexReq{
+		index:      idx,
+		snapshotTs: snapshotTs,
+		entries:    entries,
+		replyChan:  replyChan,
+	}
+	select {
+	case oracle.indexChan <- req:
+		return <-replyChan
+	case <-oracle.close:
+		return newErrDBClosed()
+	}
+}
+
+// rewrite sends keys with live values in a value log file to the oracle so they are rewritten without any concurrent commits
+func (oracle *oracle) rewrite(fileID uint32, keys []string) error {
+	replyChan := make(chan error, 1)
+	req := &rewriteReq{
+		fileID:    fileID,
+		keys:      keys,
+		replyChan: replyChan,
+	}
+	select {
+	case oracle.rewriteChan <- req:
+		return <-replyChan
+	case <-oracle.close:
+		return newErrDBClosed()
+	}
+}
+
+// advance makes txns started afterwards see every version up to the given ts. A read only DB calls it once it
+// has replayed commits of the primary
+func (oracle *oracle) advance(ts uint64) {
+	select {
+	case oracle.advanceChan <- ts:
+	case <-oracle.close:
+	}
+}
+
+// stop stops the oracle once the request it is handling is done
+func (oracle *oracle) stop() {
+	close(oracle.close)
+	<-oracle.runDone
 }
 
 func (oracle *oracle) run() {
+	defer close(oracle.runDone)
 	for {
+		// Compactions read the watermark without waiting for the oracle, which may be blocked by a write stall
+		atomic.StoreUint64(&oracle.db.lsm.watermark, oracle.oldestTxn().Watermark)
 	SelectStatement:
 		select {
 		case replyChan := <-oracle.reqChan:
 			startID := oracle.next()
+			oracle.activeTxns[startID] = time.Now()
 			replyChan <- startID
+		case startTs := <-oracle.doneChan:
+			delete(oracle.activeTxns, startTs)
+		case replyChan := <-oracle.tsChan:
+			replyChan <- oracle.ts
+		case replyChan := <-oracle.watermarkChan:
+			replyChan <- oracle.oldestTxn().Watermark
+		case replyChan := <-oracle.statsChan:
+			replyChan <- oracle.oldestTxn()
 		case req := <-oracle.commitChan:
+			delete(oracle.activeTxns, req.startTs)
 			for key, ts := range req.readSet {
 				if lastCommit, ok := oracle.commitedTxns.Get(key); ok && lastCommit > ts {
 					req.replyChan <- newErrTxnAbort()
@@ -69,6 +222,12 @@ func (oracle *oracle) run() {
 					break SelectStatement
 				}
 			}
+			// The index entries are created before the commit ts is assigned, so a failure does not use it up
+			indexEntries, err := oracle.db.indexEntries(req.writeSet)
+			if err != nil {
+				req.replyChan <- err
+				break SelectStatement
+			}
 			entries := []*Entry{}
 			commitTs := oracle.next()
 			for key, entry := range req.writeSet {
@@ -76,7 +235,55 @@ func (oracle *oracle) run() {
 				entry.ts = commitTs
 				entries = append(entries, entry)
 			}
+			for _, entry := range indexEntries {
+				entry.ts = commitTs
+				entries = append(entries, entry)
+			}
 			req.replyChan <- oracle.db.write(entries)
+		case req := <-oracle.indexChan:
+			var err error
+			entries := req.entries
+			// Keys committed since the snapshot can only be listed while none of them were evicted. Otherwise the
+			// index is backfilled again with the latest values
+			if oracle.commitedTxns.maxTs > req.snapshotTs {
+				entries, err = oracle.db.backfillIndex(req.index, math.MaxUint64)
+			} else {
+				err = oracle.db.catchUpIndex(req.index, entries, oracle.commitedTxns.Since(req.snapshotTs))
+			}
+			if err != nil {
+				req.replyChan <- err
+				break SelectStatement
+			}
+			req.replyChan <- oracle.db.writeIndex(req.index, entries, oracle.next())
+		case req := <-oracle.rewriteChan:
+			commitTs := oracle.next()
+			entries, err := oracle.db.rewriteEntries(req.fileID, req.keys, commitTs)
+			if err != nil || len(entries) == 0 {
+				req.replyChan <- err
+				break SelectStatement
+			}
+			for _, entry := range entries {
+				oracle.commitedTxns.Insert(entry.Key, commitTs)
+			}
+			req.replyChan <- oracle.db.write(entries)
+		case ts := <-oracle.advanceChan:
+			if ts >= oracle.ts {
+				oracle.ts = ts + 1
+			}
+		case <-oracle.close:
+			return
+		}
+	}
+}
+
+// oldestTxn returns the amount of active txns and the start ts and age of the oldest one. Only oracle.run calls it
+func (oracle *oracle) oldestTxn() TxnStats {
+	stats := TxnStats{Active: len(oracle.activeTxns), Watermark: oracle.ts}
+	for startTs, started := range oracle.activeTxns {
+		if startTs < stats.Watermark {
+			stats.Watermark = startTs
+			stats.OldestAge = time.Since(started)
 		}
 	}
+	return stats
 }
@@ -0,0 +1,328 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// encodeOrdered converts a value into bytes whose lexicographical order matches the order of the values.
+// The data type is prepended so values of different types never interleave
+func encodeOrdered(value *Value) []byte {
+	data := value.Data
+	result := []byte{value.DataType}
+	switch value.DataType {
+	case Int:
+		if len(data) != 8 {
+			break
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, binary.LittleEndian.Uint64(data)^(1<<63))
+		return append(result, buf...)
+	case Uint:
+		if len(data) != 8 {
+			break
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, binary.LittleEndian.Uint64(data))
+		return append(result, buf...)
+	case Float:
+		if len(data) != 8 {
+			break
+		}
+		bits := binary.LittleEndian.Uint64(data)
+		// Negative floats sort in reverse, so flip all bits. Positive floats only need the sign bit set
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, bits)
+		return append(result, buf...)
+	}
+	return append(result, data...)
+}
+
+// compareValues returns -1, 0, or 1 depending on whether a is less than, equal to, or greater than b
+func compareValues(a, b *Value) int {
+	return bytes.Compare(encodeOrdered(a), encodeOrdered(b))
+}
+
+// Escaping lets variable length values be concatenated without changing their order.
+// Every 0x00 byte is followed by 0xff and each value ends with 0x00 0x01
+const (
+	escapeByte     = 0x00
+	escapedByte    = 0xff
+	terminatorByte = 0x01
+)
+
+func appendEscaped(data, value []byte) []byte {
+	for _, b := range value {
+		data = append(data, b)
+		if b == escapeByte {
+			data = append(data, escapedByte)
+		}
+	}
+	return append(data, escapeByte, terminatorByte)
+}
+
+// readEscaped reads one escaped value from the start of data and returns it along with the bytes consumed
+func readEscaped(data []byte) (value []byte, n int, err error) {
+	i := 0
+	for i < len(data) {
+		if data[i] != escapeByte {
+			value = append(value, data[i])
+			i++
+			continue
+		}
+		if i+1 >= len(data) {
+			break
+		}
+		switch data[i+1] {
+		case escapedByte:
+			value = append(value, escapeByte)
+			i += 2
+		case terminatorByte:
+			return value, i + 2, nil
+		default:
+			return nil, 0, newErrDecodeEntry()
+		}
+	}
+	return nil, 0, newErrDecodeEntry()
+}
+
+// decodeOrdered converts bytes created by encodeOrdered, without the data type, back into a Value
+func decodeOrdered(dataType uint8, data []byte) (*Value, error) {
+	switch dataType {
+	case Int, Uint, Float:
+		if len(data) != 8 {
+			return nil, newErrIncorrectValueSize(dataType, len(data))
+		}
+		bits := binary.BigEndian.Uint64(data)
+		switch dataType {
+		case Int:
+			bits ^= 1 << 63
+		case Float:
+			if bits&(1<<63) != 0 {
+				bits &^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+		}
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, bits)
+		return &Value{DataType: dataType, Data: value}, nil
+	default:
+		return &Value{DataType: dataType, Data: data}, nil
+	}
+}
+
+func encodeTime(t time.Time) []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint64(data[:8], uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(data[8:], uint32(t.Nanosecond()))
+	return data
+}
+
+func decodeTime(data []byte) (time.Time, error) {
+	if len(data) != 12 {
+		return time.Time{}, newErrIncorrectValueSize(Time, len(data))
+	}
+	seconds := int64(binary.BigEndian.Uint64(data[:8]) ^ (1 << 63))
+	nanoseconds := int64(binary.BigEndian.Uint32(data[8:]))
+	return time.Unix(seconds, nanoseconds).UTC(), nil
+}
+
+// Decimals are encoded as a sign byte, the exponent of the most significant digit, and the digits.
+// Negative decimals have their exponent and digits inverted and a terminator so larger magnitudes sort first
+const (
+	decimalNegative byte = iota
+	decimalZero
+	decimalPositive
+)
+
+func encodeDecimal(d FixedPoint) []byte {
+	if d.Unscaled == 0 {
+		return []byte{decimalZero}
+	}
+	// Strip trailing zeros so equal decimals with different scales have the same encoding
+	coefficient := d.Unscaled
+	exponent := -int(d.Scale)
+	for coefficient%10 == 0 {
+		coefficient /= 10
+		exponent++
+	}
+	sign := decimalPositive
+	magnitude := uint64(coefficient)
+	if coefficient < 0 {
+		sign = decimalNegative
+		magnitude = uint64(-coefficient)
+	}
+	digits := []byte(strconv.FormatUint(magnitude, 10))
+	adjusted := make([]byte, 2)
+	binary.BigEndian.PutUint16(adjusted, uint16(exponent+len(digits)-1-math.MinInt16))
+
+	data := append([]byte{sign}, adjusted...)
+	data = append(data, digits...)
+	if sign == decimalNegative {
+		for i := 1; i < len(data); i++ {
+			data[i] = ^data[i]
+		}
+		data = append(data, 0xff)
+	}
+	return data
+}
+
+func decodeDecimal(data []byte) (FixedPoint, error) {
+	if len(data) == 1 && data[0] == decimalZero {
+		return FixedPoint{}, nil
+	}
+	if len(data) < 4 {
+		return FixedPoint{}, newErrIncorrectValueSize(Decimal, len(data))
+	}
+	sign := data[0]
+	body := make([]byte, len(data)-1)
+	copy(body, data[1:])
+	if sign == decimalNegative {
+		if body[len(body)-1] != 0xff {
+			return FixedPoint{}, newErrIncompatibleValue(Decimal)
+		}
+		body = body[:len(body)-1]
+		for i := range body {
+			body[i] = ^body[i]
+		}
+	} else if sign != decimalPositive {
+		return FixedPoint{}, newErrIncompatibleValue(Decimal)
+	}
+	if len(body) < 3 {
+		return FixedPoint{}, newErrIncorrectValueSize(Decimal, len(data))
+	}
+	adjusted := int(binary.BigEndian.Uint16(body[:2])) + math.MinInt16
+	digits := string(body[2:])
+	magnitude, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil || magnitude > 1<<63 || (magnitude == 1<<63 && sign == decimalPositive) {
+		return FixedPoint{}, newErrIncompatibleValue(Decimal)
+	}
+	coefficient := int64(magnitude)
+	if sign == decimalNegative {
+		coefficient = -coefficient
+	}
+	exponent := adjusted - len(digits) + 1
+	for ; exponent > 0; exponent-- {
+		if coefficient > math.MaxInt64/10 || coefficient < math.MinInt64/10 {
+			return FixedPoint{}, newErrIncompatibleValue(Decimal)
+		}
+		coefficient *= 10
+	}
+	if -exponent > math.MaxUint8 {
+		return FixedPoint{}, newErrIncompatibleValue(Decimal)
+	}
+	return FixedPoint{Unscaled: coefficient, Scale: uint8(-exponent)}, nil
+}
+
+// encodeList encodes a homogeneous list as the element type followed by each escaped element.
+// An empty list has no bytes so it sorts before every other list
+func encodeList(elements []interface{}) ([]byte, error) {
+	data := []byte{}
+	for i, element := range elements {
+		value, err := CreateValue(element)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			data = append(data, value.DataType)
+		} else if value.DataType != data[0] {
+			return nil, newErrHeterogeneousList(data[0], value.DataType)
+		}
+		data = appendEscaped(data, encodeOrdered(value)[1:])
+	}
+	return data, nil
+}
+
+func decodeList(data []byte) ([]interface{}, error) {
+	elements := []interface{}{}
+	if len(data) == 0 {
+		return elements, nil
+	}
+	dataType := data[0]
+	i := 1
+	for i < len(data) {
+		element, n, err := readEscaped(data[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		value, err := decodeOrdered(dataType, element)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseElement(value)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, parsed)
+	}
+	return elements, nil
+}
+
+// encodeMap encodes a nested document as its escaped names, in sorted order, each followed by its escaped typed value
+func encodeMap(document map[string]interface{}) ([]byte, error) {
+	names := []string{}
+	for name := range document {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data := []byte{}
+	for _, name := range names {
+		value, err := CreateValue(document[name])
+		if err != nil {
+			return nil, err
+		}
+		data = appendEscaped(data, []byte(name))
+		data = appendEscaped(data, encodeOrdered(value))
+	}
+	return data, nil
+}
+
+func decodeMap(data []byte) (map[string]interface{}, error) {
+	document := make(map[string]interface{})
+	i := 0
+	for i < len(data) {
+		name, n, err := readEscaped(data[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		element, n, err := readEscaped(data[i:])
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		if len(element) < 1 {
+			return nil, newErrDecodeEntry()
+		}
+		value, err := decodeOrdered(element[0], element[1:])
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseElement(value)
+		if err != nil {
+			return nil, err
+		}
+		document[string(name)] = parsed
+	}
+	return document, nil
+}
+
+// parseElement parses an element of a list or nested document. A nil element is stored as a tombstone, so it
+// parses back to nil
+func parseElement(value *Value) (interface{}, error) {
+	if value.DataType == Tombstone {
+		return nil, nil
+	}
+	return ParseValue(value)
+}
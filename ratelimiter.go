@@ -0,0 +1,130 @@
+package db
+
+import "time"
+
+// ioPriority is the priority of a rate limited write. Waiting writes of a higher priority are granted first
+type ioPriority int
+
+const (
+	// compactionPriority is the priority of SST files written by compaction
+	compactionPriority ioPriority = iota
+	// flushPriority is the priority of SST files written by memtable flushes, which block writes when they fall behind
+	flushPriority
+	numPriorities
+)
+
+// rateLimiter is a token bucket shared by flushes and compactions so their writes do not use up the disk bandwidth
+// needed by reads. Every refill period, the bucket is filled with a period's worth of bytes. Writes wait until the
+// bucket has tokens, and may take more than it holds, so large writes are not starved but delay the writes after them
+type rateLimiter struct {
+	requestChan chan *rateRequest
+	setChan     chan int
+	close       chan struct{}
+	done        chan struct{}
+}
+
+type rateRequest struct {
+	bytes    int
+	priority ioPriority
+	granted  chan struct{}
+}
+
+// newRateLimiter creates a rate limiter that allows bytesPerSec bytes to be written every second. 0 does not limit writes
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	rl := &rateLimiter{
+		requestChan: make(chan *rateRequest),
+		setChan:     make(chan int),
+		close:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go rl.run(bytesPerSec)
+	return rl
+}
+
+// request blocks until the given amount of bytes may be written
+func (rl *rateLimiter) request(bytes int, priority ioPriority) {
+	req := &rateRequest{
+		bytes:    bytes,
+		priority: priority,
+		granted:  make(chan struct{}),
+	}
+	select {
+	case rl.requestChan <- req:
+		select {
+		case <-req.granted:
+		case <-rl.done:
+		}
+	case <-rl.done:
+	}
+}
+
+// setRate changes the amount of bytes allowed every second. Writes that are waiting are granted at the new rate
+func (rl *rateLimiter) setRate(bytesPerSec int) {
+	select {
+	case rl.setChan <- bytesPerSec:
+	case <-rl.done:
+	}
+}
+
+// Close stops the rate limiter. Writes waiting on it and all writes after it are no longer limited
+func (rl *rateLimiter) Close() {
+	close(rl.close)
+	<-rl.done
+}
+
+func (rl *rateLimiter) run(bytesPerSec int) {
+	defer close(rl.done)
+	ticker := time.NewTicker(rateLimiterRefillPeriod)
+	defer ticker.Stop()
+
+	refill := func() int {
+		return int(int64(bytesPerSec) * int64(rateLimiterRefillPeriod) / int64(time.Second))
+	}
+	available := refill()
+	queues := make([][]*rateRequest, numPriorities)
+
+	grant := func() {
+		for priority := numPriorities - 1; priority >= 0; priority-- {
+			for len(queues[priority]) > 0 {
+				if bytesPerSec > 0 && available <= 0 {
+					return
+				}
+				req := queues[priority][0]
+				queues[priority] = queues[priority][1:]
+				if bytesPerSec > 0 {
+					available -= req.bytes
+				}
+				close(req.granted)
+			}
+		}
+	}
+
+	for {
+		select {
+		case req := <-rl.requestChan:
+			queues[req.priority] = append(queues[req.priority], req)
+			grant()
+		case rate := <-rl.setChan:
+			bytesPerSec = rate
+			if available > refill() {
+				available = refill()
+			}
+			grant()
+		case <-ticker.C:
+			// Tokens are not saved up past one period, otherwise an idle limiter would allow a burst of writes
+			available += refill()
+			if available > refill() {
+				available = refill()
+			}
+			grant()
+		case <-rl.close:
+			return
+		}
+	}
+}
+
+// SetRateLimit changes the max bytes per second written by memtable flushes and compactions while the database is
+// open. 0 stops limiting them
+func (db *DB) SetRateLimit(bytesPerSec int) {
+	db.lsm.SetRateLimit(bytesPerSec)
+}
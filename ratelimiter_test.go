@@ -0,0 +1,102 @@
+package db
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(MB)
+	defer rl.Close()
+
+	// A period's worth of bytes is available at once, the rest waits on refills
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		rl.request(100*KB, compactionPriority)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("Expected 500KB at 1MB/s to take at least 300ms, Got: %v\n", elapsed)
+	}
+
+	// Raising the rate lets waiting writes through faster
+	rl.setRate(100 * MB)
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		rl.request(100*KB, compactionPriority)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Fatalf("Expected 1MB at 100MB/s to take less than 200ms, Got: %v\n", elapsed)
+	}
+
+	rl.setRate(0)
+	start = time.Now()
+	rl.request(100*MB, compactionPriority)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("Expected unlimited write to not wait, Got: %v\n", elapsed)
+	}
+}
+
+func TestRateLimiterPriority(t *testing.T) {
+	rl := newRateLimiter(100 * KB)
+	defer rl.Close()
+
+	// Use up the bucket so the following requests have to wait
+	rl.request(20*KB, compactionPriority)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	order := []ioPriority{}
+	request := func(priority ioPriority) {
+		defer wg.Done()
+		rl.request(10*KB, priority)
+		lock.Lock()
+		order = append(order, priority)
+		lock.Unlock()
+	}
+	wg.Add(2)
+	go request(compactionPriority)
+	time.Sleep(20 * time.Millisecond)
+	go request(flushPriority)
+	wg.Wait()
+
+	if order[0] != flushPriority {
+		t.Fatalf("Expected flush to be granted before compaction, Got order: %v\n", order)
+	}
+}
+
+func TestDBRateLimit(t *testing.T) {
+	opts := DefaultOptions()
+	opts.RateLimit = 10 * MB
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	numKeys := 1000
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	db.SetRateLimit(100 * MB)
+	err = db.CompactRange("10000", "10999")
+	if err != nil {
+		t.Fatalf("Error compacting range: %v\n", err)
+	}
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(10000 + i)
+		entry, err := db.Read(key, []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != key {
+			t.Fatalf("Value expected: %v, Got: %v\n", key, string(entry.Attributes["value"].Data))
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// replica is the state of a DB opened read only on the directory of a primary DB, which may still be running.
+// The WALs of the primary are replayed into memtables that are never flushed, and its SST files are read in
+// place. Only a secondary instance catches up with the primary after it is opened
+type replica struct {
+	secondary bool
+	// wals are the memtables replayed from the WALs of the primary, by WAL id
+	wals map[uint64]*replayedWAL
+	lock sync.Mutex
+}
+
+// replayedWAL is a memtable holding the entries of a WAL replayed so far. The size of the memtable is the
+// amount of bytes of the WAL replayed
+type replayedWAL struct {
+	mt          *memTable
+	maxCommitTs uint64
+}
+
+// OpenReadOnly opens the database in the directory read only with the default options
+func OpenReadOnly(directory string) (*DB, error) {
+	return OpenReadOnlyWithOptions(directory, DefaultOptions())
+}
+
+// OpenReadOnlyWithOptions opens the database in the directory read only. It reads the directory while another DB
+// may have it open and never changes it: WALs are replayed into memory, and memtables are never flushed or
+// compacted. Writes return ErrReadOnly. Reads see the database as it was when it was opened. Reads of SST files
+// the primary removed since then by compacting them return an error
+func OpenReadOnlyWithOptions(directory string, opts *Options) (*DB, error) {
+	return openReplica(directory, opts, false)
+}
+
+// OpenSecondary opens the database in the directory as a secondary instance with the default options
+func OpenSecondary(directory string) (*DB, error) {
+	return OpenSecondaryWithOptions(directory, DefaultOptions())
+}
+
+// OpenSecondaryWithOptions opens the database in the directory read only, like OpenReadOnlyWithOptions, as a
+// secondary instance of the primary DB that has it open. TryCatchUp makes writes of the primary since it was
+// opened visible, and should be called often enough that the primary does not compact away the SST files it reads
+func OpenSecondaryWithOptions(directory string, opts *Options) (*DB, error) {
+	return openReplica(directory, opts, true)
+}
+
+// openReplica opens a read only DB without locking the directory and catches up with the primary once
+func openReplica(directory string, opts *Options, secondary bool) (*DB, error) {
+	_, err := os.Stat(directory)
+	if err != nil {
+		return nil, err
+	}
+	lsm, err := newLSM(directory, opts, true)
+	if err != nil {
+		return nil, err
+	}
+	vlog, err := newValueLog(directory, opts, true)
+	if err != nil {
+		lsm.Close()
+		return nil, err
+	}
+
+	db := &DB{
+		directory: directory,
+		opts:      opts,
+		lsm:       lsm,
+		vlog:      vlog,
+		snaphots:  newDoublyLinkedList(),
+
+		mutable: &memTable{table: newMemStore(opts.MemTableType)},
+
+		indexes: make(map[string]*index),
+		schemas: make(map[string]*Schema),
+
+		wc: &writeController{},
+
+		closing: make(chan struct{}),
+
+		replica: &replica{
+			secondary: secondary,
+			wals:      make(map[uint64]*replayedWAL),
+		},
+	}
+	db.oracle = newOracle(1, db)
+
+	err = db.catchUp()
+	if err == nil {
+		err = db.loadIndexes()
+	}
+	if err == nil {
+		err = db.loadSchemas()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// TryCatchUp makes the writes of the primary since the last catch up visible to txns started afterwards. It
+// replays new WAL entries, adds the SST files written by flushes and compactions, and drops the memtables and
+// SST files the primary removed. It returns ErrNotSecondary unless the DB was opened with OpenSecondary
+func (db *DB) TryCatchUp() error {
+	err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+	if db.replica == nil || !db.replica.secondary {
+		return newErrNotSecondary()
+	}
+	err = db.catchUp()
+	if err != nil {
+		return err
+	}
+	err = db.loadIndexes()
+	if err != nil {
+		return err
+	}
+	return db.loadSchemas()
+}
+
+// acquireWrite is acquire for operations that write to the DB. It returns ErrReadOnly if the DB was opened read only
+func (db *DB) acquireWrite() error {
+	err := db.acquire()
+	if err != nil {
+		return err
+	}
+	if db.replica != nil {
+		db.release()
+		return newErrReadOnly()
+	}
+	return nil
+}
+
+// catchUp brings a read only DB up to date with the directory. Nothing is removed before everything that replaces
+// it is visible: new value log files are opened before the WAL entries and SST files pointing into them are added,
+// and memtables and SST files are only dropped once the files they were flushed or compacted into are added.
+// Memtables are published last, all at once
+func (db *DB) catchUp() error {
+	r := db.replica
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := db.vlog.openFiles()
+	if err != nil {
+		return err
+	}
+	maxCommitTs, err := db.replayWALs()
+	if err != nil {
+		return err
+	}
+	for {
+		ts, err := db.lsm.catchUp()
+		if err != nil {
+			return err
+		}
+		if ts > maxCommitTs {
+			maxCommitTs = ts
+		}
+		// A memtable would hide newer versions flushed after its WAL, so memtables whose WAL was removed by a
+		// flush are dropped. The flush may have written its file after the levels were listed, so they are
+		// listed again until no WAL is removed in between
+		if !db.dropRemovedWALs() {
+			break
+		}
+	}
+
+	mts := []*memTable{}
+	replayed := []*replayedWAL{}
+	for _, wal := range r.wals {
+		if wal.mt.size > 0 {
+			replayed = append(replayed, wal)
+		}
+	}
+	sort.Slice(replayed, func(i, j int) bool {
+		return replayed[i].maxCommitTs < replayed[j].maxCommitTs
+	})
+	for _, wal := range replayed {
+		mts = append(mts, wal.mt)
+	}
+	db.memLock.Lock()
+	db.immutables = mts
+	db.memLock.Unlock()
+
+	err = db.vlog.closeRemovedFiles()
+	if err != nil {
+		return err
+	}
+	db.oracle.advance(maxCommitTs)
+	return nil
+}
+
+// replayWALs replays the entries appended to the WALs of the primary since the last catch up. WALs the primary
+// removed are dropped from r.wals but their memtables stay visible until catchUp replaces them. It returns the
+// max commit ts replayed
+func (db *DB) replayWALs() (maxCommitTs uint64, err error) {
+	r := db.replica
+	files, err := ioutil.ReadDir(filepath.Join(db.directory, "memtables"))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	present := make(map[uint64]struct{})
+	for _, file := range files {
+		id, err := strconv.ParseUint(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		walName := filepath.Join(db.directory, "memtables", file.Name())
+		data, err := ioutil.ReadFile(walName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		wal, ok := r.wals[id]
+		// The WAL id is reused if the primary removed the WAL it was replayed from and restarted
+		if !ok || len(data) < wal.mt.size {
+			wal = &replayedWAL{
+				mt: &memTable{table: newMemStore(db.opts.MemTableType), walName: walName},
+			}
+		}
+		entries, n, err := replayWAL(data[wal.mt.size:])
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			wal.mt.put(entry)
+			if entry.ts > wal.maxCommitTs {
+				wal.maxCommitTs = entry.ts
+			}
+		}
+		wal.mt.size += n
+		if wal.maxCommitTs > maxCommitTs {
+			maxCommitTs = wal.maxCommitTs
+		}
+		r.wals[id] = wal
+		present[id] = struct{}{}
+	}
+	for id := range r.wals {
+		if _, ok := present[id]; !ok {
+			delete(r.wals, id)
+		}
+	}
+	return maxCommitTs, nil
+}
+
+// dropRemovedWALs drops the replayed WALs the primary removed since they were replayed. It returns whether any were
+func (db *DB) dropRemovedWALs() bool {
+	dropped := false
+	for id, wal := range db.replica.wals {
+		if _, err := os.Stat(wal.mt.walName); os.IsNotExist(err) {
+			delete(db.replica.wals, id)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// catchUp adds the SST files the primary wrote since the last catch up to all levels, then removes the files it
+// deleted. It returns the max commit ts of the added files
+func (lsm *lsm) catchUp() (maxCommitTs uint64, err error) {
+	removed := make([][]string, len(lsm.levels))
+	for i, level := range lsm.levels {
+		added, gone, err := level.changedSSTFiles()
+		if err != nil {
+			return 0, err
+		}
+		kept := []*sstFile{}
+		for _, file := range added {
+			ts, err := lsm.maxTs(file)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			if ts > maxCommitTs {
+				maxCommitTs = ts
+			}
+			kept = append(kept, file)
+		}
+		level.ReplaceSSTFiles(kept, nil)
+		removed[i] = gone
+	}
+	for i, level := range lsm.levels {
+		level.ReplaceSSTFiles(nil, removed[i])
+		for _, file := range removed[i] {
+			lsm.fm.Evict(file)
+		}
+	}
+	return maxCommitTs, nil
+}
+
+// maxTs returns the newest ts of the entries of an SST file. Files written before it was recorded in their key
+// range are read in full
+func (lsm *lsm) maxTs(file *sstFile) (uint64, error) {
+	if file.keyRange.maxTs > 0 {
+		return file.keyRange.maxTs, nil
+	}
+	entries, err := lsm.fm.MMap(file.filename)
+	if err != nil {
+		return 0, err
+	}
+	maxTs := uint64(0)
+	for _, entry := range entries {
+		if entry.ts > maxTs {
+			maxTs = entry.ts
+		}
+	}
+	return maxTs, nil
+}
+
+// changedSSTFiles compares the files in the directory of the level with its manifest. It returns the files that
+// are not in the manifest yet and the files of the manifest that are no longer in the directory. Files that
+// cannot be read yet are still being written by the primary and are left for the next catch up
+func (level *level) changedSSTFiles() (added []*sstFile, removed []string, err error) {
+	infos, err := ioutil.ReadDir(level.directory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	present := make(map[string]struct{})
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".sst") {
+			continue
+		}
+		fileID := strings.TrimSuffix(info.Name(), ".sst")
+		present[fileID] = struct{}{}
+
+		level.manifestLock.RLock()
+		_, ok := level.manifest[fileID]
+		level.manifestLock.RUnlock()
+		if ok {
+			continue
+		}
+		filename := filepath.Join(level.directory, info.Name())
+		keyRange, bloom, size, err := recoverFile(filename)
+		if err != nil {
+			continue
+		}
+		added = append(added, &sstFile{
+			fileID:   fileID,
+			filename: filename,
+			keyRange: keyRange,
+			bloom:    bloom,
+			size:     size,
+		})
+	}
+
+	level.manifestLock.RLock()
+	defer level.manifestLock.RUnlock()
+	for fileID := range level.manifest {
+		if _, ok := present[fileID]; !ok {
+			removed = append(removed, filepath.Join(level.directory, fileID+".sst"))
+		}
+	}
+	return added, removed, nil
+}
+
+// closeRemovedFiles closes the value log files the primary removed
+func (vlog *valueLog) closeRemovedFiles() error {
+	fileIDs, err := vlog.fileIDs()
+	if err != nil {
+		return err
+	}
+	vlog.fileLock.Lock()
+	defer vlog.fileLock.Unlock()
+	for id, f := range vlog.files {
+		if _, ok := fileIDs[id]; ok {
+			continue
+		}
+		delete(vlog.files, id)
+		err := f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// writeLargeValues writes a version of a large value for the first numKeys keys, a few keys per txn
+func writeLargeValues(db *DB, numKeys, version int) error {
+	for i := 0; i < numKeys; i += 10 {
+		err := db.UpdateTxn(func(txn *Txn) error {
+			for j := i; j < i+10 && j < numKeys; j++ {
+				key := strconv.Itoa(j)
+				err := txn.Write(key, map[string]*Value{"value": largeValue(key, version)})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listDirectory returns the size of every file in the directory tree by path
+func listDirectory(directory string) (map[string]int64, error) {
+	files := make(map[string]int64)
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files[path] = info.Size()
+		}
+		return nil
+	})
+	return files, err
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	// Without compaction, the primary never removes SST files the read only DB may read
+	opts := DefaultOptions()
+	opts.ValueThreshold = 64
+	opts.CompactionStrategy = &noCompaction{}
+	opts.L0SlowdownWritesTrigger = 1000
+	opts.L0StopWritesTrigger = 1000
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	// Half of the values are flushed to level 0 and the value log, the other half are only in WALs
+	err = writeLargeValues(db, 100, 1)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	err = writeLargeValues(db, 50, 2)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+
+	readOnly, err := OpenReadOnly("data")
+	if err != nil {
+		t.Fatalf("Error opening DB read only: %v\n", err)
+	}
+	err = checkLargeValues(readOnly, 50, 2)
+	if err != nil {
+		t.Fatalf("Error reading values replayed from WALs: %v\n", err)
+	}
+	err = readOnly.ViewTxn(func(txn *Txn) error {
+		for i := 50; i < 100; i++ {
+			key := strconv.Itoa(i)
+			entry, err := txn.Read(key)
+			if err != nil {
+				return err
+			}
+			if string(entry.Attributes["value"].Data) != string(largeValue(key, 1).Data) {
+				t.Fatalf("Wrong value for key: %v\n", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error reading flushed values: %v\n", err)
+	}
+
+	checkReadOnly := func(op string, err error) {
+		if _, ok := err.(*ErrReadOnly); !ok {
+			t.Fatalf("Expected %s to return ErrReadOnly, Got: %v\n", op, err)
+		}
+	}
+	value, _ := CreateValue("value")
+	checkReadOnly("insert", readOnly.Insert("new", map[string]*Value{"value": value}))
+	checkReadOnly("delete", readOnly.Delete("0"))
+	checkReadOnly("flush", readOnly.Flush())
+	checkReadOnly("compact range", readOnly.CompactRange("0", "99"))
+	checkReadOnly("value log gc", readOnly.RunValueLogGC(0.5))
+	checkReadOnly("set schema", readOnly.SetSchema(&Schema{Prefix: "user:"}))
+	if _, ok := readOnly.TryCatchUp().(*ErrNotSecondary); !ok {
+		t.Fatalf("Expected catch up of a read only DB to return ErrNotSecondary\n")
+	}
+
+	// The primary keeps writing while the read only DB is open, which keeps reading what it replayed
+	err = writeLargeValues(db, 100, 3)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = checkLargeValues(readOnly, 50, 2)
+	if err != nil {
+		t.Fatalf("Error reading from read only db after primary writes: %v\n", err)
+	}
+	err = readOnly.Close()
+	if err != nil {
+		t.Fatalf("Error closing read only db: %v\n", err)
+	}
+	err = checkLargeValues(db, 100, 3)
+	if err != nil {
+		t.Fatalf("Error reading from db: %v\n", err)
+	}
+
+	// Once the primary is closed, opening read only does not change any file
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Error closing db: %v\n", err)
+	}
+	before, err := listDirectory("data")
+	if err != nil {
+		t.Fatalf("Error listing directory: %v\n", err)
+	}
+	readOnly, err = OpenReadOnly("data")
+	if err != nil {
+		t.Fatalf("Error opening DB read only: %v\n", err)
+	}
+	err = checkLargeValues(readOnly, 100, 3)
+	if err != nil {
+		t.Fatalf("Error reading from read only db: %v\n", err)
+	}
+	err = readOnly.Close()
+	if err != nil {
+		t.Fatalf("Error closing read only db: %v\n", err)
+	}
+	after, err := listDirectory("data")
+	if err != nil {
+		t.Fatalf("Error listing directory: %v\n", err)
+	}
+	if len(before) != len(after) {
+		t.Fatalf("Expected read only open to keep all files, Got: %d files before, %d after\n", len(before), len(after))
+	}
+	for path, size := range before {
+		if after[path] != size {
+			t.Fatalf("Expected %s to stay %d bytes, Got: %d\n", path, size, after[path])
+		}
+	}
+}
+
+func TestSecondaryCatchUp(t *testing.T) {
+	// Only the manual compaction removes SST files, so reads before catching up do not race with compactions
+	opts := DefaultOptions()
+	opts.ValueThreshold = 64
+	opts.CompactionStrategy = &noCompaction{}
+	opts.L0SlowdownWritesTrigger = 1000
+	opts.L0StopWritesTrigger = 1000
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	err = writeLargeValues(db, 100, 1)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	secondary, err := OpenSecondary("data")
+	if err != nil {
+		t.Fatalf("Error opening secondary: %v\n", err)
+	}
+	defer secondary.Close()
+	err = checkLargeValues(secondary, 100, 1)
+	if err != nil {
+		t.Fatalf("Error reading from secondary: %v\n", err)
+	}
+
+	// Writes in the mutable memtable of the primary are only seen after catching up
+	err = writeLargeValues(db, 100, 2)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = checkLargeValues(secondary, 100, 1)
+	if err != nil {
+		t.Fatalf("Expected secondary to read old values before catching up: %v\n", err)
+	}
+	err = secondary.TryCatchUp()
+	if err != nil {
+		t.Fatalf("Error catching up: %v\n", err)
+	}
+	err = checkLargeValues(secondary, 100, 2)
+	if err != nil {
+		t.Fatalf("Error reading from secondary after catching up: %v\n", err)
+	}
+
+	// Flushes remove WALs and compactions remove SST files the secondary is reading
+	err = writeLargeValues(db, 100, 3)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = db.CompactRange("0", "99")
+	if err != nil {
+		t.Fatalf("Error compacting db: %v\n", err)
+	}
+	err = writeLargeValues(db, 50, 4)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	err = secondary.TryCatchUp()
+	if err != nil {
+		t.Fatalf("Error catching up: %v\n", err)
+	}
+	err = checkLargeValues(secondary, 50, 4)
+	if err != nil {
+		t.Fatalf("Error reading from secondary after compaction: %v\n", err)
+	}
+	err = secondary.ViewTxn(func(txn *Txn) error {
+		for i := 50; i < 100; i++ {
+			key := strconv.Itoa(i)
+			entry, err := txn.Read(key)
+			if err != nil {
+				return err
+			}
+			if string(entry.Attributes["value"].Data) != string(largeValue(key, 3).Data) {
+				t.Fatalf("Wrong value for key: %v\n", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error reading compacted values from secondary: %v\n", err)
+	}
+
+	// Once the primary is done flushing, the secondary has the same SST files
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	err = secondary.TryCatchUp()
+	if err != nil {
+		t.Fatalf("Error catching up: %v\n", err)
+	}
+	for i, level := range secondary.lsm.levels {
+		files, err := ioutil.ReadDir(level.directory)
+		if err != nil {
+			t.Fatalf("Error reading level directory: %v\n", err)
+		}
+		if level.numFiles() != len(files) {
+			t.Fatalf("Expected secondary level %d to have %d files, Got: %d\n", i, len(files), level.numFiles())
+		}
+	}
+}
+
+func TestReplayWALPartial(t *testing.T) {
+	data := []byte{}
+	for i := 0; i < 3; i++ {
+		data = append(data, encodeEntry(simpleEntry(uint64(i+1), strconv.Itoa(i), "value"))...)
+	}
+	full := len(data)
+	for cut := 0; cut <= full; cut++ {
+		entries, n, err := replayWAL(data[:cut])
+		if err != nil {
+			t.Fatalf("Error replaying WAL cut at %d bytes: %v\n", cut, err)
+		}
+		if n > cut {
+			t.Fatalf("Expected at most %d bytes replayed, Got: %d\n", cut, n)
+		}
+		if cut == full && (len(entries) != 3 || n != full) {
+			t.Fatalf("Expected all 3 entries replayed, Got: %d entries in %d bytes\n", len(entries), n)
+		}
+	}
+}
@@ -107,11 +107,15 @@ func TestRecoverUnexpected(t *testing.T) {
 				txn.Write(key, map[string]*Value{"value": &Value{DataType: String, Data: []byte(key)}})
 				return nil
 			})
+			if _, ok := err.(*ErrDBClosed); ok {
+				return
+			}
 			if err != nil {
-				t.Fatalf("Error inserting into lsm: %v\n", err)
-			} else {
-				memorykv[key] = key
+				fmt.Printf("Error inserting into lsm: %v\n", err)
+				success = false
+				return
 			}
+			memorykv[key] = key
 		}
 	}()
 
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+const schemaMetaPrefix = internalPrefix + "meta\x00schema\x00"
+
+// Schema declares the attributes of every entry whose key starts with Prefix.
+// When multiple schemas match a key, the one with the longest prefix is enforced
+type Schema struct {
+	Prefix     string
+	Attributes map[string]*AttributeSchema
+	// Strict rejects entries with attributes that are not declared in the schema
+	Strict bool
+}
+
+// AttributeSchema declares the type of an attribute and what happens when an entry is missing it.
+// A missing attribute is set to Default if there is one, otherwise it is a violation if Required
+type AttributeSchema struct {
+	DataType uint8
+	Required bool
+	Default  *Value
+}
+
+func isSchemaType(dataType uint8) bool {
+	switch dataType {
+	case Bool, Int, Uint, Float, String, Bytes, Time, Decimal, List, Map:
+		return true
+	default:
+		return false
+	}
+}
+
+// validate checks that every declared attribute has a supported type and a well formed default value
+func (schema *Schema) validate() error {
+	if len(schemaMetaPrefix+schema.Prefix) > KeySize {
+		return newErrInvalidSchema(schema.Prefix, "prefix is too long")
+	}
+	for name, attribute := range schema.Attributes {
+		if attribute == nil {
+			return newErrInvalidSchema(schema.Prefix, "attribute "+name+" has no declaration")
+		}
+		if !isSchemaType(attribute.DataType) {
+			return newErrInvalidSchema(schema.Prefix, "attribute "+name+" has unsupported type "+dataTypeName(attribute.DataType))
+		}
+		if attribute.Default == nil {
+			continue
+		}
+		if attribute.Default.DataType != attribute.DataType {
+			return newErrInvalidSchema(schema.Prefix, "default of attribute "+name+" is not "+dataTypeName(attribute.DataType))
+		}
+		if _, err := ParseValue(attribute.Default); err != nil {
+			return newErrInvalidSchema(schema.Prefix, "default of attribute "+name+" is malformed")
+		}
+	}
+	return nil
+}
+
+// apply returns the attributes of an entry with defaults filled in or an ErrSchemaViolation.
+// A declared attribute cannot be cleared with a nil or Tombstone value, undeclared ones are kept unchanged.
+// The given attributes are never modified
+func (schema *Schema) apply(key string, attributes map[string]*Value) (map[string]*Value, error) {
+	result := make(map[string]*Value)
+	for name, value := range attributes {
+		attribute, ok := schema.Attributes[name]
+		if !ok {
+			if schema.Strict {
+				return nil, newErrSchemaViolation(key, name, "attribute is not declared")
+			}
+			result[name] = value
+			continue
+		}
+		if value == nil {
+			return nil, newErrSchemaViolation(key, name, "expected "+dataTypeName(attribute.DataType)+" but got nil")
+		}
+		if value.DataType != attribute.DataType {
+			return nil, newErrSchemaViolation(key, name, "expected "+dataTypeName(attribute.DataType)+" but got "+dataTypeName(value.DataType))
+		}
+		if _, err := ParseValue(value); err != nil {
+			return nil, newErrSchemaViolation(key, name, "value is malformed")
+		}
+		result[name] = value
+	}
+	for name, attribute := range schema.Attributes {
+		if _, ok := result[name]; ok {
+			continue
+		}
+		if attribute.Default != nil {
+			result[name] = attribute.Default
+		} else if attribute.Required {
+			return nil, newErrSchemaViolation(key, name, "required attribute is missing")
+		}
+	}
+	return result, nil
+}
+
+// encodeSchema encodes the attribute declarations of a schema so it can be stored in the DB
+func encodeSchema(schema *Schema) (data []byte) {
+	if schema.Strict {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = appendUvarint(data, uint64(len(schema.Attributes)))
+	for name, attribute := range schema.Attributes {
+		data = appendUvarint(data, uint64(len(name)))
+		data = append(data, []byte(name)...)
+		data = append(data, attribute.DataType)
+		if attribute.Required {
+			data = append(data, 1)
+		} else {
+			data = append(data, 0)
+		}
+		if attribute.Default == nil {
+			data = append(data, 0)
+			continue
+		}
+		data = append(data, 1)
+		data = appendUvarint(data, uint64(len(attribute.Default.Data)))
+		data = append(data, attribute.Default.Data...)
+	}
+	return data
+}
+
+func decodeSchema(prefix string, data []byte) (*Schema, error) {
+	schema := &Schema{
+		Prefix:     prefix,
+		Attributes: make(map[string]*AttributeSchema),
+	}
+	if len(data) < 1 {
+		return nil, newErrInvalidSchema(prefix, "stored schema is malformed")
+	}
+	schema.Strict = data[0] == 1
+	i := 1
+	numAttributes, n := binary.Uvarint(data[i:])
+	if n <= 0 {
+		return nil, newErrInvalidSchema(prefix, "stored schema is malformed")
+	}
+	i += n
+	for j := uint64(0); j < numAttributes; j++ {
+		nameSize, n := binary.Uvarint(data[i:])
+		if n <= 0 || i+n+int(nameSize)+3 > len(data) {
+			return nil, newErrInvalidSchema(prefix, "stored schema is malformed")
+		}
+		i += n
+		name := string(data[i : i+int(nameSize)])
+		i += int(nameSize)
+		attribute := &AttributeSchema{
+			DataType: data[i],
+			Required: data[i+1] == 1,
+		}
+		hasDefault := data[i+2] == 1
+		i += 3
+		if hasDefault {
+			defaultSize, n := binary.Uvarint(data[i:])
+			if n <= 0 || i+n+int(defaultSize) > len(data) {
+				return nil, newErrInvalidSchema(prefix, "stored schema is malformed")
+			}
+			i += n
+			attribute.Default = &Value{DataType: attribute.DataType, Data: data[i : i+int(defaultSize)]}
+			i += int(defaultSize)
+		}
+		schema.Attributes[name] = attribute
+	}
+	return schema, nil
+}
+
+// SetSchema declares or replaces the schema enforced on all writes to keys starting with the schema's prefix.
+// Existing entries are not checked against the new schema
+func (db *DB) SetSchema(schema *Schema) error {
+	err := schema.validate()
+	if err != nil {
+		return err
+	}
+	entry := &Entry{
+		Key:        schemaMetaPrefix + schema.Prefix,
+		Attributes: map[string]*Value{"schema": &Value{DataType: Bytes, Data: encodeSchema(schema)}},
+	}
+	err = db.oracle.commit(0, map[string]uint64{}, map[string]*Entry{entry.Key: entry})
+	if err != nil {
+		return err
+	}
+	db.schemaLock.Lock()
+	db.schemas[schema.Prefix] = schema
+	db.schemaLock.Unlock()
+	return nil
+}
+
+// RemoveSchema stops enforcing the schema declared for a prefix
+func (db *DB) RemoveSchema(prefix string) error {
+	entry := &Entry{
+		Key:        schemaMetaPrefix + prefix,
+		Attributes: nil,
+	}
+	err := db.oracle.commit(0, map[string]uint64{}, map[string]*Entry{entry.Key: entry})
+	if err != nil {
+		return err
+	}
+	db.schemaLock.Lock()
+	delete(db.schemas, prefix)
+	db.schemaLock.Unlock()
+	return nil
+}
+
+// applySchema enforces the schema with the longest prefix matching the key, if any
+func (db *DB) applySchema(key string, attributes map[string]*Value) (map[string]*Value, error) {
+	if isInternalKey(key) || attributes == nil {
+		return attributes, nil
+	}
+	db.schemaLock.RLock()
+	var match *Schema
+	for prefix, schema := range db.schemas {
+		if strings.HasPrefix(key, prefix) && (match == nil || len(prefix) > len(match.Prefix)) {
+			match = schema
+		}
+	}
+	db.schemaLock.RUnlock()
+	if match == nil {
+		return attributes, nil
+	}
+	return match.apply(key, attributes)
+}
+
+// loadSchemas reads all schemas stored in the DB
+func (db *DB) loadSchemas() error {
+	entries, err := db.scan(prefixRange(schemaMetaPrefix), math.MaxUint64)
+	if err != nil {
+		return err
+	}
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+	for _, entry := range entries {
+		if entry.Attributes == nil {
+			continue
+		}
+		value, ok := entry.Attributes["schema"]
+		if !ok {
+			continue
+		}
+		prefix := strings.TrimPrefix(entry.Key, schemaMetaPrefix)
+		schema, err := decodeSchema(prefix, value.Data)
+		if err != nil {
+			return err
+		}
+		db.schemas[prefix] = schema
+	}
+	return nil
+}
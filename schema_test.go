@@ -0,0 +1,142 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestSchemaEnforce(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	country, _ := CreateValue("unknown")
+	err = db.SetSchema(&Schema{
+		Prefix: "user:",
+		Attributes: map[string]*AttributeSchema{
+			"name":    &AttributeSchema{DataType: String, Required: true},
+			"age":     &AttributeSchema{DataType: Int},
+			"country": &AttributeSchema{DataType: String, Default: country},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error setting schema: %v\n", err)
+	}
+
+	name, _ := CreateValue("alice")
+	age, _ := CreateValue("30")
+	err = db.Insert("user:1", map[string]*Value{"name": name, "age": age})
+	if _, ok := err.(*ErrSchemaViolation); !ok {
+		t.Fatalf("Expected: ErrSchemaViolation for wrong type, Got: %v\n", err)
+	}
+	err = db.Insert("user:1", map[string]*Value{})
+	if _, ok := err.(*ErrSchemaViolation); !ok {
+		t.Fatalf("Expected: ErrSchemaViolation for missing attribute, Got: %v\n", err)
+	}
+
+	age, _ = CreateValue(int64(30))
+	err = db.Insert("user:1", map[string]*Value{"name": name, "age": age})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+	entry, err := db.Read("user:1", []string{"country"})
+	if err != nil {
+		t.Fatalf("Error reading from db: %v\n", err)
+	}
+	if string(entry.Attributes["country"].Data) != "unknown" {
+		t.Fatalf("Expected default country: unknown, Got: %v\n", string(entry.Attributes["country"].Data))
+	}
+
+	// Declared attributes cannot be cleared, so neither the default nor a missing required attribute hides it
+	cleared, _ := CreateValue(nil)
+	for _, attributes := range []map[string]*Value{
+		{"name": name, "country": cleared},
+		{"name": name, "country": nil},
+		{"name": cleared},
+	} {
+		err = db.Update("user:1", attributes)
+		if _, ok := err.(*ErrSchemaViolation); !ok {
+			t.Fatalf("Expected: ErrSchemaViolation for cleared attribute, Got: %v\n", err)
+		}
+	}
+	// Undeclared attributes are kept unchanged
+	err = db.Update("user:1", map[string]*Value{"nickname": cleared})
+	if err != nil {
+		t.Fatalf("Error updating db: %v\n", err)
+	}
+	entry, err = db.Read("user:1", []string{"nickname"})
+	if err != nil {
+		t.Fatalf("Error reading from db: %v\n", err)
+	}
+	if value := entry.Attributes["nickname"]; value == nil || value.DataType != Tombstone {
+		t.Fatalf("Expected undeclared attribute to be kept, Got: %v\n", value)
+	}
+
+	// Keys outside the prefix are not checked
+	err = db.Insert("other", map[string]*Value{"age": name})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+
+	db.Close()
+
+	db, err = NewDB("data")
+	if err != nil {
+		t.Fatalf("Error creating DB: %v\n", err)
+	}
+	err = db.Insert("user:2", map[string]*Value{"age": age})
+	if _, ok := err.(*ErrSchemaViolation); !ok {
+		t.Fatalf("Expected: ErrSchemaViolation after recovery, Got: %v\n", err)
+	}
+
+	err = db.RemoveSchema("user:")
+	if err != nil {
+		t.Fatalf("Error removing schema: %v\n", err)
+	}
+	err = db.Insert("user:2", map[string]*Value{"age": age})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+}
+
+func TestSchemaInvalid(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	value, _ := CreateValue(int64(1))
+	err = db.SetSchema(&Schema{
+		Prefix: "",
+		Attributes: map[string]*AttributeSchema{
+			"name": &AttributeSchema{DataType: String, Default: value},
+		},
+	})
+	if _, ok := err.(*ErrInvalidSchema); !ok {
+		t.Fatalf("Expected: ErrInvalidSchema, Got: %v\n", err)
+	}
+}
+
+func TestSchemaEncode(t *testing.T) {
+	value, _ := CreateValue(float64(1.5))
+	schema := &Schema{
+		Prefix: "test",
+		Strict: true,
+		Attributes: map[string]*AttributeSchema{
+			"a": &AttributeSchema{DataType: Float, Default: value},
+			"b": &AttributeSchema{DataType: Bytes, Required: true},
+		},
+	}
+	result, err := decodeSchema("test", encodeSchema(schema))
+	if err != nil {
+		t.Fatalf("Error decoding schema: %v\n", err)
+	}
+	if !result.Strict || len(result.Attributes) != 2 {
+		t.Fatalf("Expected: %v, Got: %v\n", schema, result)
+	}
+	if result.Attributes["a"].DataType != Float || compareValues(result.Attributes["a"].Default, value) != 0 {
+		t.Fatalf("Expected: %v, Got: %v\n", schema.Attributes["a"], result.Attributes["a"])
+	}
+	if result.Attributes["b"].DataType != Bytes || !result.Attributes["b"].Required || result.Attributes["b"].Default != nil {
+		t.Fatalf("Expected: %v, Got: %v\n", schema.Attributes["b"], result.Attributes["b"])
+	}
+}
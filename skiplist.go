@@ -0,0 +1,152 @@
+package db
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// skipListVersion is a version of a key in a skip list. Versions of a key are linked newest first
+type skipListVersion struct {
+	entry *Entry
+	next  *skipListVersion
+}
+
+// skipListNode is a key in a skip list with a link to the next node at each of its levels
+type skipListNode struct {
+	key      string
+	versions unsafe.Pointer // *skipListVersion
+	next     []unsafe.Pointer
+}
+
+// skipList is a concurrent skip list. Puts are serialized by a lock, while reads never take one: a new node is
+// fully built before it is linked in with an atomic store, and new versions of a key are prepended to its
+// versions the same way, so readers always see either the list before or after a put
+type skipList struct {
+	head   *skipListNode
+	height int32
+
+	writeLock sync.Mutex
+	rand      *rand.Rand
+}
+
+// newSkipList creates an empty skip list
+func newSkipList() *skipList {
+	return &skipList{
+		head: &skipListNode{
+			next: make([]unsafe.Pointer, skipListMaxHeight),
+		},
+		height: 1,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (node *skipListNode) nextNode(level int) *skipListNode {
+	return (*skipListNode)(atomic.LoadPointer(&node.next[level]))
+}
+
+func (node *skipListNode) latestVersion() *skipListVersion {
+	return (*skipListVersion)(atomic.LoadPointer(&node.versions))
+}
+
+// randomHeight returns the height of a new node. Each level has a 1 in skipListBranching chance of
+// also being in the level above
+func (list *skipList) randomHeight() int {
+	height := 1
+	for height < skipListMaxHeight && list.rand.Intn(skipListBranching) == 0 {
+		height++
+	}
+	return height
+}
+
+// seek returns the first node whose key is greater than or equal to the key. If prevs is not nil,
+// it is filled with the last node before the key at each level
+func (list *skipList) seek(key string, prevs []*skipListNode) *skipListNode {
+	node := list.head
+	for level := int(atomic.LoadInt32(&list.height)) - 1; level >= 0; level-- {
+		next := node.nextNode(level)
+		for next != nil && next.key < key {
+			node = next
+			next = node.nextNode(level)
+		}
+		if prevs != nil {
+			prevs[level] = node
+		}
+	}
+	return node.nextNode(0)
+}
+
+// Put inserts an entry into the skip list as the newest version of its key
+func (list *skipList) Put(entry *Entry) {
+	list.writeLock.Lock()
+	defer list.writeLock.Unlock()
+
+	var prevs [skipListMaxHeight]*skipListNode
+	for level := range prevs {
+		prevs[level] = list.head
+	}
+	node := list.seek(entry.Key, prevs[:])
+	if node != nil && node.key == entry.Key {
+		version := &skipListVersion{entry: entry, next: node.latestVersion()}
+		atomic.StorePointer(&node.versions, unsafe.Pointer(version))
+		return
+	}
+
+	height := list.randomHeight()
+	node = &skipListNode{
+		key:      entry.Key,
+		versions: unsafe.Pointer(&skipListVersion{entry: entry}),
+		next:     make([]unsafe.Pointer, height),
+	}
+	for level := 0; level < height; level++ {
+		node.next[level] = unsafe.Pointer(prevs[level].nextNode(level))
+	}
+	// Link the node from the bottom up, so a reader that finds it at a level can always follow it further down
+	for level := 0; level < height; level++ {
+		atomic.StorePointer(&prevs[level].next[level], unsafe.Pointer(node))
+	}
+	if int32(height) > atomic.LoadInt32(&list.height) {
+		atomic.StoreInt32(&list.height, int32(height))
+	}
+}
+
+// Find returns the newest version of the key with a ts before the given ts, or nil if there is none
+func (list *skipList) Find(key string, ts uint64) *Entry {
+	node := list.seek(key, nil)
+	if node == nil || node.key != key {
+		return nil
+	}
+	for version := node.latestVersion(); version != nil; version = version.next {
+		if version.entry.ts < ts {
+			return version.entry
+		}
+	}
+	return nil
+}
+
+// Scan returns the newest version before the given ts of every key within the range query
+func (list *skipList) Scan(keyRange *keyRange, ts uint64) []*Entry {
+	entries := []*Entry{}
+	for node := list.seek(keyRange.startKey, nil); node != nil && !keyRange.afterEnd(node.key); node = node.nextNode(0) {
+		for version := node.latestVersion(); version != nil; version = version.next {
+			if version.entry.ts < ts {
+				entries = append(entries, version.entry)
+				break
+			}
+		}
+	}
+	return entries
+}
+
+// Inorder returns all versions of all keys in key order, newest version first
+func (list *skipList) Inorder() []*Entry {
+	entries := []*Entry{}
+	for node := list.head.nextNode(0); node != nil; node = node.nextNode(0) {
+		for version := node.latestVersion(); version != nil; version = version.next {
+			entries = append(entries, version.entry)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSkipListBulk(t *testing.T) {
+	list := newSkipList()
+	for i := 4999; i >= 1000; i-- {
+		entry, err := createEntry(uint64(i), strconv.Itoa(i), map[string]interface{}{"value": strconv.Itoa(i)})
+		if err != nil {
+			t.Fatalf("Error creating data entry: %v\n", err)
+		}
+		list.Put(entry)
+	}
+
+	entries := list.Inorder()
+	if len(entries) != 4000 {
+		t.Fatalf("Expected 4000 entries, Got: %d\n", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Key != strconv.Itoa(i+1000) {
+			t.Fatalf("Expected Key: %v, Got %v\n", strconv.Itoa(i+1000), entry.Key)
+		}
+		if string(entry.Attributes["value"].Data) != strconv.Itoa(i+1000) {
+			t.Fatalf("Expected Value: %v, Got %v\n", strconv.Itoa(i+1000), string(entry.Attributes["value"].Data))
+		}
+	}
+
+	result := list.Scan(&keyRange{startKey: "2000", endKey: "2999"}, 10000)
+	if len(result) != 1000 || result[0].Key != "2000" || result[999].Key != "2999" {
+		t.Fatalf("Expected keys 2000 to 2999, Got: %d entries\n", len(result))
+	}
+	if result := list.Scan(&keyRange{startKey: "5", endKey: "6"}, 10000); len(result) != 0 {
+		t.Fatalf("Expected no entries past the last key, Got: %d\n", len(result))
+	}
+}
+
+func TestSkipListVersions(t *testing.T) {
+	list := newSkipList()
+	for ts := uint64(1); ts <= 5; ts++ {
+		list.Put(simpleEntry(ts*10, "key", strconv.Itoa(int(ts*10))))
+	}
+
+	if entry := list.Find("key", 10); entry != nil {
+		t.Fatalf("Expected no version before ts 10, Got: %v\n", entry.ts)
+	}
+	for _, ts := range []uint64{11, 30, 31, 1000} {
+		entry := list.Find("key", ts)
+		expected := (ts - 1) / 10 * 10
+		if expected > 50 {
+			expected = 50
+		}
+		if entry == nil || entry.ts != expected {
+			t.Fatalf("Expected version %d before ts %d, Got: %v\n", expected, ts, entry)
+		}
+	}
+	entries := list.Inorder()
+	for i, entry := range entries {
+		if entry.ts != uint64(50-10*i) {
+			t.Fatalf("Expected versions newest first, Got: %d at %d\n", entry.ts, i)
+		}
+	}
+	if entry := list.Find("missing", 1000); entry != nil {
+		t.Fatalf("Expected missing key to not be found\n")
+	}
+}
+
+func TestSkipListConcurrent(t *testing.T) {
+	list := newSkipList()
+	numKeys := 2000
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, 8)
+	done := make(chan struct{})
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := strconv.Itoa(10000 + rand.Intn(numKeys))
+				entry := list.Find(key, uint64(numKeys*2))
+				if entry != nil && entry.Key != key {
+					errChan <- newErrKeyNotFound()
+					return
+				}
+				entries := list.Scan(&keyRange{startKey: "10000", endKey: "19999"}, uint64(numKeys*2))
+				for i := 1; i < len(entries); i++ {
+					if entries[i-1].Key >= entries[i].Key {
+						errChan <- newErrInvalidRange()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i, key := range rand.Perm(numKeys) {
+		list.Put(simpleEntry(uint64(i), strconv.Itoa(10000+key), strconv.Itoa(i)))
+	}
+	close(done)
+	wg.Wait()
+	close(errChan)
+	for err := range errChan {
+		t.Fatalf("Error reading skip list while writing: %v\n", err)
+	}
+	if entries := list.Inorder(); len(entries) != numKeys {
+		t.Fatalf("Expected %d entries, Got: %d\n", numKeys, len(entries))
+	}
+}
+
+func TestDBSkipListMemTable(t *testing.T) {
+	// The default options and zero value options both use the AVL tree
+	if DefaultOptions().MemTableType != (Options{}).MemTableType {
+		t.Fatalf("Expected default memtable type to match the zero value, Got: %d\n", DefaultOptions().MemTableType)
+	}
+	opts := DefaultOptions()
+	opts.MemTableType = SkipListMemTable
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	if _, ok := db.mutable.table.(*skipList); !ok {
+		t.Fatalf("Expected skip list memtable, Got: %T\n", db.mutable.table)
+	}
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	entries, err := db.Scan("10000", []string{"value"})
+	if err != nil {
+		t.Fatalf("Error scanning db: %v\n", err)
+	}
+	if len(entries) != 1000 {
+		t.Fatalf("Scan length, Expected: %d, Got: %d\n", 1000, len(entries))
+	}
+}
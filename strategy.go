@@ -0,0 +1,213 @@
+package db
+
+import (
+	"os"
+	"time"
+)
+
+// CompactionStrategy decides which SST files are compacted and where their entries end up. It is selected with
+// Options.CompactionStrategy when the DB is opened
+type CompactionStrategy interface {
+	// pick returns the next compaction to run, or nil if no compaction is needed
+	pick(lsm *lsm) *compaction
+	// l0Trigger returns the amount of level 0 files at which level 0 is compacted, or 0 if files stay in level 0
+	// until they are dropped. The level 0 write stall triggers are scaled by it
+	l0Trigger() int
+}
+
+// leveledCompaction keeps the files of every level below level 0 non overlapping, so a read checks at most one
+// file per level. Entries are rewritten every time they move down a level
+type leveledCompaction struct{}
+
+// LeveledCompaction returns the default compaction strategy. Levels whose size exceeds their capacity are merged
+// one file at a time into the files they overlap in the level below
+func LeveledCompaction() CompactionStrategy {
+	return &leveledCompaction{}
+}
+
+// pick returns a compaction for the level with the highest score. The last level is never compacted
+func (s *leveledCompaction) pick(lsm *lsm) *compaction {
+	best := -1
+	bestScore := 1.0
+	for i, level := range lsm.levels[:len(lsm.levels)-1] {
+		if score := level.score(); score >= bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	return lsm.levels[best].pickInputs()
+}
+
+func (s *leveledCompaction) l0Trigger() int {
+	return compactThreshold
+}
+
+// score returns how urgently the level needs compaction. Levels with a score of at least 1 are compacted.
+// Level 0 is scored by its amount of files since every read checks all of them, other levels by their size
+func (level *level) score() float64 {
+	level.manifestLock.RLock()
+	defer level.manifestLock.RUnlock()
+	if level.level == 0 {
+		return float64(len(level.manifest)) / float64(compactThreshold)
+	}
+	return float64(level.size) / float64(level.capacity)
+}
+
+// pickInputs picks the files of the level to compact. Files in level 0 overlap each other so all of them are
+// compacted together. Other levels pick the first file after the key where their last compaction ended, so
+// compactions go round robin over the key space
+func (level *level) pickInputs() *compaction {
+	files := level.sortedSSTFiles()
+	if len(files) == 0 {
+		return nil
+	}
+	inputs := files
+	if level.level > 0 {
+		picked := files[0]
+		for _, file := range files {
+			if file.keyRange.startKey > level.cursor {
+				picked = file
+				break
+			}
+		}
+		// Files written before levels were kept non overlapping may still overlap the picked file
+		inputs = level.expandInputs(picked.keyRange.startKey, picked.keyRange.endKey)
+		level.cursor = filesKeyRange(inputs).endKey
+	}
+	kr := filesKeyRange(inputs)
+	return &compaction{
+		level:          level.level,
+		output:         level.level + 1,
+		inputs:         inputs,
+		overlaps:       level.below.overlappingSSTFiles(kr.startKey, kr.endKey),
+		targetFileSize: level.opts.TargetFileSize,
+	}
+}
+
+// expandInputs returns the files in the level overlapping the range, along with every file that transitively
+// overlaps them, so that no version of a key is left behind in the level
+func (level *level) expandInputs(startKey, endKey string) []*sstFile {
+	inputs := level.overlappingSSTFiles(startKey, endKey)
+	for len(inputs) > 0 {
+		kr := filesKeyRange(inputs)
+		expanded := level.overlappingSSTFiles(kr.startKey, kr.endKey)
+		if len(expanded) == len(inputs) {
+			break
+		}
+		inputs = expanded
+	}
+	return inputs
+}
+
+// filesKeyRange returns the smallest key range containing all the files
+func filesKeyRange(files []*sstFile) *keyRange {
+	kr := &keyRange{
+		startKey: files[0].keyRange.startKey,
+		endKey:   files[0].keyRange.endKey,
+	}
+	for _, file := range files[1:] {
+		if file.keyRange.startKey < kr.startKey {
+			kr.startKey = file.keyRange.startKey
+		}
+		if file.keyRange.endKey > kr.endKey {
+			kr.endKey = file.keyRange.endKey
+		}
+	}
+	return kr
+}
+
+// tieredCompaction lets every level collect sorted runs, each a single SST file, and merges all runs of a level
+// into one run in the level below once there are enough of them. Runs in a level have similar sizes and entries
+// are rewritten once per level, at the cost of reads checking every run of a level
+type tieredCompaction struct {
+	runsPerLevel int
+}
+
+// TieredCompaction returns a size tiered compaction strategy that merges the runs of a level once it has
+// runsPerLevel of them. Runs in the last level are merged with each other
+func TieredCompaction(runsPerLevel int) CompactionStrategy {
+	if runsPerLevel < 2 {
+		runsPerLevel = 2
+	}
+	return &tieredCompaction{runsPerLevel: runsPerLevel}
+}
+
+func (s *tieredCompaction) l0Trigger() int {
+	return s.runsPerLevel
+}
+
+func (s *tieredCompaction) pick(lsm *lsm) *compaction {
+	for _, level := range lsm.levels {
+		files := level.sortedSSTFiles()
+		if len(files) < s.runsPerLevel {
+			continue
+		}
+		output := level.level + 1
+		if level.below == nil {
+			output = level.level
+		}
+		return &compaction{
+			level:  level.level,
+			output: output,
+			inputs: files,
+		}
+	}
+	return nil
+}
+
+// fifoCompaction never merges files. It drops the oldest files once the DB exceeds its size budget or files
+// exceed their max age
+type fifoCompaction struct {
+	maxSize int
+	maxAge  time.Duration
+}
+
+// FIFOCompaction returns a compaction strategy that deletes the oldest SST files while the total size of all SST
+// files exceeds maxSize, or files are older than maxAge. A maxSize or maxAge of 0 disables that limit
+func FIFOCompaction(maxSize int, maxAge time.Duration) CompactionStrategy {
+	return &fifoCompaction{
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+}
+
+// l0Trigger returns 0 since all files stay in level 0, and only the size and age limits bound their amount
+func (s *fifoCompaction) l0Trigger() int {
+	return 0
+}
+
+// pick returns a compaction that drops the oldest file if it is over budget
+func (s *fifoCompaction) pick(lsm *lsm) *compaction {
+	var oldest *sstFile
+	var oldestLevel int
+	var oldestTime time.Time
+	totalSize := 0
+	for _, level := range lsm.levels {
+		for _, file := range level.sortedSSTFiles() {
+			totalSize += file.size
+			info, err := os.Stat(file.filename)
+			if err != nil {
+				continue
+			}
+			if oldest == nil || info.ModTime().Before(oldestTime) {
+				oldest, oldestLevel, oldestTime = file, level.level, info.ModTime()
+			}
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	overSize := s.maxSize > 0 && totalSize > s.maxSize
+	overAge := s.maxAge > 0 && time.Since(oldestTime) > s.maxAge
+	if !overSize && !overAge {
+		return nil
+	}
+	return &compaction{
+		level:  oldestLevel,
+		output: oldestLevel,
+		inputs: []*sstFile{oldest},
+		drop:   true,
+	}
+}
@@ -0,0 +1,364 @@
+package db
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// table is an open SST file along with its decoded header and index block. A memory mapped table keeps
+// the mapping instead of the open file
+type table struct {
+	filename string
+	f        *os.File
+	mapping  []byte
+	header   *sstHeader
+	index    []*indexEntry
+
+	// refs counts the reads using the table. An evicted table is closed once its last read is done
+	refs    int
+	evicted bool
+}
+
+// tableCache keeps recently used SST files open with their index blocks decoded. It bounds the amount of
+// open files, including files being written, which prevents 'too many open files' errors
+type tableCache struct {
+	capacity int
+	open     int
+	mmap     bool
+	tables   map[string]*list.Element
+	order    *list.List
+	lock     sync.Mutex
+	cond     *sync.Cond
+}
+
+func newTableCache(capacity int, mmap bool) *tableCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	tc := &tableCache{
+		capacity: capacity,
+		mmap:     mmap,
+		tables:   make(map[string]*list.Element),
+		order:    list.New(),
+	}
+	tc.cond = sync.NewCond(&tc.lock)
+	return tc
+}
+
+// reserveLocked waits until another file can be opened, closing the least recently used idle table if needed.
+// The caller must hold the lock
+func (tc *tableCache) reserveLocked() {
+	for tc.open >= tc.capacity {
+		evicted := false
+		for element := tc.order.Back(); element != nil; element = element.Prev() {
+			t := element.Value.(*table)
+			if t.refs == 0 {
+				tc.removeLocked(element)
+				evicted = true
+				break
+			}
+		}
+		if !evicted {
+			tc.cond.Wait()
+		}
+	}
+	tc.open++
+}
+
+// reserve takes a slot for a file opened outside the table cache
+func (tc *tableCache) reserve() {
+	tc.lock.Lock()
+	tc.reserveLocked()
+	tc.lock.Unlock()
+}
+
+// unreserve gives back a slot taken by reserve once its file is closed
+func (tc *tableCache) unreserve() {
+	tc.lock.Lock()
+	tc.open--
+	tc.cond.Broadcast()
+	tc.lock.Unlock()
+}
+
+// removeLocked removes a table from the cache and closes it if no reads are using it. The caller must hold the lock
+func (tc *tableCache) removeLocked(element *list.Element) {
+	t := tc.order.Remove(element).(*table)
+	delete(tc.tables, t.filename)
+	t.evicted = true
+	if t.refs == 0 {
+		t.close()
+		tc.open--
+		tc.cond.Broadcast()
+	}
+}
+
+// acquire returns the open table for the file, opening it if it is not cached.
+// Every acquired table must be released
+func (tc *tableCache) acquire(filename string, cache *blockCache) (*table, error) {
+	tc.lock.Lock()
+	if element, ok := tc.tables[filename]; ok {
+		t := element.Value.(*table)
+		t.refs++
+		tc.order.MoveToFront(element)
+		tc.lock.Unlock()
+		return t, nil
+	}
+	tc.reserveLocked()
+	tc.lock.Unlock()
+
+	t, err := openTable(filename, cache, tc.mmap)
+	if err != nil {
+		tc.unreserve()
+		return nil, err
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if element, ok := tc.tables[filename]; ok {
+		// Another read opened the file at the same time
+		t.close()
+		tc.open--
+		tc.cond.Broadcast()
+		t = element.Value.(*table)
+		t.refs++
+		tc.order.MoveToFront(element)
+		return t, nil
+	}
+	t.refs = 1
+	tc.tables[filename] = tc.order.PushFront(t)
+	return t, nil
+}
+
+// release marks a read of the table as done
+func (tc *tableCache) release(t *table) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	t.refs--
+	if t.refs == 0 && t.evicted {
+		t.close()
+		tc.open--
+		tc.cond.Broadcast()
+	}
+}
+
+// evict removes a deleted or moved file from the cache. Reads already using it finish before it is closed
+// or unmapped
+func (tc *tableCache) evict(filename string) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	if element, ok := tc.tables[filename]; ok {
+		tc.removeLocked(element)
+	}
+}
+
+// close closes every cached table. It must only be called once no reads use the tables
+func (tc *tableCache) close() error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	var firstErr error
+	for element := tc.order.Front(); element != nil; element = tc.order.Front() {
+		t := tc.order.Remove(element).(*table)
+		delete(tc.tables, t.filename)
+		err := t.close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		tc.open--
+	}
+	tc.cond.Broadcast()
+	return firstErr
+}
+
+// openTable opens an SST file and decodes its header and index block, using the block cache if it has them.
+// If mmap is set the file is memory mapped and closed
+func openTable(filename string, cache *blockCache, mmap bool) (*table, error) {
+	f, err := os.OpenFile(filename, os.O_RDONLY, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{
+		filename: filename,
+		f:        f,
+	}
+	key := blockCacheKey{fileID: sstFileID(filename), offset: 0}
+	if value, ok := cache.get(key); ok {
+		cached := value.(*cachedIndex)
+		t.header, t.index = cached.header, cached.index
+	} else {
+		t.header, t.index, err = readIndex(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		cache.set(key, &cachedIndex{header: t.header, index: t.index}, indexCacheSize(t.index))
+	}
+	if !mmap {
+		return t, nil
+	}
+	t.mapping, err = mmapFile(f, int(t.header.size)+t.header.totalSize())
+	f.Close()
+	t.f = nil
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// close closes the file of the table or unmaps it
+func (t *table) close() error {
+	if t.mapping != nil {
+		err := munmapFile(t.mapping)
+		t.mapping = nil
+		return err
+	}
+	return t.f.Close()
+}
+
+// read returns size bytes of the file at offset. Bytes of a memory mapped table point into the mapping
+func (t *table) read(offset int64, size uint64) ([]byte, error) {
+	if t.mapping != nil {
+		if offset < 0 || uint64(offset)+size > uint64(len(t.mapping)) {
+			return nil, newErrReadUnexpectedBytes(t.filename)
+		}
+		return t.mapping[offset : uint64(offset)+size], nil
+	}
+	data := make([]byte, size)
+	numBytes, err := t.f.ReadAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	if numBytes != len(data) {
+		return nil, newErrReadUnexpectedBytes(t.filename)
+	}
+	return data, nil
+}
+
+// readBlock reads the decompressed contents of a data block. Uncompressed blocks of a memory mapped table are
+// copied since the entries decoded from them outlive the mapping
+func (t *table) readBlock(handle *indexEntry) ([]byte, error) {
+	data, err := t.read(t.header.dataOffset()+int64(handle.offset), handle.size)
+	if err != nil {
+		return nil, err
+	}
+	block, err := blockContents(t.header.version, data)
+	if err != nil {
+		return nil, err
+	}
+	if t.mapping != nil && (t.header.version < compressedVersion || CompressionType(data[0]) == NoCompression) {
+		block = append([]byte{}, block...)
+	}
+	return block, nil
+}
+
+// block returns the decompressed contents of a data block, reading it from the file if it is not in the block cache
+func (t *table) block(cache *blockCache, handle *indexEntry) ([]byte, error) {
+	key := blockCacheKey{fileID: sstFileID(t.filename), offset: uint64(t.header.dataOffset()) + handle.offset}
+	if value, ok := cache.get(key); ok {
+		return value.([]byte), nil
+	}
+	block, err := t.readBlock(handle)
+	if err != nil {
+		return nil, err
+	}
+	cache.set(key, block, len(block))
+	return block, nil
+}
+
+// find returns the latest version of the key older than ts. Versions of a key may continue in the next
+// data block when it is the last key of a block
+func (t *table) find(cache *blockCache, key string, ts uint64) (*Entry, error) {
+	blockIndex, err := findDataBlock(key, t.index)
+	if err != nil {
+		return nil, err
+	}
+	for ; blockIndex < len(t.index); blockIndex++ {
+		block, err := t.block(cache, t.index[blockIndex])
+		if err != nil {
+			return nil, err
+		}
+		entry, err := findKeyInBlock(key, ts, t.header.version, block)
+		if _, ok := err.(*ErrKeyNotFound); !ok || t.index[blockIndex].key != key {
+			return entry, err
+		}
+	}
+	return nil, newErrKeyNotFound()
+}
+
+// rangeScan returns all entries in the key range older than ts
+func (t *table) rangeScan(cache *blockCache, keyRange *keyRange, ts uint64) ([]*Entry, error) {
+	entries := []*Entry{}
+	startBlock, endBlock := rangeDataBlocks(keyRange, t.index)
+	for _, handle := range t.index[startBlock : endBlock+1] {
+		block, err := t.block(cache, handle)
+		if err != nil {
+			return nil, err
+		}
+		blockEntries, err := decodeBlock(t.header.version, block)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, blockEntries...)
+	}
+	return findKeysInBlocks(keyRange, ts, entries)
+}
+
+// entries reads and decodes every entry in the table without filling the block cache
+func (t *table) entries() ([]*Entry, error) {
+	if t.mapping != nil {
+		entries := []*Entry{}
+		for _, handle := range t.index {
+			block, err := t.readBlock(handle)
+			if err != nil {
+				return nil, err
+			}
+			blockEntries, err := decodeBlock(t.header.version, block)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, blockEntries...)
+		}
+		return entries, nil
+	}
+	data, err := t.read(t.header.dataOffset(), t.header.dataSize)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDataBlocks(t.header.version, data, 0, t.index)
+}
+
+// tableIterator reads the entries of a table in order one data block at a time, bypassing the block cache
+type tableIterator struct {
+	tables  *tableCache
+	t       *table
+	block   int
+	entries []*Entry
+	pos     int
+}
+
+// next returns the next entry of the table, or nil once all entries have been read
+func (it *tableIterator) next() (*Entry, error) {
+	for it.pos >= len(it.entries) {
+		if it.block >= len(it.t.index) {
+			return nil, nil
+		}
+		block, err := it.t.readBlock(it.t.index[it.block])
+		if err != nil {
+			return nil, err
+		}
+		it.entries, err = decodeBlock(it.t.header.version, block)
+		if err != nil {
+			return nil, err
+		}
+		it.block++
+		it.pos = 0
+	}
+	entry := it.entries[it.pos]
+	it.pos++
+	return entry, nil
+}
+
+// close releases the table. It must be called once the iterator is no longer used
+func (it *tableIterator) close() {
+	it.tables.release(it.t)
+}
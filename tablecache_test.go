@@ -0,0 +1,198 @@
+package db
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTableCacheMaxOpenFiles(t *testing.T) {
+	_, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	fm := newFileManager(newBlockCache(MB), 2, false)
+
+	filenames := []string{}
+	for i := 0; i < 5; i++ {
+		entries := []*Entry{}
+		for j := 0; j < 100; j++ {
+			key := strconv.Itoa(1000*(i+1) + j)
+			entries = append(entries, simpleEntry(uint64(j), key, key))
+		}
+		dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries, SnappyCompression)
+		if err != nil {
+			t.Fatalf("Error writing data entries: %v\n", err)
+		}
+		keyRangeEntry := createkeyRangeEntry(kr)
+		header := createHeader(len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry))
+		data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+		filename := "data/L0/table" + strconv.Itoa(i) + ".sst"
+		err = fm.Write(filename, data)
+		if err != nil {
+			t.Fatalf("Error writing to file: %v\n", err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	var wg sync.WaitGroup
+	errChan := make(chan error, 500)
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 100; j++ {
+			wg.Add(1)
+			go func(filename, key string) {
+				defer wg.Done()
+				entry, err := fm.Find(filename, key, 1000)
+				if err != nil {
+					errChan <- err
+				} else if string(entry.Attributes["value"].Data) != key {
+					errChan <- newErrKeyNotFound()
+				}
+			}(filenames[i], strconv.Itoa(1000*(i+1)+j))
+		}
+	}
+	wg.Wait()
+	close(errChan)
+	for err := range errChan {
+		t.Fatalf("Error finding key: %v\n", err)
+	}
+	if fm.tables.open > 2 {
+		t.Fatalf("Expected at most 2 open files, Got: %d\n", fm.tables.open)
+	}
+
+	// An evicted table stays open until the read using it is done
+	table, err := fm.tables.acquire(filenames[0], fm.cache)
+	if err != nil {
+		t.Fatalf("Error acquiring table: %v\n", err)
+	}
+	fm.Evict(filenames[0])
+	entry, err := table.find(fm.cache, "1000", 1000)
+	if err != nil || string(entry.Attributes["value"].Data) != "1000" {
+		t.Fatalf("Error reading evicted table: %v\n", err)
+	}
+	fm.tables.release(table)
+	if _, ok := fm.tables.tables[filenames[0]]; ok {
+		t.Fatalf("Expected evicted table to be removed from table cache\n")
+	}
+	if fm.tables.open > 1 {
+		t.Fatalf("Expected evicted table to be closed, Got %d open files\n", fm.tables.open)
+	}
+}
+
+func TestTableCacheMMap(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("Memory mapped reads are not supported on this platform")
+	}
+	_, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	fm := newFileManager(newBlockCache(MB), 10, true)
+
+	for _, compression := range []CompressionType{NoCompression, SnappyCompression} {
+		entries := []*Entry{}
+		for i := 1000; i < 3000; i++ {
+			key := strconv.Itoa(i)
+			entries = append(entries, simpleEntry(uint64(i), key, key))
+		}
+		dataBlocks, indexBlock, bloom, kr, err := writeEntries(entries, compression)
+		if err != nil {
+			t.Fatalf("Error writing data entries: %v\n", err)
+		}
+		keyRangeEntry := createkeyRangeEntry(kr)
+		header := createHeader(len(dataBlocks), len(indexBlock), len(bloom.bits), len(keyRangeEntry))
+		data := append(header, append(append(append(dataBlocks, indexBlock...), bloom.bits...), keyRangeEntry...)...)
+		filename := "data/L0/mmap" + strconv.Itoa(int(compression)) + ".sst"
+		err = fm.Write(filename, data)
+		if err != nil {
+			t.Fatalf("Error writing to file: %v\n", err)
+		}
+
+		table, err := fm.tables.acquire(filename, fm.cache)
+		if err != nil {
+			t.Fatalf("Error acquiring table: %v\n", err)
+		}
+		if table.mapping == nil {
+			t.Fatalf("Expected table to be memory mapped\n")
+		}
+		entry, err := fm.Find(filename, "1234", 10000)
+		if err != nil || string(entry.Attributes["value"].Data) != "1234" {
+			t.Fatalf("Error finding key: %v\n", err)
+		}
+		result, err := fm.Range(filename, &keyRange{startKey: "2000", endKey: "2099"}, 10000)
+		if err != nil || len(result) != 100 {
+			t.Fatalf("Error range query on file: %v\n", err)
+		}
+		all, err := fm.MMap(filename)
+		if err != nil || len(all) != len(entries) {
+			t.Fatalf("Error reading all entries: %v\n", err)
+		}
+
+		// A deleted file stays mapped until the reads using it are done
+		fm.Evict(filename)
+		err = os.Remove(filename)
+		if err != nil {
+			t.Fatalf("Error deleting file: %v\n", err)
+		}
+		entry, err = table.find(fm.cache, "2999", 10000)
+		if err != nil || string(entry.Attributes["value"].Data) != "2999" {
+			t.Fatalf("Error reading deleted table: %v\n", err)
+		}
+		fm.tables.release(table)
+		if table.mapping != nil {
+			t.Fatalf("Expected table to be unmapped after its last read\n")
+		}
+
+		// Values read through the mapping must stay valid after it is unmapped
+		for i, entry := range all {
+			if entry.Key != entries[i].Key || string(entry.Attributes["value"].Data) != entries[i].Key {
+				t.Fatalf("Entry %d, Expected: %v, Got: %v\n", i, entries[i].Key, entry.Key)
+			}
+		}
+		if string(result[0].Attributes["value"].Data) != result[0].Key {
+			t.Fatalf("Range result, Expected: %v, Got: %v\n", result[0].Key, string(result[0].Attributes["value"].Data))
+		}
+	}
+}
+
+func TestDBMMapReads(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MMapReads = true
+	opts.Compression = NoCompression
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	numKeys := 2000
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	time.Sleep(2 * time.Second)
+
+	for i := 0; i < numKeys; i += 3 {
+		key := strconv.Itoa(i)
+		entry, err := db.Read(key, []string{"value"})
+		if err != nil {
+			t.Fatalf("Error reading key %v: %v\n", key, err)
+		}
+		if string(entry.Attributes["value"].Data) != key {
+			t.Fatalf("Value expected: %v, Got: %v\n", key, string(entry.Attributes["value"].Data))
+		}
+	}
+	entries, err := db.Scan("", []string{"value"})
+	if err != nil {
+		t.Fatalf("Error scanning db: %v\n", err)
+	}
+	if len(entries) != numKeys {
+		t.Fatalf("Scan length, Expected: %d, Got: %d\n", numKeys, len(entries))
+	}
+}
@@ -1,5 +1,7 @@
 package db
 
+import "time"
+
 // Txn is Transaction struct for Optimistic Concurrency Control.
 type Txn struct {
 	db *DB
@@ -9,9 +11,28 @@ type Txn struct {
 
 	writeCache map[string]*Entry
 	readSet    map[string]uint64
+
+	discarded bool
+}
+
+// TxnStats reports the txns that are neither committed nor discarded. Value log files rewritten by garbage
+// collection are only deleted once every txn started before the rewrite is done, so a txn that is never committed
+// or discarded keeps them on disk for as long as the DB is open
+type TxnStats struct {
+	// Active is the amount of txns that are neither committed nor discarded
+	Active int
+	// Watermark is the start ts of the oldest active txn, or the ts of the next txn if there are none
+	Watermark uint64
+	// OldestAge is how long ago the oldest active txn started
+	OldestAge time.Duration
+	// PendingValueLogFiles is the amount of value log files rewritten by garbage collection that wait for the
+	// watermark to pass the ts they were rewritten at before they are deleted
+	PendingValueLogFiles int
 }
 
-// StartTxn returns a new Txn to perform ops on
+// StartTxn returns a new Txn to perform ops on. Until it is done, the txn pins the watermark below which value
+// log garbage collection deletes rewritten files. Commit ends the txn whether it succeeds or not, so only a txn
+// that is not committed, such as a read only txn, must be discarded
 func (db *DB) StartTxn() *Txn {
 	return &Txn{
 		db:         db,
@@ -23,6 +44,11 @@ func (db *DB) StartTxn() *Txn {
 
 // Read gets value for a key from the DB and updates the txn readSet
 func (txn *Txn) Read(key string) (*Entry, error) {
+	err := txn.db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.db.release()
 	entry, err := txn.db.read(key, txn.startTs)
 	if err != nil {
 		return nil, err
@@ -31,12 +57,18 @@ func (txn *Txn) Read(key string) (*Entry, error) {
 	return entry, nil
 }
 
-// Write updates the write cache of the txn
-func (txn *Txn) Write(key string, attributes map[string]*Value) {
+// Write updates the write cache of the txn. It returns ErrSchemaViolation if the attributes do not
+// match the schema declared for the key
+func (txn *Txn) Write(key string, attributes map[string]*Value) error {
+	attributes, err := txn.db.applySchema(key, attributes)
+	if err != nil {
+		return err
+	}
 	txn.writeCache[key] = &Entry{
 		Key:        key,
 		Attributes: attributes,
 	}
+	return nil
 }
 
 // Delete updates the write cache of the txn
@@ -49,14 +81,29 @@ func (txn *Txn) Delete(key string) {
 
 // Scan gets a range of values from a start key to an end key from the DB and updates the txn readSet
 func (txn *Txn) Scan(startKey, endKey string) ([]*Entry, error) {
-	kvs, err := txn.db.scan(startKey, endKey, txn.startTs)
+	return txn.scan(&keyRange{startKey: startKey, endKey: endKey})
+}
+
+// scan gets all values within the key range from the DB and updates the txn readSet
+func (txn *Txn) scan(keyRange *keyRange) ([]*Entry, error) {
+	err := txn.db.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer txn.db.release()
+	kvs, err := txn.db.scan(keyRange, txn.startTs)
 	if err != nil {
 		return nil, err
 	}
+	result := []*Entry{}
 	for _, kv := range kvs {
+		if isInternalKey(kv.Key) {
+			continue
+		}
 		txn.readSet[kv.Key] = kv.ts
+		result = append(result, kv)
 	}
-	return kvs, nil
+	return result, nil
 }
 
 // Exists checks if key exists in the db
@@ -73,10 +120,49 @@ func (txn *Txn) Exists(key string) (bool, error) {
 	return true, nil
 }
 
-// Commit sends the txn's read and write set to the oracle for commit
+// Discard ends the txn without committing its writes. Values the txn could read are kept in the
+// value log until every txn that started before they were rewritten is committed or discarded
+func (txn *Txn) Discard() {
+	if txn.discarded {
+		return
+	}
+	txn.discarded = true
+	txn.db.oracle.done(txn.startTs)
+}
+
+// Commit sends the txn's read and write set to the oracle for commit. The txn is done afterwards even if the
+// commit fails, so it does not need to be discarded
 func (txn *Txn) Commit() error {
 	if len(txn.writeCache) == 0 {
+		txn.Discard()
 		return nil
 	}
-	return txn.db.oracle.commit(txn.readSet, txn.writeCache)
+	for key := range txn.writeCache {
+		if isInternalKey(key) {
+			txn.Discard()
+			return newErrReservedKey(key)
+		}
+	}
+	err := txn.db.acquireWrite()
+	if err != nil {
+		txn.Discard()
+		return err
+	}
+	defer txn.db.release()
+	err = txn.db.throttleWrite()
+	if err != nil {
+		txn.Discard()
+		return err
+	}
+	txn.discarded = true
+	return txn.db.oracle.commit(txn.startTs, txn.readSet, txn.writeCache)
+}
+
+// TxnStats returns how many txns are active and how long the oldest one has been pinning the watermark
+func (db *DB) TxnStats() TxnStats {
+	stats := db.oracle.stats()
+	db.vlog.gcLock.Lock()
+	stats.PendingValueLogFiles = len(db.vlog.obsolete)
+	db.vlog.gcLock.Unlock()
+	return stats
 }
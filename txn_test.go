@@ -187,3 +187,49 @@ func TestTxnAbortWRW(t *testing.T) {
 		t.Fatalf("Wrong result from read Txn. Got: %v\n", string(result.Attributes["value"].Data))
 	}
 }
+
+func TestTxnCommitReleasesWatermark(t *testing.T) {
+	db, err := setupDB("data")
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	value, _ := CreateValue("value")
+	err = db.Insert("key", map[string]*Value{"value": value})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+	// Committed, aborted, empty, and failed txns are done without being discarded
+	committed := db.StartTxn()
+	committed.Read("key")
+	aborted := db.StartTxn()
+	aborted.Read("key")
+	empty := db.StartTxn()
+	reserved := db.StartTxn()
+	if stats := db.TxnStats(); stats.Active != 4 || stats.Watermark != committed.startTs {
+		t.Fatalf("Expected 4 active txns pinning the watermark at %d, Got: %+v\n", committed.startTs, stats)
+	}
+
+	committed.Write("key", map[string]*Value{"value": value})
+	err = committed.Commit()
+	if err != nil {
+		t.Fatalf("Error committing txn: %v\n", err)
+	}
+	aborted.Write("key", map[string]*Value{"value": value})
+	if _, ok := aborted.Commit().(*ErrTxnAbort); !ok {
+		t.Fatalf("Expected conflicting txn to abort\n")
+	}
+	err = empty.Commit()
+	if err != nil {
+		t.Fatalf("Error committing empty txn: %v\n", err)
+	}
+	reserved.writeCache[internalPrefix+"key"] = &Entry{Key: internalPrefix + "key"}
+	if _, ok := reserved.Commit().(*ErrReservedKey); !ok {
+		t.Fatalf("Expected txn writing an internal key to fail\n")
+	}
+
+	if stats := db.TxnStats(); stats.Active != 0 {
+		t.Fatalf("Expected committed txns to release the watermark, Got: %+v\n", stats)
+	}
+}
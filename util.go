@@ -26,6 +26,20 @@ func uint64ToBytes(u uint64) []byte {
 	return buf
 }
 
+// Converts a uint32 to a byte slice
+func uint32ToBytes(u uint32) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, u)
+	return buf
+}
+
+// appendUvarint appends the varint encoding of x to data
+func appendUvarint(data []byte, x uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, x)
+	return append(data, buf[:n]...)
+}
+
 // deleteData deletes all data from database
 func deleteData(directory string) error {
 	if _, err := os.Stat(directory); os.IsNotExist(err) {
@@ -0,0 +1,545 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// valueLog is an append only log of large attribute values. Flushing a memtable moves values above the
+// threshold into the log so SST files, and therefore compactions, only carry small pointers to them
+type valueLog struct {
+	directory string
+	threshold int
+	fileSize  int
+
+	files    map[uint32]*os.File
+	head     uint32
+	headSize int64
+	readOnly bool
+	fileLock sync.RWMutex
+
+	// obsolete maps files whose live values have been rewritten to the ts every txn must start at or after
+	// before the file can be deleted. It is only kept in memory. Once the DB is reopened, none of the values of
+	// these files are live anymore, so the next garbage collection deletes them right away
+	obsolete map[uint32]uint64
+	gcLock   sync.Mutex
+	deleter  *fileDeleter
+}
+
+// valueLocation points at a record in the value log
+type valueLocation struct {
+	fileID uint32
+	offset uint64
+	size   uint32
+}
+
+// valueRecord is a value in the value log along with the entry and attribute it belongs to.
+// The key and name let garbage collection check whether the value is still referenced
+type valueRecord struct {
+	key      string
+	ts       uint64
+	name     string
+	value    *Value
+	location *valueLocation
+}
+
+// newValueLog opens all value log files in the directory. New values are always appended to a new file
+// so a partially written record from a crash can only be at the end of a file. A read only value log opens
+// its files for reading and never creates the directory
+func newValueLog(directory string, opts *Options, readOnly bool) (*valueLog, error) {
+	directory = filepath.Join(directory, "vlog")
+	if !readOnly {
+		err := os.MkdirAll(directory, dirPerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	vlog := &valueLog{
+		directory: directory,
+		threshold: opts.ValueThreshold,
+		fileSize:  opts.ValueLogFileSize,
+		readOnly:  readOnly,
+		files:     make(map[uint32]*os.File),
+		obsolete:  make(map[uint32]uint64),
+		deleter:   &fileDeleter{},
+	}
+	err := vlog.openFiles()
+	if err != nil {
+		vlog.Close()
+		return nil, err
+	}
+	return vlog, nil
+}
+
+// fileIDs returns the ids of all value log files in the directory
+func (vlog *valueLog) fileIDs() (map[uint32]struct{}, error) {
+	infos, err := ioutil.ReadDir(vlog.directory)
+	if err != nil {
+		if vlog.readOnly && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	fileIDs := make(map[uint32]struct{})
+	for _, info := range infos {
+		id, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), ".vlog"), 10, 32)
+		if err != nil || !strings.HasSuffix(info.Name(), ".vlog") {
+			continue
+		}
+		fileIDs[uint32(id)] = struct{}{}
+	}
+	return fileIDs, nil
+}
+
+// openFiles opens the value log files in the directory that are not open yet
+func (vlog *valueLog) openFiles() error {
+	fileIDs, err := vlog.fileIDs()
+	if err != nil {
+		return err
+	}
+	flag := os.O_RDWR
+	if vlog.readOnly {
+		flag = os.O_RDONLY
+	}
+	vlog.fileLock.Lock()
+	defer vlog.fileLock.Unlock()
+	for id := range fileIDs {
+		if _, ok := vlog.files[id]; ok {
+			continue
+		}
+		f, err := os.OpenFile(vlog.filename(id), flag, filePerm)
+		if err != nil {
+			// A read only value log may see a file the primary removed after it was listed
+			if vlog.readOnly && os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		vlog.files[id] = f
+		if id >= vlog.head {
+			vlog.head = id + 1
+		}
+	}
+	return nil
+}
+
+func (vlog *valueLog) filename(fileID uint32) string {
+	return filepath.Join(vlog.directory, fmt.Sprintf("%06d.vlog", fileID))
+}
+
+func (location *valueLocation) value() *Value {
+	data := make([]byte, valuePointerSize)
+	binary.LittleEndian.PutUint32(data[:4], location.fileID)
+	binary.LittleEndian.PutUint64(data[4:12], location.offset)
+	binary.LittleEndian.PutUint32(data[12:], location.size)
+	return &Value{DataType: valuePointer, Data: data}
+}
+
+func decodeValueLocation(value *Value) (*valueLocation, error) {
+	if value.DataType != valuePointer || len(value.Data) != valuePointerSize {
+		return nil, newErrIncorrectValueSize(valuePointer, len(value.Data))
+	}
+	return &valueLocation{
+		fileID: binary.LittleEndian.Uint32(value.Data[:4]),
+		offset: binary.LittleEndian.Uint64(value.Data[4:12]),
+		size:   binary.LittleEndian.Uint32(value.Data[12:]),
+	}, nil
+}
+
+// encodeValueRecord encodes a value as its size and checksum followed by the key, ts, attribute name, and value
+func encodeValueRecord(entry *Entry, name string, value *Value) []byte {
+	body := appendUvarint([]byte{}, uint64(len(entry.Key)))
+	body = append(body, []byte(entry.Key)...)
+	body = append(body, uint64ToBytes(entry.ts)...)
+	body = appendUvarint(body, uint64(len(name)))
+	body = append(body, []byte(name)...)
+	body = append(body, value.DataType)
+	body = append(body, value.Data...)
+
+	data := make([]byte, valueLogHeaderSize)
+	binary.LittleEndian.PutUint32(data[:4], uint32(len(body)))
+	binary.LittleEndian.PutUint32(data[4:], crc32.ChecksumIEEE(body))
+	return append(data, body...)
+}
+
+// decodeValueRecord decodes the record at the start of data. It returns a nil record if data ends before the record does
+func decodeValueRecord(data []byte, location *valueLocation) (*valueRecord, error) {
+	if len(data) < valueLogHeaderSize {
+		return nil, nil
+	}
+	size := int(binary.LittleEndian.Uint32(data[:4]))
+	if len(data)-valueLogHeaderSize < size {
+		return nil, nil
+	}
+	body := data[valueLogHeaderSize : valueLogHeaderSize+size]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[4:8]) {
+		return nil, newErrCorruptValueLog(location.fileID, location.offset)
+	}
+	location.size = uint32(valueLogHeaderSize + size)
+
+	i := 0
+	keySize, n := binary.Uvarint(body)
+	if n <= 0 || uint64(len(body)-n) < keySize+timestampSize {
+		return nil, newErrCorruptValueLog(location.fileID, location.offset)
+	}
+	i += n
+	key := string(body[i : i+int(keySize)])
+	i += int(keySize)
+	ts := bytesToUint64(body[i : i+timestampSize])
+	i += timestampSize
+	nameSize, n := binary.Uvarint(body[i:])
+	if n <= 0 || uint64(len(body)-i-n) < nameSize+1 {
+		return nil, newErrCorruptValueLog(location.fileID, location.offset)
+	}
+	i += n
+	name := string(body[i : i+int(nameSize)])
+	i += int(nameSize)
+	return &valueRecord{
+		key:      key,
+		ts:       ts,
+		name:     name,
+		value:    &Value{DataType: body[i], Data: body[i+1:]},
+		location: location,
+	}, nil
+}
+
+// headFile returns the file new values are appended to and its size. A new file is started once the
+// current one reaches the max value log file size
+func (vlog *valueLog) headFile() (uint32, *os.File, int64, error) {
+	vlog.fileLock.Lock()
+	defer vlog.fileLock.Unlock()
+
+	f, ok := vlog.files[vlog.head]
+	if ok && vlog.headSize < int64(vlog.fileSize) {
+		return vlog.head, f, vlog.headSize, nil
+	}
+	if ok {
+		vlog.head++
+		vlog.headSize = 0
+	}
+	f, err := os.OpenFile(vlog.filename(vlog.head), os.O_CREATE|os.O_EXCL|os.O_RDWR, filePerm)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	vlog.files[vlog.head] = f
+	return vlog.head, f, 0, nil
+}
+
+// separate appends all values above the threshold to the value log and returns entries with those values
+// replaced by pointers. The given entries are never modified since they are still visible in the memtable
+func (vlog *valueLog) separate(entries []*Entry) ([]*Entry, error) {
+	var fileID uint32
+	var f *os.File
+	var offset int64
+	data := []byte{}
+	result := make([]*Entry, len(entries))
+	for i, entry := range entries {
+		result[i] = entry
+		for name, value := range entry.Attributes {
+			if value == nil || value.DataType == Tombstone || len(value.Data) <= vlog.threshold {
+				continue
+			}
+			if f == nil {
+				var err error
+				fileID, f, offset, err = vlog.headFile()
+				if err != nil {
+					return nil, err
+				}
+			}
+			if result[i] == entry {
+				attributes := make(map[string]*Value)
+				for name, value := range entry.Attributes {
+					attributes[name] = value
+				}
+				result[i] = &Entry{ts: entry.ts, Key: entry.Key, Attributes: attributes}
+			}
+			record := encodeValueRecord(entry, name, value)
+			location := &valueLocation{
+				fileID: fileID,
+				offset: uint64(offset) + uint64(len(data)),
+				size:   uint32(len(record)),
+			}
+			data = append(data, record...)
+			result[i].Attributes[name] = location.value()
+		}
+	}
+	if len(data) == 0 {
+		return result, nil
+	}
+	numBytes, err := f.WriteAt(data, offset)
+	if err != nil {
+		return nil, err
+	}
+	if numBytes != len(data) {
+		return nil, newErrWriteUnexpectedBytes(vlog.filename(fileID))
+	}
+	err = f.Sync()
+	if err != nil {
+		return nil, err
+	}
+	vlog.fileLock.Lock()
+	vlog.headSize = offset + int64(len(data))
+	vlog.fileLock.Unlock()
+	return result, nil
+}
+
+// read returns the value at the given location. The file cannot be deleted while it is being read
+func (vlog *valueLog) read(location *valueLocation) (*Value, error) {
+	vlog.fileLock.RLock()
+	defer vlog.fileLock.RUnlock()
+
+	f, ok := vlog.files[location.fileID]
+	if !ok {
+		return nil, newErrValueLogFileNotFound(location.fileID)
+	}
+	data := make([]byte, location.size)
+	numBytes, err := f.ReadAt(data, int64(location.offset))
+	if numBytes != len(data) {
+		if err != nil {
+			return nil, err
+		}
+		return nil, newErrReadUnexpectedBytes(vlog.filename(location.fileID))
+	}
+	record, err := decodeValueRecord(data, &valueLocation{fileID: location.fileID, offset: location.offset})
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, newErrCorruptValueLog(location.fileID, location.offset)
+	}
+	return record.value, nil
+}
+
+// resolve returns the entry with all value pointers replaced by the values they point at
+func (vlog *valueLog) resolve(entry *Entry) (*Entry, error) {
+	if entry == nil {
+		return nil, nil
+	}
+	var attributes map[string]*Value
+	for name, value := range entry.Attributes {
+		if value == nil || value.DataType != valuePointer {
+			continue
+		}
+		if attributes == nil {
+			attributes = make(map[string]*Value)
+			for name, value := range entry.Attributes {
+				attributes[name] = value
+			}
+		}
+		location, err := decodeValueLocation(value)
+		if err != nil {
+			return nil, err
+		}
+		attributes[name], err = vlog.read(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if attributes == nil {
+		return entry, nil
+	}
+	return &Entry{ts: entry.ts, Key: entry.Key, Attributes: attributes}, nil
+}
+
+// records reads every complete record in a value log file
+func (vlog *valueLog) records(fileID uint32) ([]*valueRecord, error) {
+	data, err := ioutil.ReadFile(vlog.filename(fileID))
+	if err != nil {
+		return nil, err
+	}
+	records := []*valueRecord{}
+	offset := 0
+	for offset < len(data) {
+		record, err := decodeValueRecord(data[offset:], &valueLocation{fileID: fileID, offset: uint64(offset)})
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			break
+		}
+		records = append(records, record)
+		offset += int(record.location.size)
+	}
+	return records, nil
+}
+
+// candidates returns every value log file that is no longer appended to, oldest first
+func (vlog *valueLog) candidates() []uint32 {
+	vlog.fileLock.RLock()
+	defer vlog.fileLock.RUnlock()
+
+	fileIDs := []uint32{}
+	for fileID := range vlog.files {
+		if fileID != vlog.head {
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	sort.Slice(fileIDs, func(i, j int) bool {
+		return fileIDs[i] < fileIDs[j]
+	})
+	return fileIDs
+}
+
+// deleteObsolete deletes rewritten files once the oldest active txn started after their values were rewritten
+func (vlog *valueLog) deleteObsolete(watermark uint64) error {
+	for fileID, ts := range vlog.obsolete {
+		if watermark < ts {
+			continue
+		}
+		vlog.fileLock.Lock()
+		f := vlog.files[fileID]
+		delete(vlog.files, fileID)
+		vlog.fileLock.Unlock()
+
+		if f != nil {
+			f.Close()
+		}
+		err := vlog.deleter.remove(vlog.filename(fileID))
+		if err != nil {
+			return err
+		}
+		delete(vlog.obsolete, fileID)
+	}
+	return nil
+}
+
+// Close closes all value log files
+func (vlog *valueLog) Close() error {
+	vlog.fileLock.Lock()
+	defer vlog.fileLock.Unlock()
+	var firstErr error
+	for fileID, f := range vlog.files {
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(vlog.files, fileID)
+	}
+	return firstErr
+}
+
+// isLive checks if the latest version of the record's entry still points at the record
+func (db *DB) isLive(record *valueRecord) (bool, error) {
+	entry, err := db.find(record.key, math.MaxUint64)
+	if err != nil {
+		if _, ok := err.(*ErrKeyNotFound); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	value, ok := entry.Attributes[record.name]
+	if !ok || value == nil || value.DataType != valuePointer {
+		return false, nil
+	}
+	location, err := decodeValueLocation(value)
+	if err != nil {
+		return false, err
+	}
+	return location.fileID == record.location.fileID && location.offset == record.location.offset, nil
+}
+
+// rewriteEntries creates new versions of the entries that still have values in the file, with all values
+// resolved so they are moved to the head of the value log on the next flush.
+// It must only be called by the oracle so no commits interleave between the liveness check and the write
+func (db *DB) rewriteEntries(fileID uint32, keys []string, ts uint64) ([]*Entry, error) {
+	entries := []*Entry{}
+	for _, key := range keys {
+		entry, err := db.find(key, math.MaxUint64)
+		if err != nil {
+			if _, ok := err.(*ErrKeyNotFound); ok {
+				continue
+			}
+			return nil, err
+		}
+		live := false
+		for _, value := range entry.Attributes {
+			if value == nil || value.DataType != valuePointer {
+				continue
+			}
+			location, err := decodeValueLocation(value)
+			if err != nil {
+				return nil, err
+			}
+			if location.fileID == fileID {
+				live = true
+			}
+		}
+		if !live {
+			continue
+		}
+		resolved, err := db.vlog.resolve(entry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &Entry{ts: ts, Key: key, Attributes: resolved.Attributes})
+	}
+	return entries, nil
+}
+
+// RunValueLogGC rewrites the live values of every value log file in which at least discardRatio of the bytes
+// belong to values that have been overwritten or deleted. Rewritten files are deleted once every txn that
+// could still read from them has been committed or discarded, so a leaked txn keeps them on disk, which TxnStats
+// reports. Files that are still waiting when the DB is closed are deleted by the first garbage collection after it
+// is reopened
+func (db *DB) RunValueLogGC(discardRatio float64) error {
+	err := db.acquireWrite()
+	if err != nil {
+		return err
+	}
+	defer db.release()
+	vlog := db.vlog
+	vlog.gcLock.Lock()
+	defer vlog.gcLock.Unlock()
+
+	for _, fileID := range vlog.candidates() {
+		if _, ok := vlog.obsolete[fileID]; ok {
+			continue
+		}
+		records, err := vlog.records(fileID)
+		if err != nil {
+			return err
+		}
+		keys := []string{}
+		seen := make(map[string]struct{})
+		total, discard := 0, 0
+		for _, record := range records {
+			total += int(record.location.size)
+			live, err := db.isLive(record)
+			if err != nil {
+				return err
+			}
+			if !live {
+				discard += int(record.location.size)
+				continue
+			}
+			if _, ok := seen[record.key]; !ok {
+				seen[record.key] = struct{}{}
+				keys = append(keys, record.key)
+			}
+		}
+		if total > 0 && float64(discard)/float64(total) < discardRatio {
+			continue
+		}
+		for i := 0; i < len(keys); i += gcBatchSize {
+			end := i + gcBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			err := db.oracle.rewrite(fileID, keys[i:end])
+			if err != nil {
+				return err
+			}
+		}
+		vlog.obsolete[fileID] = db.oracle.nextTs()
+	}
+	return vlog.deleteObsolete(db.oracle.watermark())
+}
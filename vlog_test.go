@@ -0,0 +1,274 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupDBWithOptions(directory string, opts *Options) (*DB, error) {
+	err := deleteData(directory)
+	if err != nil {
+		return nil, err
+	}
+	return NewDBWithOptions(directory, opts)
+}
+
+func largeValue(key string, version int) *Value {
+	value, _ := CreateValue(strings.Repeat(key+"-"+strconv.Itoa(version)+"|", 100))
+	return value
+}
+
+func checkLargeValues(db *DB, numKeys, version int) error {
+	return db.ViewTxn(func(txn *Txn) error {
+		for i := 0; i < numKeys; i++ {
+			key := strconv.Itoa(i)
+			entry, err := txn.Read(key)
+			if err != nil {
+				return err
+			}
+			if string(entry.Attributes["value"].Data) != string(largeValue(key, version).Data) {
+				return fmt.Errorf("Wrong value for key: %v", key)
+			}
+		}
+		return nil
+	})
+}
+
+func countPointers(db *DB) (int, error) {
+	count := 0
+	for _, level := range db.lsm.levels {
+		files, err := ioutil.ReadDir(level.directory)
+		if err != nil {
+			return 0, err
+		}
+		for _, info := range files {
+			entries, err := db.lsm.fm.MMap(filepath.Join(level.directory, info.Name()))
+			if err != nil {
+				return 0, err
+			}
+			for _, entry := range entries {
+				for _, value := range entry.Attributes {
+					if value.DataType == valuePointer {
+						count++
+					}
+				}
+			}
+		}
+	}
+	return count, nil
+}
+
+func TestValueLogSeparation(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueThreshold = 256
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	numKeys := 100
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(i)
+		small, _ := CreateValue(int64(i))
+		err := db.Insert(key, map[string]*Value{"value": largeValue(key, 0), "small": small})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	time.Sleep(1 * time.Second)
+
+	pointers, err := countPointers(db)
+	if err != nil {
+		t.Fatalf("Error reading SST files: %v\n", err)
+	}
+	if pointers == 0 {
+		t.Fatalf("Expected large values in SST files to be replaced by value log pointers\n")
+	}
+	err = checkLargeValues(db, numKeys, 0)
+	if err != nil {
+		t.Fatalf("Error reading large values: %v\n", err)
+	}
+	entries, err := db.Scan("", []string{"value", "small"})
+	if err != nil {
+		t.Fatalf("Error scanning db: %v\n", err)
+	}
+	if len(entries) != numKeys {
+		t.Fatalf("Scan length, Expected: %d, Got: %d\n", numKeys, len(entries))
+	}
+	for _, entry := range entries {
+		if string(entry.Attributes["value"].Data) != string(largeValue(entry.Key, 0).Data) {
+			t.Fatalf("Scan returned wrong value for key: %v\n", entry.Key)
+		}
+		if entry.Attributes["small"].DataType != Int {
+			t.Fatalf("Small value should not have been moved into the value log\n")
+		}
+	}
+
+	db.Close()
+
+	db, err = NewDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error creating DB: %v\n", err)
+	}
+	err = checkLargeValues(db, numKeys, 0)
+	if err != nil {
+		t.Fatalf("Error reading large values after recovery: %v\n", err)
+	}
+}
+
+func TestValueLogGC(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueThreshold = 256
+	opts.ValueLogFileSize = 4 * KB
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	numKeys := 100
+	for i := 0; i < numKeys; i++ {
+		key := strconv.Itoa(i)
+		err := db.Insert(key, map[string]*Value{"value": largeValue(key, 0)})
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	}
+	time.Sleep(1 * time.Second)
+
+	// A txn that started before the overwrites must still be able to read the old values after GC
+	snapshot := db.StartTxn()
+
+	for version := 1; version <= 2; version++ {
+		for i := 0; i < numKeys; i++ {
+			key := strconv.Itoa(i)
+			err := db.Update(key, map[string]*Value{"value": largeValue(key, version)})
+			if err != nil {
+				t.Fatalf("Error updating db: %v\n", err)
+			}
+		}
+	}
+	time.Sleep(1 * time.Second)
+
+	before := len(db.vlog.candidates())
+	err = db.RunValueLogGC(0.5)
+	if err != nil {
+		t.Fatalf("Error running value log GC: %v\n", err)
+	}
+	if len(db.vlog.obsolete) == 0 {
+		t.Fatalf("Expected value log GC to rewrite files\n")
+	}
+	if len(db.vlog.candidates()) < before {
+		t.Fatalf("Value log files were deleted while an older txn could still read them\n")
+	}
+	entry, err := snapshot.Read("0")
+	if err != nil {
+		t.Fatalf("Error reading from snapshot: %v\n", err)
+	}
+	if string(entry.Attributes["value"].Data) != string(largeValue("0", 0).Data) {
+		t.Fatalf("Snapshot read wrong value after value log GC\n")
+	}
+	snapshot.Discard()
+
+	err = db.RunValueLogGC(0.5)
+	if err != nil {
+		t.Fatalf("Error running value log GC: %v\n", err)
+	}
+	if len(db.vlog.obsolete) != 0 {
+		t.Fatalf("Expected rewritten value log files to be deleted, Got: %d remaining\n", len(db.vlog.obsolete))
+	}
+	if len(db.vlog.candidates()) >= before {
+		t.Fatalf("Expected fewer value log files than %d, Got: %d\n", before, len(db.vlog.candidates()))
+	}
+	err = checkLargeValues(db, numKeys, 2)
+	if err != nil {
+		t.Fatalf("Error reading large values after GC: %v\n", err)
+	}
+
+	db.Close()
+
+	db, err = NewDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error creating DB: %v\n", err)
+	}
+	err = checkLargeValues(db, numKeys, 2)
+	if err != nil {
+		t.Fatalf("Error reading large values after recovery: %v\n", err)
+	}
+}
+
+func TestValueLogGCLeakedTxn(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ValueThreshold = 256
+	opts.ValueLogFileSize = 4 * KB
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+
+	numKeys := 100
+	err = writeLargeValues(db, numKeys, 0)
+	if err != nil {
+		t.Fatalf("Error writing to db: %v\n", err)
+	}
+	// The txn is never committed or discarded, so it pins the watermark until the DB is closed
+	leaked := db.StartTxn()
+	for version := 1; version <= 2; version++ {
+		err = writeLargeValues(db, numKeys, version)
+		if err != nil {
+			t.Fatalf("Error writing to db: %v\n", err)
+		}
+	}
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+
+	before := len(db.vlog.candidates())
+	for i := 0; i < 2; i++ {
+		err = db.RunValueLogGC(0.5)
+		if err != nil {
+			t.Fatalf("Error running value log GC: %v\n", err)
+		}
+	}
+	if len(db.vlog.candidates()) < before {
+		t.Fatalf("Value log files were deleted while a leaked txn could still read them\n")
+	}
+	time.Sleep(10 * time.Millisecond)
+	stats := db.TxnStats()
+	if stats.Active != 1 || stats.Watermark != leaked.startTs || stats.OldestAge < 10*time.Millisecond {
+		t.Fatalf("Expected the leaked txn to pin the watermark at %d, Got: %+v\n", leaked.startTs, stats)
+	}
+	if stats.PendingValueLogFiles == 0 || stats.PendingValueLogFiles != len(db.vlog.obsolete) {
+		t.Fatalf("Expected rewritten files to wait for the watermark, Got: %+v\n", stats)
+	}
+
+	// The rewritten files are only tracked in memory, the first GC after reopening deletes them
+	db.Close()
+	db, err = NewDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error creating DB: %v\n", err)
+	}
+	defer db.Close()
+	if stats := db.TxnStats(); stats.Active != 0 || stats.PendingValueLogFiles != 0 {
+		t.Fatalf("Expected no active txns or pending files after reopening, Got: %+v\n", stats)
+	}
+	err = db.RunValueLogGC(0.5)
+	if err != nil {
+		t.Fatalf("Error running value log GC: %v\n", err)
+	}
+	if len(db.vlog.candidates()) >= before {
+		t.Fatalf("Expected fewer value log files than %d, Got: %d\n", before, len(db.vlog.candidates()))
+	}
+	if len(db.vlog.obsolete) != 0 {
+		t.Fatalf("Expected rewritten value log files to be deleted, Got: %d remaining\n", len(db.vlog.obsolete))
+	}
+	err = checkLargeValues(db, numKeys, 2)
+	if err != nil {
+		t.Fatalf("Error reading large values after GC: %v\n", err)
+	}
+}
@@ -0,0 +1,353 @@
+package db
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeStall is how much writes are held back while flushes or level 0 compactions fall behind
+type writeStall int
+
+const (
+	noStall writeStall = iota
+	// slowdownStall delays every write so flushes and compactions can catch up
+	slowdownStall
+	// stopStall holds writes until flushes or compactions catch up
+	stopStall
+)
+
+// WriteStallStats reports how often and for how long writes were slowed down or stopped
+type WriteStallStats struct {
+	// Slowdowns is the amount of writes delayed because level 0 has too many files
+	Slowdowns uint64
+	// SlowdownTime is the total time writes were delayed
+	SlowdownTime time.Duration
+	// MemTableStops is the amount of writes stopped because all immutable memtables were waiting to be flushed
+	MemTableStops uint64
+	// L0Stops is the amount of writes stopped because level 0 had too many files
+	L0Stops uint64
+	// StopTime is the total time writes were stopped
+	StopTime time.Duration
+	// Rejected is the amount of writes that returned ErrWriteStall instead of waiting
+	Rejected uint64
+}
+
+// writeController holds the state of the memtable queue and write stalls. Apart from memTableFull and the stats,
+// it is only used by db.run
+type writeController struct {
+	// memTableID is the id of the WAL of the mutable memtable. WAL ids only increase
+	memTableID uint64
+	// flushing is the oldest immutable memtable while it is flushed, nil if no flush is running
+	flushing *memTable
+	// flushFailed is set if the flush of the flushing memtable failed. It is retried every stall check interval
+	// until it failed maxBackgroundRetries times in a row, counted by flushErrors
+	flushFailed bool
+	flushErrors int
+	// rotateErrors is the amount of times in a row the WAL of a new memtable could not be created. The rotation is
+	// retried every stall check interval until it failed maxBackgroundRetries times in a row
+	rotateErrors int
+	// flushReqs are the Flush calls waiting for their memtable to be flushed
+	flushReqs []*flushRequest
+	// stalled are the writes that reached db.run while all memtables were full, in commit order
+	stalled []*writeRequest
+	// closing is set once Close is called. Writes that would be stalled from then on return ErrDBClosed
+	closing bool
+	// bloomsSize is the memory used by bloom filters at the last memory budget check
+	bloomsSize int
+
+	// memTableFull is 1 while the mutable memtable is full and the queue of immutable memtables is too, or while
+	// memtables wait to be flushed and the memory budget is exceeded
+	memTableFull int32
+
+	stats     WriteStallStats
+	statsLock sync.Mutex
+}
+
+// flushRequest is a Flush call. It returns once mt is flushed, which is the newest memtable at the time
+// of the call. A nil mt means the call is waiting for room in the immutable memtable queue
+type flushRequest struct {
+	mt      *memTable
+	errChan chan error
+}
+
+// stall returns how much writes should be held back, and why
+func (db *DB) stall() (writeStall, string) {
+	if atomic.LoadInt32(&db.wc.memTableFull) == 1 {
+		return stopStall, "memtable flush"
+	}
+	slowdown, stop := db.l0Triggers()
+	if stop == 0 {
+		return noStall, ""
+	}
+	numL0 := db.lsm.levels[0].numFiles()
+	if numL0 >= stop {
+		return stopStall, "level 0 compaction"
+	}
+	if numL0 >= slowdown {
+		return slowdownStall, "level 0 compaction"
+	}
+	return noStall, ""
+}
+
+// l0Triggers returns the level 0 slowdown and stop triggers for the compaction strategy. The options are set
+// for leveled compaction, which compacts level 0 at compactThreshold files, and are scaled up for strategies
+// that let more files collect in level 0 first. Both are 0 if the strategy never compacts level 0
+func (db *DB) l0Triggers() (slowdown, stop int) {
+	trigger := db.lsm.strategy.l0Trigger()
+	if trigger == 0 {
+		return 0, 0
+	}
+	slowdown, stop = db.opts.L0SlowdownWritesTrigger, db.opts.L0StopWritesTrigger
+	if trigger > compactThreshold {
+		slowdown = slowdown * trigger / compactThreshold
+		stop = stop * trigger / compactThreshold
+	}
+	return slowdown, stop
+}
+
+// throttleWrite holds back a commit while flushes or level 0 compactions fall behind. It runs before the commit
+// reaches the oracle so that txns can still start while writes are stopped. In non blocking mode, commits that
+// would be delayed or stopped return ErrWriteStall instead. Stopped commits return the background error once
+// the flush or compaction they wait for keeps failing, and ErrDBClosed once Close is called
+func (db *DB) throttleWrite() error {
+	start := time.Now()
+	stopped := false
+	defer func() {
+		if stopped {
+			db.wc.statsLock.Lock()
+			db.wc.stats.StopTime += time.Since(start)
+			db.wc.statsLock.Unlock()
+		}
+	}()
+
+	for {
+		err := db.lsm.bgErr.get()
+		if err != nil {
+			return err
+		}
+		stall, reason := db.stall()
+		if stall == noStall {
+			return nil
+		}
+		if db.opts.NonBlockingWrites {
+			db.wc.statsLock.Lock()
+			db.wc.stats.Rejected++
+			db.wc.statsLock.Unlock()
+			return newErrWriteStall(reason)
+		}
+		if stall == slowdownStall {
+			time.Sleep(writeSlowdownDelay)
+			db.wc.statsLock.Lock()
+			db.wc.stats.Slowdowns++
+			db.wc.stats.SlowdownTime += writeSlowdownDelay
+			db.wc.statsLock.Unlock()
+			return nil
+		}
+		if !stopped {
+			stopped = true
+			db.wc.statsLock.Lock()
+			if reason == "memtable flush" {
+				db.wc.stats.MemTableStops++
+			} else {
+				db.wc.stats.L0Stops++
+			}
+			db.wc.statsLock.Unlock()
+		}
+		select {
+		case <-db.closing:
+			return newErrDBClosed()
+		case <-time.After(writeStallCheckInterval):
+		}
+	}
+}
+
+// processWrite writes the request to the mutable memtable and queues it to be flushed once it is full. If the
+// mutable memtable is already full because the immutable memtable queue is too, it returns false and the request
+// must be retried once a flush is done
+func (db *DB) processWrite(req *writeRequest) bool {
+	if db.memTableFull() {
+		return false
+	}
+	err := db.mutable.Write(req.entries)
+	if err != nil {
+		req.errChan <- err
+		return true
+	}
+	// The write is in the mutable memtable even if it cannot be rotated
+	if db.mutable.size > MemTableSize || db.flushEarly() {
+		db.rotateMemTable()
+	}
+	db.updateMemTableFull()
+	req.errChan <- nil
+	return true
+}
+
+// processStalled retries stalled writes in order until the mutable memtable is full again
+func (db *DB) processStalled() {
+	for len(db.wc.stalled) > 0 {
+		req := db.wc.stalled[0]
+		db.wc.stalled = db.wc.stalled[1:]
+		if !db.processWrite(req) {
+			db.wc.stalled = append([]*writeRequest{req}, db.wc.stalled...)
+			return
+		}
+	}
+}
+
+// memTableFull returns whether writes have to wait for an immutable memtable to be flushed, either because the
+// mutable memtable is full or because the memtables are over the memory budget
+func (db *DB) memTableFull() bool {
+	return db.mutable.size > MemTableSize || (len(db.immutables) > 0 && db.overBudget())
+}
+
+// updateMemTableFull publishes whether writes have to wait for an immutable memtable to be flushed
+func (db *DB) updateMemTableFull() {
+	full := int32(0)
+	if db.memTableFull() {
+		full = 1
+	}
+	atomic.StoreInt32(&db.wc.memTableFull, full)
+}
+
+// rotateMemTable queues the mutable memtable to be flushed and replaces it with a new memtable with its own WAL.
+// It returns false if the immutable memtable queue is full, or if the WAL of the new memtable cannot be created.
+// Like a failed flush, a failed rotation is retried until it failed maxBackgroundRetries times in a row, then the
+// error becomes the background error and is returned
+func (db *DB) rotateMemTable() (bool, error) {
+	if len(db.immutables) >= db.opts.MaxImmutableMemTables {
+		return false, nil
+	}
+	mt, _, err := newMemTable(db.directory, strconv.FormatUint(db.wc.memTableID+1, 10), db.opts.MemTableType)
+	if err != nil {
+		db.wc.rotateErrors++
+		if db.wc.rotateErrors < maxBackgroundRetries {
+			return false, nil
+		}
+		db.wc.rotateErrors = 0
+		db.failWrites(err)
+		return false, db.lsm.bgErr.get()
+	}
+	db.wc.rotateErrors = 0
+	db.wc.memTableID++
+
+	db.memLock.Lock()
+	db.immutables = append(db.immutables, db.mutable)
+	db.mutable = mt
+	db.memLock.Unlock()
+
+	db.startFlush()
+	return true, nil
+}
+
+// startFlush sends the oldest immutable memtable to be flushed unless a flush is already running
+func (db *DB) startFlush() {
+	if db.wc.flushing != nil || len(db.immutables) == 0 {
+		return
+	}
+	db.wc.flushing = db.immutables[0]
+	db.flushChan <- db.wc.flushing
+}
+
+// processFlushRequests queues the mutable memtable of Flush calls to be flushed. A Flush call with an empty
+// mutable memtable waits for the newest immutable memtable, and returns right away if there is none
+func (db *DB) processFlushRequests() {
+	for i := 0; i < len(db.wc.flushReqs); {
+		req := db.wc.flushReqs[i]
+		if req.mt != nil {
+			i++
+			continue
+		}
+		if db.mutable.size > 0 {
+			// A failed rotation already returned the background error to all waiting Flush calls
+			rotated, err := db.rotateMemTable()
+			if err != nil || !rotated {
+				return
+			}
+		}
+		if len(db.immutables) == 0 {
+			req.errChan <- nil
+			db.wc.flushReqs = append(db.wc.flushReqs[:i], db.wc.flushReqs[i+1:]...)
+			continue
+		}
+		req.mt = db.immutables[len(db.immutables)-1]
+		i++
+	}
+}
+
+// replyFlushRequests returns the Flush calls waiting for the given memtable
+func (db *DB) replyFlushRequests(mt *memTable, err error) {
+	waiting := []*flushRequest{}
+	for _, req := range db.wc.flushReqs {
+		if req.mt == mt {
+			req.errChan <- err
+		} else {
+			waiting = append(waiting, req)
+		}
+	}
+	db.wc.flushReqs = waiting
+}
+
+// flushDone is called by db.run once a flush is done. The flushed memtable is removed from the queue and the next
+// one is flushed. A failed flush keeps the memtable in the queue until a retry succeeds. Once it failed
+// maxBackgroundRetries times in a row, it becomes the background error and all waiting Flush calls and writes
+// return it
+func (db *DB) flushDone(err error) {
+	mt := db.wc.flushing
+	db.wc.flushFailed = err != nil
+	if err != nil {
+		db.wc.flushErrors++
+		if db.wc.flushErrors >= maxBackgroundRetries {
+			db.wc.flushErrors = 0
+			db.failWrites(err)
+		}
+		return
+	}
+	db.wc.flushErrors = 0
+	db.memLock.Lock()
+	db.immutables = db.immutables[1:]
+	db.memLock.Unlock()
+	db.wc.flushing = nil
+
+	db.replyFlushRequests(mt, nil)
+	db.startFlush()
+	db.checkMemTables()
+}
+
+// failWrites makes the error the background error and returns it to all waiting Flush calls and writes
+func (db *DB) failWrites(err error) {
+	db.lsm.bgErr.set(err)
+	for _, req := range db.wc.flushReqs {
+		req.errChan <- db.lsm.bgErr.get()
+	}
+	db.wc.flushReqs = nil
+	for _, req := range db.wc.stalled {
+		req.errChan <- db.lsm.bgErr.get()
+	}
+	db.wc.stalled = nil
+}
+
+// checkMemTables retries a failed flush unless the DB is read only, then queues the mutable memtable if it filled
+// up while the immutable memtable queue was full or its rotation failed, and lets the Flush calls and writes
+// waiting for it continue. It also resizes the block cache to the memory budget
+func (db *DB) checkMemTables() {
+	db.applyMemoryBudget()
+	if db.wc.flushFailed && db.lsm.bgErr.get() == nil {
+		db.wc.flushFailed = false
+		db.flushChan <- db.wc.flushing
+	}
+	if db.mutable.size > MemTableSize || db.flushEarly() {
+		db.rotateMemTable()
+	}
+	db.processFlushRequests()
+	db.processStalled()
+	db.updateMemTableFull()
+}
+
+// WriteStallStats returns how often and for how long writes were slowed down or stopped
+func (db *DB) WriteStallStats() WriteStallStats {
+	db.wc.statsLock.Lock()
+	defer db.wc.statsLock.Unlock()
+	return db.wc.stats
+}
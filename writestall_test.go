@@ -0,0 +1,189 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// noCompaction is a compaction strategy that never compacts, so level 0 files pile up
+type noCompaction struct{}
+
+func (s *noCompaction) pick(lsm *lsm) *compaction {
+	return nil
+}
+
+func (s *noCompaction) l0Trigger() int {
+	return compactThreshold
+}
+
+// startStoppedWriters starts writers of 8 KB values until both memtables are full while the caller holds the value
+// log lock so the flush cannot finish. Then numWriters txns commit, which are stopped by the write stall before
+// they reach db.run. Every writer and txn sends the error that ends it on the returned channel
+func startStoppedWriters(db *DB, numWriters int) (chan error, error) {
+	errs := make(chan error, 2*numWriters)
+	value, _ := CreateValue(strings.Repeat("v", 8*KB))
+	// The txns start first since StartTxn waits for the oracle, which waits for the writes in db.run
+	txns := []*Txn{}
+	for w := 0; w < numWriters; w++ {
+		txn := db.StartTxn()
+		txn.Write("txn-"+strconv.Itoa(w), map[string]*Value{"value": value})
+		txns = append(txns, txn)
+	}
+	for w := 0; w < numWriters; w++ {
+		go func(w int) {
+			for i := 0; ; i++ {
+				key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				err := db.Insert(key, map[string]*Value{"value": value})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&db.wc.memTableFull) == 0 {
+		if time.Now().After(deadline) {
+			return errs, fmt.Errorf("Expected memtables to fill up while the flush is waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, txn := range txns {
+		go func(txn *Txn) {
+			errs <- txn.Commit()
+		}(txn)
+	}
+	for db.WriteStallStats().MemTableStops < uint64(numWriters) {
+		if time.Now().After(deadline) {
+			return errs, fmt.Errorf("Expected %d writes to stop, Got: %d", numWriters, db.WriteStallStats().MemTableStops)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errs, nil
+}
+
+// setupL0Files writes a level 0 file for each of the given amount of flushes
+func setupL0Files(db *DB, numFiles int) error {
+	for i := 0; i < numFiles; i++ {
+		key := strconv.Itoa(10000 + i)
+		value, _ := CreateValue(key)
+		err := db.Insert(key, map[string]*Value{"value": value})
+		if err != nil {
+			return err
+		}
+		err = db.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestWriteStallL0(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CompactionStrategy = &noCompaction{}
+	opts.L0SlowdownWritesTrigger = 2
+	opts.L0StopWritesTrigger = 3
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	err = setupL0Files(db, 2)
+	if err != nil {
+		t.Fatalf("Error writing level 0 files: %v\n", err)
+	}
+	value, _ := CreateValue("slow")
+	err = db.Insert("slow", map[string]*Value{"value": value})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+	if stats := db.WriteStallStats(); stats.Slowdowns != 1 {
+		t.Fatalf("Expected 1 slowed down write, Got: %d\n", stats.Slowdowns)
+	}
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatalf("Error flushing memtable: %v\n", err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		value, _ := CreateValue("stopped")
+		errChan <- db.Insert("stopped", map[string]*Value{"value": value})
+	}()
+	select {
+	case err := <-errChan:
+		t.Fatalf("Expected write to be stopped, Got: %v\n", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// Reads go on while writes are stopped
+	_, err = db.Read("slow", []string{"value"})
+	if err != nil {
+		t.Fatalf("Error reading key while writes are stopped: %v\n", err)
+	}
+
+	err = db.CompactRange("", "zzzzz")
+	if err != nil {
+		t.Fatalf("Error compacting range: %v\n", err)
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Fatalf("Error inserting into db: %v\n", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected write to continue after level 0 was compacted\n")
+	}
+	stats := db.WriteStallStats()
+	if stats.L0Stops != 1 || stats.StopTime < 200*time.Millisecond {
+		t.Fatalf("Expected 1 stopped write for at least 200ms, Got: %d for %v\n", stats.L0Stops, stats.StopTime)
+	}
+	entry, err := db.Read("stopped", []string{"value"})
+	if err != nil || string(entry.Attributes["value"].Data) != "stopped" {
+		t.Fatalf("Error reading stopped write: %v\n", err)
+	}
+}
+
+func TestWriteStallNonBlocking(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CompactionStrategy = &noCompaction{}
+	opts.L0SlowdownWritesTrigger = 2
+	opts.L0StopWritesTrigger = 3
+	opts.NonBlockingWrites = true
+	db, err := setupDBWithOptions("data", opts)
+	if err != nil {
+		t.Fatalf("Error setting up DB: %v\n", err)
+	}
+	defer db.Close()
+
+	err = setupL0Files(db, 2)
+	if err != nil {
+		t.Fatalf("Error writing level 0 files: %v\n", err)
+	}
+	value, _ := CreateValue("rejected")
+	err = db.Insert("rejected", map[string]*Value{"value": value})
+	if _, ok := err.(*ErrWriteStall); !ok {
+		t.Fatalf("Expected write stall error, Got: %v\n", err)
+	}
+	if stats := db.WriteStallStats(); stats.Rejected != 1 {
+		t.Fatalf("Expected 1 rejected write, Got: %d\n", stats.Rejected)
+	}
+	_, err = db.Read("rejected", []string{"value"})
+	if _, ok := err.(*ErrKeyNotFound); !ok {
+		t.Fatalf("Expected rejected write to not be applied, Got: %v\n", err)
+	}
+
+	err = db.CompactRange("", "zzzzz")
+	if err != nil {
+		t.Fatalf("Error compacting range: %v\n", err)
+	}
+	err = db.Insert("rejected", map[string]*Value{"value": value})
+	if err != nil {
+		t.Fatalf("Error inserting into db: %v\n", err)
+	}
+}